@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// JSON backup of an account
+
+// version of the archive format, it's increased when the format changes
+const ARCHIVE_VERSION = 1
+
+type ArchiveProfile struct {
+	Username string `json:"username"`
+	Fullname string `json:"fullname"`
+	Email    string `json:"email"`
+}
+
+// a task of an archive, the dependencies are stored as edges
+type ArchiveTask struct {
+	Id                uint     `json:"id"`
+	Title             string   `json:"title"`
+	Description       string   `json:"description"`
+	Location          string   `json:"location"`
+	Date              string   `json:"date"`
+	Time              string   `json:"time"`
+	Status            string   `json:"status"`
+	StartedAt         string   `json:"startedAt"`
+	CompletedAt       string   `json:"completedAt"`
+	EstimatedDuration uint     `json:"estimatedDuration"`
+	Tags              []string `json:"tags"`
+	DueDate           string   `json:"dueDate"`
+	DueTime           string   `json:"dueTime"`
+	Priority          string   `json:"priority"`
+	Recurrence        string   `json:"recurrence"`
+	// if the next occurrence gets the next tasks
+	RecurrenceCopyNext bool `json:"recurrenceCopyNext"`
+}
+
+type ArchiveTag struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// an entry of next_task_map
+type ArchiveEdge struct {
+	TaskId     uint `json:"taskId"`
+	NextTaskId uint `json:"nextTaskId"`
+}
+
+type Archive struct {
+	Version    int            `json:"version"`
+	ExportedAt string         `json:"exportedAt"`
+	Profile    ArchiveProfile `json:"profile"`
+	Tags       []ArchiveTag   `json:"tags"`
+	Tasks      []ArchiveTask  `json:"tasks"`
+	Edges      []ArchiveEdge  `json:"edges"`
+}
+
+func NewArchive(user User, tags []Tag, tasks []Task, now time.Time) Archive {
+	archive := Archive{
+		Version:    ARCHIVE_VERSION,
+		ExportedAt: now.UTC().Format(time.RFC3339),
+		Profile: ArchiveProfile{
+			Username: user.Username,
+			Fullname: user.Fullname,
+			Email:    user.Email,
+		},
+		Tags:  make([]ArchiveTag, 0, len(tags)),
+		Tasks: make([]ArchiveTask, 0, len(tasks)),
+		Edges: make([]ArchiveEdge, 0),
+	}
+	for _, tag := range tags {
+		archive.Tags = append(archive.Tags, ArchiveTag{tag.Name, tag.Color})
+	}
+	for _, task := range tasks {
+		archive.Tasks = append(archive.Tasks, ArchiveTask{
+			Id:                 task.Id,
+			Title:              task.Title,
+			Description:        task.Description,
+			Location:           task.Location,
+			Date:               task.Date,
+			Time:               task.Time,
+			Status:             task.Status,
+			StartedAt:          task.StartedAt,
+			CompletedAt:        task.CompletedAt,
+			EstimatedDuration:  task.EstimatedDuration,
+			Tags:               task.Tags,
+			DueDate:            task.DueDate,
+			DueTime:            task.DueTime,
+			Priority:           task.Priority,
+			Recurrence:         task.Recurrence,
+			RecurrenceCopyNext: task.RecurrenceCopyNext,
+		})
+		for _, nt := range task.NextTaskIds {
+			archive.Edges = append(archive.Edges, ArchiveEdge{task.Id, nt})
+		}
+	}
+	return archive
+}
+
+func parseArchiveTimestamp(timestamp string) (sql.NullTime, error) {
+	if timestamp == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return sql.NullTime{}, errors.New(fmt.Sprintf("Invalid timestamp '%s'", timestamp))
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// ArchiveTagsToRestore returns the valid tags of an archive, which are
+// restored by ImportTasks
+func ArchiveTagsToRestore(tags []ArchiveTag) []Tag {
+	restored := make([]Tag, 0, len(tags))
+	for _, tag := range tags {
+		if ValidateTagName(tag.Name) && ValidateColor(tag.Color) {
+			restored = append(restored, Tag{Name: tag.Name, Color: tag.Color})
+		}
+	}
+	return restored
+}
+
+// ImportArchive converts the tasks of an archive into tasks of an import, the
+// ids of the archive are only used to resolve the edges. An error is returned,
+// if the archive can't be imported at all.
+func ImportArchive(archive Archive) ([]ImportTask, []ImportResult, bool, error) {
+	if archive.Version < 1 || archive.Version > ARCHIVE_VERSION {
+		return nil, nil, false, errors.New(fmt.Sprintf("Unsupported archive version %d", archive.Version))
+	}
+	tasks := make([]ImportTask, len(archive.Tasks))
+	results := make([]ImportResult, len(archive.Tasks))
+	indexOfId := make(map[uint]int)
+	valid := true
+	for i, task := range archive.Tasks {
+		results[i].Index = i
+		results[i].Ref = fmt.Sprint(task.Id)
+		if _, duplicate := indexOfId[task.Id]; duplicate {
+			results[i].Error = fmt.Sprintf("Duplicate id %d", task.Id)
+			valid = false
+			continue
+		}
+		indexOfId[task.Id] = i
+		tasks[i].Task = CreateTask{
+			Title:              task.Title,
+			Description:        task.Description,
+			Location:           task.Location,
+			Date:               task.Date,
+			Time:               task.Time,
+			Status:             task.Status,
+			EstimatedDuration:  task.EstimatedDuration,
+			Tags:               task.Tags,
+			DueDate:            task.DueDate,
+			DueTime:            task.DueTime,
+			Priority:           task.Priority,
+			Recurrence:         task.Recurrence,
+			RecurrenceCopyNext: task.RecurrenceCopyNext,
+		}
+		if !ValidateCreateTask(&tasks[i].Task) {
+			results[i].Error = "Task is not valid"
+			valid = false
+			continue
+		}
+		var err error
+		if tasks[i].StartedAt, err = parseArchiveTimestamp(task.StartedAt); err != nil {
+			results[i].Error = err.Error()
+			valid = false
+			continue
+		}
+		if tasks[i].CompletedAt, err = parseArchiveTimestamp(task.CompletedAt); err != nil {
+			results[i].Error = err.Error()
+			valid = false
+		}
+	}
+	for i, edge := range archive.Edges {
+		from, ok := indexOfId[edge.TaskId]
+		if !ok {
+			return nil, nil, false, errors.New(fmt.Sprintf("Edge %d references unknown task %d", i, edge.TaskId))
+		}
+		to, ok := indexOfId[edge.NextTaskId]
+		if !ok {
+			return nil, nil, false, errors.New(fmt.Sprintf("Edge %d references unknown task %d", i, edge.NextTaskId))
+		}
+		tasks[to].addPreviousIndex(from)
+	}
+	if valid {
+		valid = checkImportCycle(tasks, results)
+	}
+	return tasks, results, valid, nil
+}
+
+// handleExportGet exports the tasks in the format of the query parameter
+// format: json (default, with the profile), csv or todo.txt
+func handleExportGet(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	format := r.URL.Query().Get("format")
+	var columns []CsvColumn
+	var delimiter rune
+	switch format {
+	case "", "json", "todo.txt":
+	case "csv":
+		var err error
+		columns, err = ParseCsvColumns(r.URL.Query().Get("columns"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		delimiter, err = ParseCsvDelimiter(r.URL.Query().Get("delimiter"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, "format must be one of 'json', 'csv' or 'todo.txt'", http.StatusBadRequest)
+		return
+	}
+	user, err := store.GetUser(username)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tasks, err := store.SelectAllTasks(username, TaskFilter{})
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tags, err := store.SelectTags(username)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("smart-todo-%s", username)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", CSV_CONTENT_TYPE+"; charset=utf-8")
+		w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", filename))
+		if err := RenderCsv(w, tasks, columns, delimiter); err != nil {
+			logger.Error.Println(err)
+		}
+	case "todo.txt":
+		w.Header().Set("Content-Type", TODO_TXT_CONTENT_TYPE+"; charset=utf-8")
+		w.Header().Add("Content-Disposition", "attachment; filename=\"todo.txt\"")
+		fmt.Fprint(w, RenderTodoTxt(tasks))
+	default:
+		w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", filename))
+		json.NewEncoder(w).Encode(NewArchive(user, tags, tasks, time.Now()))
+	}
+}
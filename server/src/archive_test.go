@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestImportArchive(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		// the edge from 1 to 2 is repeated
+		archive := `{"version": 1, "tasks": [
+			{"id": 1, "title": "a", "status": "open"},
+			{"id": 2, "title": "b", "status": "done", "completedAt": "2023-05-01T10:00:00Z"}
+		], "edges": [{"taskId": 1, "nextTaskId": 2}, {"taskId": 1, "nextTaskId": 2}]}`
+		var response importResponse
+		if status := c.upload("/import", JSON_CONTENT_TYPE, archive, &response); status != http.StatusCreated {
+			t.Fatalf("import responded with %d %+v", status, response)
+		}
+		ids := make(map[string]uint)
+		for _, item := range response.Items {
+			ids[item.Ref] = item.Id
+		}
+		if next := c.getTask(ids["1"]).NextTaskIds; !reflect.DeepEqual(next, []uint{ids["2"]}) {
+			t.Errorf("nextTaskIds of 1 are %v", next)
+		}
+
+		invalid := map[string]int{
+			`{"version": 2, "tasks": []}`: http.StatusBadRequest,
+			`{"version": 1, "tasks": [{"id": 1, "title": "a"}], "edges": [{"taskId": 1, "nextTaskId": 2}]}`: http.StatusBadRequest,
+			`{"version": 1, "tasks": [{"id": 1, "title": "a"}, {"id": 1, "title": "b"}]}`:                   http.StatusUnprocessableEntity,
+			`{"version": 1, "tasks": [{"id": 1, "title": "a"}], "edges": [{"taskId": 1, "nextTaskId": 1}]}`: http.StatusUnprocessableEntity,
+			`{"version": 1, "tasks": [{"id": 1, "title": "a", "completedAt": "yesterday"}]}`:                http.StatusUnprocessableEntity,
+		}
+		for archive, expected := range invalid {
+			var response importResponse
+			if status := c.upload("/import", JSON_CONTENT_TYPE, archive, &response); status != expected {
+				t.Errorf("import of %s responded with %d, want %d", archive, status, expected)
+			}
+		}
+		if tasks := c.getTasks(); len(tasks) != 2 {
+			t.Errorf("%d tasks exist after invalid imports", len(tasks))
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"smart-todo-server/graph"
+)
+
+type batchRequestOperation struct {
+	Action string `json:"action"`
+	// ids of tasks are numbers or temporary ids of tasks, which are created by
+	// earlier operations of the batch
+	Id         interface{} `json:"id"`
+	NextTaskId interface{} `json:"nextTaskId"`
+	// temporary id of a created task
+	TempId string `json:"tempId"`
+	// optional version of the task, which must not have changed
+	Version uint64          `json:"version"`
+	Task    json.RawMessage `json:"task"`
+}
+
+type batchRequest struct {
+	Operations []batchRequestOperation `json:"operations"`
+}
+
+// parseBatchTaskId converts an id of a task or a temporary id of an earlier
+// operation, which is returned as reference. Null is no task.
+func parseBatchTaskId(value interface{}, tempIds map[string]bool) (uint, string, string) {
+	switch id := value.(type) {
+	case nil:
+		return 0, "", ""
+	case float64:
+		if id < 0 || id != float64(uint(id)) {
+			return 0, "", "Invalid task id"
+		}
+		return uint(id), "", ""
+	case string:
+		if !tempIds[id] {
+			return 0, "", fmt.Sprintf("Unknown temporary id '%s'", id)
+		}
+		return 0, id, ""
+	}
+	return 0, "", "Invalid task id"
+}
+
+// extractTempIds removes the temporary ids from the id array of the key, the
+// remaining ids are parsed like without batch
+func extractTempIds(obj map[string]interface{}, key string, tempIds map[string]bool) ([]string, string) {
+	items, ok := obj[key].([]interface{})
+	if !ok {
+		return nil, ""
+	}
+	refs := make([]string, 0)
+	ids := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		ref, ok := item.(string)
+		if !ok {
+			ids = append(ids, item)
+			continue
+		}
+		if !tempIds[ref] {
+			return nil, fmt.Sprintf("Unknown temporary id '%s'", ref)
+		}
+		refs = append(refs, ref)
+	}
+	obj[key] = ids
+	return refs, ""
+}
+
+// parseBatchOperation validates an operation of a batch request, an error
+// message is returned, if it isn't valid. tempIds are the temporary ids of
+// the earlier operations, the temporary id of a create is added.
+func parseBatchOperation(op batchRequestOperation, tempIds map[string]bool) (BatchOperation, string) {
+	operation := BatchOperation{Action: op.Action, Version: op.Version, TempId: op.TempId}
+	var error string
+	operation.Id, operation.IdRef, error = parseBatchTaskId(op.Id, tempIds)
+	if error != "" {
+		return operation, error
+	}
+	operation.NextTaskId, operation.NextTaskRef, error = parseBatchTaskId(op.NextTaskId, tempIds)
+	if error != "" {
+		return operation, error
+	}
+	if op.TempId != "" && op.Action != BATCH_ACTION_CREATE {
+		return operation, "Only create takes a temporary id"
+	}
+	if tempIds[op.TempId] {
+		return operation, fmt.Sprintf("Temporary id '%s' is used twice", op.TempId)
+	}
+	var patchObj map[string]interface{}
+	if op.Action == BATCH_ACTION_CREATE || op.Action == BATCH_ACTION_UPDATE {
+		if len(op.Task) == 0 {
+			return operation, op.Action + " needs a task"
+		}
+		if err := json.Unmarshal(op.Task, &patchObj); err != nil || patchObj == nil {
+			return operation, "Can't parse task"
+		}
+		operation.NextTaskRefs, error = extractTempIds(patchObj, "nextTaskIds", tempIds)
+		if error != "" {
+			return operation, error
+		}
+		operation.PreviousTaskRefs, error = extractTempIds(patchObj, "previousTaskIds", tempIds)
+		if error != "" {
+			return operation, error
+		}
+	}
+	switch op.Action {
+	case BATCH_ACTION_CREATE:
+		data, err := json.Marshal(patchObj)
+		if err == nil {
+			err = json.Unmarshal(data, &operation.Task)
+		}
+		if err != nil {
+			return operation, "Can't parse task"
+		}
+		if !ValidateCreateTask(&operation.Task) {
+			return operation, "New Task is not valid"
+		}
+		if op.TempId != "" {
+			tempIds[op.TempId] = true
+		}
+	case BATCH_ACTION_UPDATE:
+		operation.Task, operation.PatchKeys, error = parsePatchTask(patchObj)
+		if error != "" {
+			return operation, error
+		}
+	case BATCH_ACTION_DELETE:
+	case BATCH_ACTION_LINK, BATCH_ACTION_UNLINK:
+		if op.Id == nil || op.NextTaskId == nil {
+			return operation, op.Action + " needs id and nextTaskId"
+		}
+	default:
+		return operation, fmt.Sprintf(
+			"action must be one of '%s', '%s', '%s', '%s' or '%s'",
+			BATCH_ACTION_CREATE, BATCH_ACTION_UPDATE, BATCH_ACTION_DELETE,
+			BATCH_ACTION_LINK, BATCH_ACTION_UNLINK,
+		)
+	}
+	return operation, ""
+}
+
+// parseBatchOperations validates the operations of a batch request. If an
+// operation isn't valid, its index and an error message are returned.
+func parseBatchOperations(request batchRequest) ([]BatchOperation, int, string) {
+	operations := make([]BatchOperation, 0, len(request.Operations))
+	tempIds := make(map[string]bool)
+	for i, op := range request.Operations {
+		operation, error := parseBatchOperation(op, tempIds)
+		if error != "" {
+			return nil, i, error
+		}
+		operations = append(operations, operation)
+	}
+	return operations, 0, ""
+}
+
+func handleTasksBatchPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	var request batchRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, "Can't parse json body", http.StatusBadRequest)
+		return
+	}
+	operations, index, error := parseBatchOperations(request)
+	if error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": error, "operation": index})
+		return
+	}
+	results, err := store.ApplyBatch(operations, user)
+	var batchErr *BatchError
+	var cycleErr *graph.CycleError
+	var versionErr *VersionError
+	if errors.As(err, &batchErr) {
+		status := http.StatusBadRequest
+		response := map[string]any{
+			"error":     batchErr.Err.Error(),
+			"operation": batchErr.Index,
+		}
+		if errors.As(err, &cycleErr) {
+			status = http.StatusConflict
+			response["cycle"] = cycleErr.Path
+		} else if errors.As(err, &versionErr) {
+			status = http.StatusPreconditionFailed
+		} else if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	} else if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type batchResponse struct {
+	Results []struct {
+		Action string `json:"action"`
+		Id     uint   `json:"id"`
+		TempId string `json:"tempId"`
+	} `json:"results"`
+	errorResponse
+}
+
+func TestTasksBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		existing := c.createTask(map[string]interface{}{"title": "existing"})
+		var response batchResponse
+		status := c.request("POST", "/tasks/batch", map[string]interface{}{"operations": []interface{}{
+			map[string]interface{}{"action": "create", "tempId": "a", "task": map[string]interface{}{"title": "a"}},
+			map[string]interface{}{"action": "create", "tempId": "b", "task": map[string]interface{}{
+				"title": "b", "previousTaskIds": []interface{}{"a", existing},
+			}},
+			map[string]interface{}{"action": "update", "id": existing, "version": 1, "task": map[string]interface{}{"title": "updated"}},
+		}}, &response)
+		if status != http.StatusOK || len(response.Results) != 3 {
+			t.Fatalf("batch responded with %d %+v", status, response)
+		}
+		a, b := response.Results[0].Id, response.Results[1].Id
+		if response.Results[0].TempId != "a" || response.Results[1].TempId != "b" {
+			t.Errorf("results of the creates are %+v", response.Results)
+		}
+		if next := c.getTask(a).NextTaskIds; !reflect.DeepEqual(next, []uint{b}) {
+			t.Errorf("nextTaskIds of the temporary id are %v", next)
+		}
+		if task := c.getTask(existing); task.Title != "updated" || !reflect.DeepEqual(task.NextTaskIds, []uint{b}) {
+			t.Errorf("updated task is %+v", task)
+		}
+
+		// nothing is applied, if an operation fails
+		tests := []struct {
+			name       string
+			operations []interface{}
+			status     int
+			operation  int
+		}{
+			{"cycle", []interface{}{
+				map[string]interface{}{"action": "create", "task": map[string]interface{}{"title": "c"}},
+				map[string]interface{}{"action": "link", "id": b, "nextTaskId": a},
+			}, http.StatusConflict, 1},
+			{"unknown temporary id", []interface{}{
+				map[string]interface{}{"action": "delete", "id": a},
+				map[string]interface{}{"action": "link", "id": "x", "nextTaskId": b},
+			}, http.StatusBadRequest, 1},
+			{"old version", []interface{}{
+				map[string]interface{}{"action": "update", "id": existing, "version": 1, "task": map[string]interface{}{"title": "x"}},
+			}, http.StatusPreconditionFailed, 0},
+			{"missing task", []interface{}{
+				map[string]interface{}{"action": "create", "task": map[string]interface{}{"title": "c"}},
+				map[string]interface{}{"action": "delete", "id": 99},
+			}, http.StatusNotFound, 1},
+		}
+		for _, test := range tests {
+			var response batchResponse
+			status := c.request("POST", "/tasks/batch", map[string]interface{}{"operations": test.operations}, &response)
+			if status != test.status || response.Operation == nil || *response.Operation != test.operation {
+				t.Errorf("%s: batch responded with %d %+v", test.name, status, response.errorResponse)
+			}
+		}
+		if tasks := c.getTasks(); len(tasks) != 3 {
+			t.Errorf("%d tasks exist after failed batches", len(tasks))
+		}
+	})
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -13,14 +15,26 @@ type Conf struct {
 		Port     int    `yaml:"port"`
 		ApiPath  string `yaml:"apiPath"`
 		TokenTTL int    `yaml:"tokenTTL"`
+		// days, after which the changes are deleted from the change log
+		ChangeLogTTL int `yaml:"changeLogTTL"`
+		// networks in CIDR notation of the proxies, whose X-Forwarded-For
+		// header is used as ip of the client
+		TrustedProxies []string `yaml:"trustedProxies"`
 	} `yaml:"server"`
 	Database struct {
+		Driver   string `yaml:"driver"`
+		Path     string `yaml:"path"`
 		Domain   string `yaml:"domain"`
 		Port     int    `yaml:"port"`
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 		Database string `yaml:"database"`
 	} `yaml:"database"`
+	Webhooks struct {
+		// networks in CIDR notation, which webhooks may call, although they
+		// are loopback, private or link-local networks
+		AllowedNetworks []string `yaml:"allowedNetworks"`
+	} `yaml:"webhooks"`
 	Debug struct {
 		TokenMap map[string]string `yaml:"tokenMap"`
 	} `yaml:"debug"`
@@ -53,29 +67,61 @@ func (conf *Conf) readConfig() error {
 		conf.Server.TokenTTL = 7
 		logger.Warning.Println("token time to life not set, use 7 days")
 	}
-	if conf.Database.Domain == "" {
-		conf.Database.Domain = "localhost"
-		logger.Warning.Println("database domain not set, use \"localhost\"")
+	if conf.Server.ChangeLogTTL == 0 {
+		conf.Server.ChangeLogTTL = 30
+		logger.Warning.Println("change log time to life not set, use 30 days")
 	}
-	if conf.Database.Port == 0 {
-		conf.Database.Port = 5432
-		logger.Warning.Println("databse port not set, use 5432")
+	if conf.Database.Driver == "" {
+		conf.Database.Driver = DRIVER_POSTGRES
+		logger.Warning.Println("database driver not set, use \"postgres\"")
 	}
-	if conf.Database.Username == "" {
-		return errors.New("database username is not set")
+	switch conf.Database.Driver {
+	case DRIVER_POSTGRES:
+		if conf.Database.Domain == "" {
+			conf.Database.Domain = "localhost"
+			logger.Warning.Println("database domain not set, use \"localhost\"")
+		}
+		if conf.Database.Port == 0 {
+			conf.Database.Port = 5432
+			logger.Warning.Println("databse port not set, use 5432")
+		}
+		if conf.Database.Username == "" {
+			return errors.New("database username is not set")
+		}
+		if conf.Database.Password == "" {
+			return errors.New("database password is not set")
+		}
+		if conf.Database.Database == "" {
+			return errors.New("database name is not set")
+		}
+	case DRIVER_SQLITE:
+		if conf.Database.Path == "" {
+			conf.Database.Path = "smart-todo.db"
+			logger.Warning.Println("database path not set, use \"smart-todo.db\"")
+		}
+	case DRIVER_MEMORY:
+		logger.Warning.Println("memory database is used, all data is lost on shutdown")
+	default:
+		return errors.New(
+			"database driver must be one of \"postgres\", \"sqlite\" or \"memory\"",
+		)
 	}
-	if conf.Database.Password == "" {
-		return errors.New("database password is not set")
+	for _, network := range conf.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return errors.New(fmt.Sprintf("invalid network %s of the trusted proxies: %v", network, err))
+		}
 	}
-	if conf.Database.Database == "" {
-		return errors.New("database name is not set")
+	for _, network := range conf.Webhooks.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return errors.New(fmt.Sprintf("invalid network %s of the webhooks: %v", network, err))
+		}
 	}
 	if len(conf.Debug.TokenMap) > 0 {
 		logger.Warning.Println(
 			"You use an unsecure debug feature. " +
 				"The login token for some username will be initial set and " +
 				"some one can use this without knowing the password. " +
-				"A normal login will override the initial token",
+				"The session of the token is renewed on every start",
 		)
 	}
 	return nil
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CSV export and import of the tasks
+
+const CSV_CONTENT_TYPE = "text/csv"
+
+// fields of a task, which can be mapped to columns of a CSV file
+var CSV_FIELDS = []string{
+	"id",
+	"title",
+	"description",
+	"location",
+	"date",
+	"time",
+	"status",
+	"startedAt",
+	"completedAt",
+	"estimatedDuration",
+	"nextTaskIds",
+	"tags",
+	"dueDate",
+	"dueTime",
+	"priority",
+	"recurrence",
+	"recurrenceCopyNext",
+}
+
+// a column of a CSV file, which contains a field of the tasks
+type CsvColumn struct {
+	Header string
+	Field  string
+}
+
+func isCsvField(field string) bool {
+	for _, f := range CSV_FIELDS {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCsvColumns parses a column mapping like "Task:title,Start:date". A
+// column without field contains the field with the same name.
+func ParseCsvColumns(mapping string) ([]CsvColumn, error) {
+	columns := make([]CsvColumn, 0)
+	if mapping == "" {
+		return columns, nil
+	}
+	for _, entry := range strings.Split(mapping, ",") {
+		header, field, found := strings.Cut(entry, ":")
+		if !found {
+			field = header
+		}
+		header = strings.TrimSpace(header)
+		field = strings.TrimSpace(field)
+		if !isCsvField(field) {
+			return nil, errors.New(fmt.Sprintf(
+				"Unknown field '%s', must be one of %s", field, strings.Join(CSV_FIELDS, ", "),
+			))
+		}
+		columns = append(columns, CsvColumn{header, field})
+	}
+	return columns, nil
+}
+
+// ParseCsvDelimiter returns the delimiter of the CSV file, which is ',' by
+// default
+func ParseCsvDelimiter(delimiter string) (rune, error) {
+	if delimiter == "" {
+		return ',', nil
+	}
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || r == '"' || r == '\r' || r == '\n' {
+		return 0, errors.New(fmt.Sprintf("Invalid delimiter '%s'", delimiter))
+	}
+	return r, nil
+}
+
+func csvValue(task *Task, field string) string {
+	switch field {
+	case "id":
+		return fmt.Sprint(task.Id)
+	case "title":
+		return task.Title
+	case "description":
+		return task.Description
+	case "location":
+		return task.Location
+	case "date":
+		return task.Date
+	case "time":
+		return task.Time
+	case "status":
+		return task.Status
+	case "startedAt":
+		return task.StartedAt
+	case "completedAt":
+		return task.CompletedAt
+	case "estimatedDuration":
+		return fmt.Sprint(task.EstimatedDuration)
+	case "nextTaskIds":
+		ids := make([]string, 0, len(task.NextTaskIds))
+		for _, nt := range task.NextTaskIds {
+			ids = append(ids, fmt.Sprint(nt))
+		}
+		return strings.Join(ids, " ")
+	case "tags":
+		return strings.Join(task.Tags, " ")
+	case "dueDate":
+		return task.DueDate
+	case "dueTime":
+		return task.DueTime
+	case "priority":
+		return task.Priority
+	case "recurrence":
+		return task.Recurrence
+	case "recurrenceCopyNext":
+		return strconv.FormatBool(task.RecurrenceCopyNext)
+	}
+	return ""
+}
+
+// spreadsheet applications evaluate a cell starting with one of these
+// characters as a formula
+const CSV_FORMULA_PREFIXES = "=+-@\t\r"
+
+// escapeCsvValue prefixes a value, which would be evaluated as formula, with
+// a quote. A value starting with a quote is prefixed as well, so that
+// unescapeCsvValue returns every value unchanged.
+func escapeCsvValue(value string) string {
+	if value != "" && strings.ContainsRune(CSV_FORMULA_PREFIXES+"'", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeCsvValue removes the quote of a value escaped by escapeCsvValue
+func unescapeCsvValue(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune(CSV_FORMULA_PREFIXES+"'", rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
+
+// RenderCsv writes the tasks with a header row. Without columns all fields
+// are written. Values, which look like a formula, are escaped.
+func RenderCsv(w io.Writer, tasks []Task, columns []CsvColumn, delimiter rune) error {
+	if len(columns) == 0 {
+		for _, field := range CSV_FIELDS {
+			columns = append(columns, CsvColumn{field, field})
+		}
+	}
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	header := make([]string, 0, len(columns))
+	for _, column := range columns {
+		header = append(header, column.Header)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for i := range tasks {
+		record := make([]string, 0, len(columns))
+		for _, column := range columns {
+			record = append(record, escapeCsvValue(csvValue(&tasks[i], column.Field)))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// setCsvValue sets a field of an imported task, the next tasks are returned
+// as references
+func setCsvValue(task *ImportTask, field string, value string) ([]string, error) {
+	var err error
+	value = unescapeCsvValue(value)
+	switch field {
+	case "title":
+		task.Task.Title = value
+	case "description":
+		task.Task.Description = value
+	case "location":
+		task.Task.Location = value
+	case "date":
+		task.Task.Date = value
+	case "time":
+		task.Task.Time = value
+	case "status":
+		task.Task.Status = value
+	case "startedAt":
+		task.StartedAt, err = parseArchiveTimestamp(value)
+	case "completedAt":
+		task.CompletedAt, err = parseArchiveTimestamp(value)
+	case "estimatedDuration":
+		if value != "" {
+			duration, parseErr := strconv.ParseUint(value, 10, 32)
+			if parseErr != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid estimatedDuration '%s'", value))
+			}
+			task.Task.EstimatedDuration = uint(duration)
+		}
+	case "nextTaskIds":
+		return strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ',' || r == ';'
+		}), nil
+	case "tags":
+		task.Task.Tags = strings.FieldsFunc(value, func(r rune) bool {
+			return unicode.IsSpace(r) || r == ',' || r == ';'
+		})
+	case "dueDate":
+		task.Task.DueDate = value
+	case "dueTime":
+		task.Task.DueTime = value
+	case "priority":
+		task.Task.Priority = value
+	case "recurrence":
+		task.Task.Recurrence = value
+	case "recurrenceCopyNext":
+		if value != "" {
+			copyNext, parseErr := strconv.ParseBool(value)
+			if parseErr != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid recurrenceCopyNext '%s'", value))
+			}
+			task.Task.RecurrenceCopyNext = copyNext
+		}
+	}
+	return nil, err
+}
+
+// ImportCsv converts the rows of a CSV file with a header row into tasks. The
+// columns are mapped to the fields by the given columns or by their header.
+// The next tasks reference the id column, or the number of the row if there
+// is no id column or its cell is blank. An error is returned, if the file can't be imported at all.
+func ImportCsv(r io.Reader, columns []CsvColumn, delimiter rune) ([]ImportTask, []ImportResult, bool, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(records) == 0 {
+		return nil, nil, false, errors.New("CSV file has no header row")
+	}
+	header := records[0]
+	if len(header) > 0 {
+		// spreadsheet applications like to start the file with a byte order mark
+		header[0] = strings.TrimPrefix(header[0], "\uFEFF")
+	}
+
+	// field of every column, empty if the column is ignored
+	fields := make([]string, len(header))
+	for i, name := range header {
+		for _, field := range CSV_FIELDS {
+			if strings.EqualFold(strings.TrimSpace(name), field) {
+				fields[i] = field
+			}
+		}
+	}
+	for _, column := range columns {
+		found := false
+		for i, name := range header {
+			if strings.TrimSpace(name) == column.Header {
+				fields[i] = column.Field
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, false, errors.New(fmt.Sprintf("Column '%s' not found", column.Header))
+		}
+	}
+
+	rows := records[1:]
+	tasks := make([]ImportTask, len(rows))
+	results := make([]ImportResult, len(rows))
+	ids := make([]string, len(rows))
+	nextRefs := make([][]string, len(rows))
+	valid := true
+	for i, row := range rows {
+		results[i].Index = i
+		for j, field := range fields {
+			if field == "id" {
+				ids[i] = strings.TrimSpace(row[j])
+			}
+		}
+		results[i].Ref = ids[i]
+		if ids[i] == "" {
+			results[i].Ref = fmt.Sprint(i + 1)
+		}
+		for j, field := range fields {
+			if field == "" || field == "id" {
+				continue
+			}
+			refs, err := setCsvValue(&tasks[i], field, strings.TrimSpace(row[j]))
+			if err != nil {
+				results[i].Error = err.Error()
+				break
+			}
+			if refs != nil {
+				nextRefs[i] = refs
+			}
+		}
+		if results[i].Error == "" && !ValidateCreateTask(&tasks[i].Task) {
+			results[i].Error = "Task is not valid"
+		}
+		if results[i].Error != "" {
+			valid = false
+		}
+	}
+	if !linkImportTasks(tasks, results, ids, nextRefs) {
+		valid = false
+	}
+	if valid {
+		valid = checkImportCycle(tasks, results)
+	}
+	return tasks, results, valid, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCsvFormulaRoundTrip(t *testing.T) {
+	titles := []string{"=1+2", "+1", "-1", "@SUM(A1)", "'quoted", "'=1", "plain", "a=b"}
+	tasks := make([]Task, 0, len(titles))
+	for i, title := range titles {
+		tasks = append(tasks, Task{Id: uint(i + 1), Title: title, Status: STATUS_OPEN})
+	}
+	var buffer bytes.Buffer
+	columns := []CsvColumn{{"id", "id"}, {"title", "title"}}
+	if err := RenderCsv(&buffer, tasks, columns, ','); err != nil {
+		t.Fatalf("RenderCsv() returned %v", err)
+	}
+	for _, prefix := range []string{"\n1,=", "\n2,+", "\n3,-", "\n4,@"} {
+		if bytes.Contains(buffer.Bytes(), []byte(prefix)) {
+			t.Errorf("RenderCsv() rendered a formula:\n%s", buffer.String())
+		}
+	}
+	imported, results, valid, err := ImportCsv(&buffer, nil, ',')
+	if err != nil || !valid {
+		t.Fatalf("ImportCsv() returned %v %+v", err, results)
+	}
+	for i, task := range imported {
+		if task.Task.Title != titles[i] {
+			t.Errorf("title %q was imported as %q", titles[i], task.Task.Title)
+		}
+	}
+}
+
+func TestImportCsvIds(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		refs     []string
+		previous [][]int
+		valid    bool
+	}{
+		{
+			name:     "row numbers without id column",
+			data:     "title,nextTaskIds\na,2\nb,\n",
+			refs:     []string{"1", "2"},
+			previous: [][]int{nil, {0}},
+			valid:    true,
+		},
+		{
+			name:     "blank ids are row numbers",
+			data:     "id,title,nextTaskIds\n,a,x\nx,b,\n,c,1 x\n",
+			refs:     []string{"1", "x", "3"},
+			previous: [][]int{{2}, {0, 2}, nil},
+			valid:    true,
+		},
+		{
+			name:     "ids take precedence over row numbers",
+			data:     "id,title,nextTaskIds\n2,a,\n,b,2\n",
+			refs:     []string{"2", "2"},
+			previous: [][]int{{1}, nil},
+			valid:    true,
+		},
+		{
+			name:     "repeated next tasks",
+			data:     "id,title,nextTaskIds\na,a,b b;b\nb,b,\n",
+			refs:     []string{"a", "b"},
+			previous: [][]int{nil, {0}},
+			valid:    true,
+		},
+		{
+			name:  "duplicate ids",
+			data:  "id,title\na,a\na,b\n",
+			refs:  []string{"a", "a"},
+			valid: false,
+		},
+		{
+			name:  "unknown next task",
+			data:  "id,title,nextTaskIds\na,a,b\n",
+			refs:  []string{"a"},
+			valid: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tasks, results, valid, err := ImportCsv(bytes.NewBufferString(test.data), nil, ',')
+			if err != nil {
+				t.Fatalf("ImportCsv() returned %v", err)
+			}
+			if valid != test.valid {
+				t.Errorf("ImportCsv() is valid %v, want %v: %+v", valid, test.valid, results)
+			}
+			refs := make([]string, 0, len(results))
+			for _, result := range results {
+				refs = append(refs, result.Ref)
+			}
+			if !reflect.DeepEqual(refs, test.refs) {
+				t.Errorf("refs are %v, want %v", refs, test.refs)
+			}
+			if !test.valid {
+				return
+			}
+			for i, task := range tasks {
+				if !reflect.DeepEqual(task.PreviousIndexes, test.previous[i]) {
+					t.Errorf("previous indexes of row %d are %v, want %v", i+1, task.PreviousIndexes, test.previous[i])
+				}
+			}
+		})
+	}
+}
@@ -2,24 +2,50 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+
+	"smart-todo-server/graph"
 )
 
-const VOLATILE_FOREIGN_KEY_INSERT_UPDATE_ERROR_MSG = "pq: insert or update " +
-	"on table \"next_task_map\" violates foreign key constraint " +
-	"\"next_task_map_next_task_id_fkey\""
-const VOLATILE_FOREIGN_KEY_DELETE_UPDATE_ERROR_MSG = "pq: update or delete " +
-	"on table \"tasks\" violates foreign key constraint " +
-	"\"next_task_map_next_task_id_fkey\" on table \"next_task_map\""
 const NO_ROW_IN_OUTPUT_ERROR_MSG = "sql: no rows in result set"
 
+// columns of a task, which are expected by parseRowToTask
+const TASK_COLUMNS = "id, title, description, location, " +
+	"start_date, start_time, status, started_at, completed_at, estimated_duration, " +
+	"due_date, due_time, priority, recurrence, recurrence_copy_next, version"
+
+const SELECT_TASKS_QUERY = "SELECT " + TASK_COLUMNS + " FROM tasks "
+
+// the edges and tags of at most this many tasks are selected by the ids of
+// the tasks, for more tasks the ones of all tasks of the user are selected
+const MAX_SELECTED_TASK_IDS = 2 * TASKS_MAX_LIMIT
+
+// id which stands for a task, which is not yet inserted
+const NEW_TASK_ID = 0
+
+// queryer is implemented by sql.DB and sql.Tx
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Db stores everything in a PostgreSQL or SQLite database
 type Db struct {
 	db               *sql.DB
+	driver           string
+	pendingMutex     sync.Mutex
+	pending          map[*sql.Tx]*pendingEvents
 	regexExpressions struct {
 		regexDateReplace *regexp.Regexp
 		regexTimeReplace *regexp.Regexp
@@ -27,19 +53,37 @@ type Db struct {
 }
 
 func (db *Db) Connect(conf Conf) error {
-	connStr := fmt.Sprintf(
-		"host='%s' port=%d user='%s' password='%s' dbname='%s' sslmode=disable",
-		conf.Database.Domain,
-		conf.Database.Port,
-		conf.Database.Username,
-		conf.Database.Password,
-		conf.Database.Database,
-	)
 	var err error
-	db.db, err = sql.Open("postgres", connStr)
-	if err != nil {
-		return err
+	db.driver = conf.Database.Driver
+	switch db.driver {
+	case DRIVER_POSTGRES:
+		connStr := fmt.Sprintf(
+			"host='%s' port=%d user='%s' password='%s' dbname='%s' sslmode=disable",
+			conf.Database.Domain,
+			conf.Database.Port,
+			conf.Database.Username,
+			conf.Database.Password,
+			conf.Database.Database,
+		)
+		db.db, err = sql.Open("postgres", connStr)
+		if err != nil {
+			return err
+		}
+	case DRIVER_SQLITE:
+		connStr := fmt.Sprintf(
+			"file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)",
+			conf.Database.Path,
+		)
+		db.db, err = sql.Open("sqlite", connStr)
+		if err != nil {
+			return err
+		}
+		// sqlite allows only one writer at a time
+		db.db.SetMaxOpenConns(1)
+	default:
+		return errors.New(fmt.Sprintf("unsupported database driver %s", db.driver))
 	}
+	db.pending = make(map[*sql.Tx]*pendingEvents)
 	db.regexExpressions.regexDateReplace = regexp.MustCompile(
 		"^([0-9]{4}-[0-9]{2}-[0-9]{2})T[0-9]{2}:[0-9]{2}:[0-9]{2}Z$",
 	)
@@ -49,21 +93,307 @@ func (db *Db) Connect(conf Conf) error {
 	return nil
 }
 
-func (db *Db) Disconnect() error {
+func (db *Db) Close() error {
 	err := db.db.Close()
 	return err
 }
 
-func (db *Db) SelectAllTasks(user string) ([]Task, error) {
+// inTransaction runs fn inside of a transaction, which is committed, if fn
+// returns no error and rolled back otherwise. On PostgreSQL the transactions
+// of a user are serialized by an advisory lock, so the checks of fn (e.g. for
+// cycles) can't be raced by a concurrent transaction of the user. SQLite has
+// a single connection and serializes all transactions anyway. Transactions
+// without a user (migrations) aren't locked. The events of the transaction
+// are written to the change log, the versions of the tasks with update events
+// are incremented, the deliveries to the webhooks are queued and the events
+// are published after the commit.
+func (db *Db) inTransaction(user string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if user != "" && db.driver == DRIVER_POSTGRES {
+		// released on commit or rollback
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", user)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				logger.Error.Println(rollbackErr)
+			}
+			return err
+		}
+	}
+	pending := &pendingEvents{}
+	db.pendingMutex.Lock()
+	db.pending[tx] = pending
+	db.pendingMutex.Unlock()
+	defer func() {
+		db.pendingMutex.Lock()
+		delete(db.pending, tx)
+		db.pendingMutex.Unlock()
+	}()
+	err = fn(tx)
+	if err == nil {
+		err = db.insertChanges(tx, pending)
+	}
+	if err == nil {
+		err = db.incrementVersions(tx, pending.changedTaskIds())
+	}
+	queued := 0
+	if err == nil {
+		queued, err = db.insertDeliveries(tx, pending)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error.Println(rollbackErr)
+		}
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		pending.publish()
+		if queued > 0 {
+			notifyWebhookWorker()
+		}
+	}
+	return err
+}
+
+// emit adds an event about the tasks to the transaction
+func (db *Db) emit(tx *sql.Tx, user string, eventType string, taskIds ...uint) {
+	db.pendingMutex.Lock()
+	pending := db.pending[tx]
+	db.pendingMutex.Unlock()
+	pending.add(user, eventType, taskIds...)
+}
+
+// insertChanges writes the events to the change log. The ids are the cursors
+// of the sync, so the changes of a user must be committed in the order of
+// their ids. This holds, because the transactions of a user are serialized by
+// inTransaction.
+func (db *Db) insertChanges(tx *sql.Tx, pending *pendingEvents) error {
+	if len(pending.events) == 0 {
+		return nil
+	}
+	query := "INSERT INTO changes(username, type, task_id, created_at) VALUES "
+	values := make([]any, 0, 4*len(pending.events))
+	now := time.Now().UTC()
+	for i, event := range pending.events {
+		if i > 0 {
+			query += ", "
+		}
+		values = append(values, pending.user, event.Type, event.TaskId, now)
+		query += fmt.Sprintf(
+			"($%d, $%d, $%d, $%d)", len(values)-3, len(values)-2, len(values)-1, len(values),
+		)
+	}
+	_, err := tx.Exec(query, values...)
+	return err
+}
+
+func (db *Db) selectChangesPruned(q queryer) (uint64, error) {
+	var prunedUntil uint64
+	err := q.QueryRow("SELECT pruned_until FROM changes_pruned").Scan(&prunedUntil)
+	return prunedUntil, err
+}
+
+func (db *Db) SelectChanges(user string, since uint64) ([]Event, error) {
+	prunedUntil, err := db.selectChangesPruned(db.db)
+	if err != nil {
+		return nil, err
+	}
+	if since < prunedUntil {
+		return nil, &ExpiredCursorError{since}
+	}
 	rows, err := db.db.Query(
-		"SELECT id, title, description, location,"+
-			"start_date, start_time, array_agg(next_task_map.next_task_id) "+
-			"FROM tasks LEFT JOIN next_task_map ON id=next_task_map.task_id "+
-			"WHERE username= $1 GROUP BY id ORDER BY id", user,
+		"SELECT id, type, task_id FROM changes WHERE username = $1 AND id > $2 ORDER BY id",
+		user, since,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	changes := make([]Event, 0)
+	for rows.Next() {
+		var change Event
+		if err := rows.Scan(&change.Id, &change.Type, &change.TaskId); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// LastChange returns at least the last deleted change, so a user, whose
+// changes were all deleted, doesn't get an expired cursor
+func (db *Db) LastChange(user string) (uint64, error) {
+	var last uint64
+	err := db.db.QueryRow(
+		"SELECT COALESCE(MAX(id), 0) FROM changes WHERE username = $1", user,
+	).Scan(&last)
+	if err != nil {
+		return 0, err
+	}
+	prunedUntil, err := db.selectChangesPruned(db.db)
+	if prunedUntil > last {
+		last = prunedUntil
+	}
+	return last, err
+}
+
+// DeleteChanges deletes the changes up to the last change, which was created
+// before the time, so only a range of cursors expires
+func (db *Db) DeleteChanges(createdBefore time.Time) error {
+	return db.inTransaction("", func(tx *sql.Tx) error {
+		var last sql.NullInt64
+		err := tx.QueryRow(
+			"SELECT MAX(id) FROM changes WHERE created_at < $1", createdBefore,
+		).Scan(&last)
+		if err != nil || !last.Valid {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM changes WHERE id <= $1", last.Int64)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"UPDATE changes_pruned SET pruned_until = $1 WHERE pruned_until < $1", last.Int64,
+		)
+		return err
+	})
+}
+
+func (db *Db) incrementVersions(tx *sql.Tx, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query := "UPDATE tasks SET version = version + 1 WHERE id IN ("
+	values := make([]any, 0, len(ids))
+	for i, id := range ids {
+		if i > 0 {
+			query += ", "
+		}
+		values = append(values, id)
+		query += fmt.Sprintf("$%d", len(values))
+	}
+	_, err := tx.Exec(query+")", values...)
+	return err
+}
+
+// checkVersion returns a VersionError, if the task has another version. A
+// version of 0 and missing tasks aren't checked. PostgreSQL locks the task
+// until the end of the transaction, so it can't be changed after the check.
+func (db *Db) checkVersion(tx *sql.Tx, id uint, version uint64, user string) error {
+	if version == 0 {
+		return nil
+	}
+	query := "SELECT version FROM tasks WHERE id = $1 AND username = $2"
+	if db.driver == DRIVER_POSTGRES {
+		query += " FOR UPDATE"
+	}
+	var current uint64
+	err := tx.QueryRow(query, id, user).Scan(&current)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return nil
+		}
+		return err
+	}
+	if current != version {
+		return &VersionError{id, current}
+	}
+	return nil
+}
+
+func (db *Db) SelectAllTasks(user string, filter TaskFilter) ([]Task, error) {
+	query := SELECT_TASKS_QUERY + "WHERE username = $1"
+	values := []any{user}
+	if filter.Ids != nil {
+		// NULL keeps the list valid without ids
+		placeholders := []string{"NULL"}
+		for _, id := range filter.Ids {
+			values = append(values, id)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+		}
+		query += fmt.Sprintf(" AND id IN (%s)", strings.Join(placeholders, ", "))
+	}
+	if len(filter.Status) > 0 {
+		placeholders := make([]string, 0, len(filter.Status))
+		for _, status := range filter.Status {
+			values = append(values, status)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+		}
+		query += fmt.Sprintf(" AND status IN (%s)", strings.Join(placeholders, ", "))
+	}
+	if filter.DateFrom != "" {
+		values = append(values, filter.DateFrom)
+		query += fmt.Sprintf(" AND start_date >= $%d", len(values))
+	}
+	if filter.DateTo != "" {
+		values = append(values, filter.DateTo)
+		query += fmt.Sprintf(" AND start_date <= $%d", len(values))
+	}
+	if filter.Query != "" {
+		pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(
+			strings.ToLower(filter.Query),
+		)
+		values = append(values, "%"+pattern+"%")
+		n := len(values)
+		query += fmt.Sprintf(
+			" AND (LOWER(title) LIKE $%d ESCAPE '\\' "+
+				"OR LOWER(COALESCE(description, '')) LIKE $%d ESCAPE '\\' "+
+				"OR LOWER(COALESCE(location, '')) LIKE $%d ESCAPE '\\')",
+			n, n, n,
+		)
+	}
+	if filter.HasDependencies != nil {
+		not := ""
+		if !*filter.HasDependencies {
+			not = "NOT "
+		}
+		query += " AND " + not + "EXISTS (SELECT 1 FROM next_task_map WHERE next_task_id = tasks.id)"
+	}
+	if filter.HasDependents != nil {
+		not := ""
+		if !*filter.HasDependents {
+			not = "NOT "
+		}
+		query += " AND " + not + "EXISTS (SELECT 1 FROM next_task_map WHERE task_id = tasks.id)"
+	}
+	if filter.Tags != nil {
+		query += " AND " + tagExpressionSql(filter.Tags, &values)
+	}
+	sortExpression := taskSortExpression(filter.Sort)
+	direction, comparison := "", ">"
+	if filter.Descending {
+		direction, comparison = " DESC", "<"
+	}
+	if filter.After != nil {
+		var value any = filter.After.Value
+		switch sortExpression {
+		case "id":
+			value = filter.After.Id
+		case "estimated_duration":
+			value, _ = strconv.Atoi(filter.After.Value)
+		}
+		values = append(values, value, filter.After.Id)
+		query += fmt.Sprintf(
+			" AND (%s %s $%d OR (%s = $%d AND id %s $%d))",
+			sortExpression, comparison, len(values)-1,
+			sortExpression, len(values)-1, comparison, len(values),
+		)
+	}
+	if sortExpression == "id" {
+		query += " ORDER BY id" + direction
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s%s, id%s", sortExpression, direction, direction)
+	}
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := db.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
 	tasks := make([]Task, 0)
 	defer rows.Close()
 	for rows.Next() {
@@ -73,16 +403,214 @@ func (db *Db) SelectAllTasks(user string) ([]Task, error) {
 		}
 		tasks = append(tasks, task)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = db.selectNextTaskIds(db.db, user, tasks)
+	if err != nil {
+		return nil, err
+	}
+	err = db.selectTaskTags(db.db, user, tasks)
+	if err != nil {
+		return nil, err
+	}
 	return tasks, nil
 }
 
-func parseRowToTask(rows *sql.Rows, db *Db) (Task, error) {
+// SearchTasks uses the full-text search of PostgreSQL, SQLite uses the
+// in-process search
+func (db *Db) SearchTasks(user string, query string, limit uint) ([]SearchResult, error) {
+	if db.driver != DRIVER_POSTGRES {
+		tasks, err := db.SelectAllTasks(user, TaskFilter{})
+		if err != nil {
+			return nil, err
+		}
+		return SearchTasks(tasks, query, limit), nil
+	}
+	rows, err := db.db.Query(
+		"SELECT "+TASK_COLUMNS+", ts_rank(search_vector, query), "+
+			"ts_headline('simple', title, query, $3), "+
+			"ts_headline('simple', coalesce(description, ''), query, $4), "+
+			"ts_headline('simple', coalesce(location, ''), query, $3) "+
+			"FROM tasks, websearch_to_tsquery('simple', $2) query "+
+			"WHERE username = $1 AND search_vector @@ query "+
+			fmt.Sprintf("ORDER BY ts_rank(search_vector, query) DESC, id LIMIT %d", limit),
+		user, query, SEARCH_HEADLINE_OPTIONS, SEARCH_SNIPPET_OPTIONS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]SearchResult, 0)
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		var result SearchResult
+		var title, description, location string
+		result.Task, err = parseRowToTask(rows, db, &result.Rank, &title, &description, &location)
+		if err != nil {
+			return nil, err
+		}
+		// ts_headline returns the start of fields without matches
+		result.Highlights = make(map[string]string)
+		for field, highlight := range map[string]string{
+			"title":       title,
+			"description": description,
+			"location":    location,
+		} {
+			if strings.Contains(highlight, SEARCH_HIGHLIGHT_START) {
+				result.Highlights[field] = highlight
+			}
+		}
+		results = append(results, result)
+		tasks = append(tasks, result.Task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := db.selectNextTaskIds(db.db, user, tasks); err != nil {
+		return nil, err
+	}
+	if err := db.selectTaskTags(db.db, user, tasks); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Task.NextTaskIds = tasks[i].NextTaskIds
+		results[i].Task.Tags = tasks[i].Tags
+	}
+	return results, nil
+}
+
+// taskSortExpression returns the SQL expression of the TASK_SORT_* value,
+// which must sort like taskSortValue
+func taskSortExpression(sort string) string {
+	switch sort {
+	case TASK_SORT_TITLE:
+		return "title"
+	case TASK_SORT_DATE:
+		return "COALESCE(CAST(start_date AS text), '') || ' ' || " +
+			"COALESCE(SUBSTR(CAST(start_time AS text), 1, 5), '')"
+	case TASK_SORT_DURATION:
+		return "estimated_duration"
+	}
+	return "id"
+}
+
+// taskIdsCondition appends the ids of the tasks to the values and returns the
+// condition, that the column is one of them
+func taskIdsCondition(column string, tasks []Task, values *[]any) string {
+	placeholders := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		*values = append(*values, task.Id)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(*values)))
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", "))
+}
+
+// selectNextTaskIds sets the next tasks of the tasks of the user, only the
+// edges of the tasks are selected, if they aren't too many
+func (db *Db) selectNextTaskIds(q queryer, user string, tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	if len(tasks) > MAX_SELECTED_TASK_IDS {
+		g, err := db.selectTaskGraph(q, user)
+		if err != nil {
+			return err
+		}
+		for i := range tasks {
+			tasks[i].NextTaskIds = g.Next(tasks[i].Id)
+		}
+		return nil
+	}
+	values := make([]any, 0, len(tasks))
+	rows, err := q.Query(
+		"SELECT task_id, next_task_id FROM next_task_map WHERE "+
+			taskIdsCondition("task_id", tasks, &values)+" ORDER BY next_task_id",
+		values...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	nextOfTask := make(map[uint][]uint)
+	for rows.Next() {
+		var taskId, nextTaskId uint
+		if err := rows.Scan(&taskId, &nextTaskId); err != nil {
+			return err
+		}
+		nextOfTask[taskId] = append(nextOfTask[taskId], nextTaskId)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range tasks {
+		tasks[i].NextTaskIds = make([]uint, 0)
+		tasks[i].NextTaskIds = append(tasks[i].NextTaskIds, nextOfTask[tasks[i].Id]...)
+	}
+	return nil
+}
+
+// SelectPreviousTasks selects the previous tasks with a recursive query,
+// which is supported by PostgreSQL and SQLite
+func (db *Db) SelectPreviousTasks(ids []uint, user string) ([]Task, error) {
+	if len(ids) == 0 {
+		return make([]Task, 0), nil
+	}
+	values := []any{user}
+	placeholders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+	}
+	rows, err := db.db.Query(
+		"WITH RECURSIVE previous(id) AS ("+
+			"SELECT task_id FROM next_task_map WHERE next_task_id IN ("+strings.Join(placeholders, ", ")+") "+
+			"UNION SELECT next_task_map.task_id FROM next_task_map "+
+			"JOIN previous ON next_task_map.next_task_id = previous.id) "+
+			SELECT_TASKS_QUERY+"WHERE username = $1 AND id IN (SELECT id FROM previous) ORDER BY id",
+		values...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]Task, 0)
+	defer rows.Close()
+	for rows.Next() {
+		task, err := parseRowToTask(rows, db)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return tasks, db.selectNextTaskIds(db.db, user, tasks)
+}
+
+// parseRowToTask scans the columns of SELECT_TASKS_QUERY, the values of
+// additional columns are scanned into extra
+func parseRowToTask(rows *sql.Rows, db *Db, extra ...any) (Task, error) {
 	var id uint
 	var title string
-	var description, location, date, time sql.NullString
-	var nextTasks ArrayAggInt
-	// var nextTasksInt []uint
-	if err := rows.Scan(&id, &title, &description, &location, &date, &time, &nextTasks); err != nil {
+	var description, location, date, startTime sql.NullString
+	var status string
+	var startedAt, completedAt sql.NullTime
+	var estimatedDuration uint
+	var dueDate, dueTime sql.NullString
+	var priority, recurrence string
+	var recurrenceCopyNext bool
+	var version uint64
+	destinations := []any{
+		&id, &title, &description, &location, &date, &startTime,
+		&status, &startedAt, &completedAt, &estimatedDuration,
+		&dueDate, &dueTime, &priority, &recurrence, &recurrenceCopyNext,
+		&version,
+	}
+	err := rows.Scan(append(destinations, extra...)...)
+	if err != nil {
 		return Task{}, err
 	}
 	var task Task
@@ -97,24 +625,41 @@ func parseRowToTask(rows *sql.Rows, db *Db) (Task, error) {
 	if date.Valid {
 		task.Date = db.regexExpressions.regexDateReplace.ReplaceAllString(date.String, "$1")
 	}
-	if time.Valid {
-		task.Time = db.regexExpressions.regexTimeReplace.ReplaceAllString(time.String, "$1")
+	if startTime.Valid {
+		task.Time = db.regexExpressions.regexTimeReplace.ReplaceAllString(startTime.String, "$1")
 	}
-	if nextTasks.Valid {
-		task.NextTaskIds = nextTasks.Value
-	} else {
-		task.NextTaskIds = make([]uint, 0)
+	if dueDate.Valid {
+		task.DueDate = db.regexExpressions.regexDateReplace.ReplaceAllString(dueDate.String, "$1")
+	}
+	if dueTime.Valid {
+		task.DueTime = db.regexExpressions.regexTimeReplace.ReplaceAllString(dueTime.String, "$1")
+	}
+	task.Priority = priority
+	task.Recurrence = recurrence
+	task.RecurrenceCopyNext = recurrenceCopyNext
+	task.Version = version
+	task.Status = status
+	task.EstimatedDuration = estimatedDuration
+	if startedAt.Valid {
+		task.StartedAt = startedAt.Time.Format(time.RFC3339)
+	}
+	if completedAt.Valid {
+		task.CompletedAt = completedAt.Time.Format(time.RFC3339)
 	}
+	task.NextTaskIds = make([]uint, 0)
+	task.Tags = make([]string, 0)
+	task.DueConflicts = make([]uint, 0)
 	return task, nil
 }
 
 func (db *Db) SelectOneSpecialTasks(id uint, user string) (Task, error) {
-	rows, err := db.db.Query(
-		"SELECT id, title, description, location, "+
-			"start_date, start_time, array_agg(next_task_map.next_task_id) "+
-			"FROM tasks "+
-			"LEFT JOIN next_task_map ON id=next_task_map.task_id "+
-			"WHERE id = $1 AND username = $2 GROUP BY id ORDER BY id ", id, user)
+	return db.selectTask(db.db, id, user)
+}
+
+func (db *Db) selectTask(q queryer, id uint, user string) (Task, error) {
+	rows, err := q.Query(
+		SELECT_TASKS_QUERY+
+			"WHERE id = $1 AND username = $2 ORDER BY id ", id, user)
 	if err != nil {
 		return Task{}, err
 	}
@@ -127,61 +672,143 @@ func (db *Db) SelectOneSpecialTasks(id uint, user string) (Task, error) {
 		}
 		tasks = append(tasks, task)
 	}
+	if err := rows.Err(); err != nil {
+		return Task{}, err
+	}
 	if len(tasks) == 1 {
+		tasks[0].NextTaskIds, err = db.selectNextTaskIdsOf(q, id)
+		if err != nil {
+			return Task{}, err
+		}
+		err = db.selectTaskTags(q, user, tasks)
+		if err != nil {
+			return Task{}, err
+		}
 		return tasks[0], nil
 	}
-	errorStr := fmt.Sprintf("Can't find task with id %d", id)
-	return Task{}, errors.New(errorStr)
+	return Task{}, &TaskNotFoundError{id, "Can't find task with id %d"}
+}
+
+func (db *Db) selectNextTaskIdsOf(q queryer, id uint) ([]uint, error) {
+	rows, err := q.Query(
+		"SELECT next_task_id FROM next_task_map WHERE task_id = $1 ORDER BY next_task_id", id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nextTaskIds := make([]uint, 0)
+	for rows.Next() {
+		var nextTaskId uint
+		if err := rows.Scan(&nextTaskId); err != nil {
+			return nil, err
+		}
+		nextTaskIds = append(nextTaskIds, nextTaskId)
+	}
+	return nextTaskIds, rows.Err()
 }
 
 func (db *Db) InsertTask(task CreateTask, user string) (uint, error) {
+	var id uint
+	err := db.inTransaction(user, func(tx *sql.Tx) error {
+		var err error
+		id, err = db.insertTask(tx, task, user)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (db *Db) insertTask(tx *sql.Tx, task CreateTask, user string) (uint, error) {
 	var id uint = 0
 	if !ValidateCreateTask(&task) {
 		return 0, errors.New("CreateTask not valid")
 	}
+	referencedIds := append(append([]uint{}, task.NextTaskIds...), task.PreviousTaskIds...)
+	err := db.checkTasksExist(tx, user, referencedIds)
+	if err != nil {
+		return 0, err
+	}
+	if len(task.NextTaskIds) > 0 && len(task.PreviousTaskIds) > 0 {
+		err := db.checkCycle(tx, user, NEW_TASK_ID, task.NextTaskIds, task.PreviousTaskIds, true, true)
+		if err != nil {
+			return 0, err
+		}
+	}
 	var date any = task.Date
 	if date == "" {
 		date = sql.NullTime{}
 	}
-	var time any = task.Time
-	if time == "" {
-		time = sql.NullTime{}
+	var startTime any = task.Time
+	if startTime == "" {
+		startTime = sql.NullTime{}
 	}
-	err := db.db.QueryRow(
+	var dueDate any = task.DueDate
+	if dueDate == "" {
+		dueDate = sql.NullTime{}
+	}
+	var dueTime any = task.DueTime
+	if dueTime == "" {
+		dueTime = sql.NullTime{}
+	}
+	if task.Status == "" {
+		task.Status = STATUS_OPEN
+	}
+	startedAt, completedAt := StatusTimestamps(
+		STATUS_OPEN, sql.NullTime{}, sql.NullTime{}, task.Status, time.Now(),
+	)
+	err = tx.QueryRow(
 		`INSERT INTO
-		tasks(username, title, description, location, start_date, start_time)
-		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		tasks(username, title, description, location, start_date, start_time,
+			status, started_at, completed_at, estimated_duration,
+			due_date, due_time, priority, recurrence, recurrence_copy_next)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id`,
 		user,
 		task.Title,
 		task.Description,
 		task.Location,
 		date,
-		time,
+		startTime,
+		task.Status,
+		startedAt,
+		completedAt,
+		task.EstimatedDuration,
+		dueDate,
+		dueTime,
+		task.Priority,
+		task.Recurrence,
+		task.RecurrenceCopyNext,
 	).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
+	db.emit(tx, user, EVENT_TASK_CREATED, id)
 	if len(task.PreviousTaskIds) > 0 {
-		err := db.insertPreviousTaskIds(id, task.PreviousTaskIds)
-		// for _, pt := range task.PreviousTaskIds {
-		// 	err := db.insertNextTaskIds(pt, []uint{id})
+		err := db.insertPreviousTaskIds(tx, id, task.PreviousTaskIds)
 		if err != nil {
-			db.DeleteTask(id, user)
 			return 0, err
 		}
-		// }
+		db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, task.PreviousTaskIds...)
 	}
 	if len(task.NextTaskIds) > 0 {
-		err := db.insertNextTaskIds(id, task.NextTaskIds)
+		err := db.insertNextTaskIds(tx, id, task.NextTaskIds)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(task.Tags) > 0 {
+		err := db.setTaskTags(tx, user, id, task.Tags)
 		if err != nil {
-			db.DeleteTask(id, user)
 			return 0, err
 		}
 	}
 	return id, nil
 }
 
-func (db *Db) insertNextTaskIds(id uint, nextTaskIds []uint) error {
+func (db *Db) insertNextTaskIds(tx *sql.Tx, id uint, nextTaskIds []uint) error {
 	insertNextIdsQuery := "INSERT INTO next_task_map VALUES "
 	values := make([]any, 0)
 	var delimiter string
@@ -193,17 +820,11 @@ func (db *Db) insertNextTaskIds(id uint, nextTaskIds []uint) error {
 		}
 
 	}
-	_, err := db.db.Query(insertNextIdsQuery, values...)
-	if err != nil {
-		if strings.Contains(err.Error(), VOLATILE_FOREIGN_KEY_INSERT_UPDATE_ERROR_MSG) {
-			return errors.New("One as next tasks refererenced tasks not exists")
-		}
-		return err
-	}
-	return nil
+	_, err := tx.Exec(insertNextIdsQuery, values...)
+	return err
 }
 
-func (db *Db) insertPreviousTaskIds(id uint, previousTaskIds []uint) error {
+func (db *Db) insertPreviousTaskIds(tx *sql.Tx, id uint, previousTaskIds []uint) error {
 	insertPreviousIdsQuery := "INSERT INTO next_task_map VALUES "
 	values := make([]any, 0)
 	var delimiter string
@@ -215,40 +836,230 @@ func (db *Db) insertPreviousTaskIds(id uint, previousTaskIds []uint) error {
 		}
 
 	}
-	_, err := db.db.Query(insertPreviousIdsQuery, values...)
-	if err != nil {
-		if strings.Contains(err.Error(), VOLATILE_FOREIGN_KEY_INSERT_UPDATE_ERROR_MSG) {
-			return errors.New("One as next tasks refererenced tasks not exists")
-		}
-		return err
+	_, err := tx.Exec(insertPreviousIdsQuery, values...)
+	return err
+}
+
+// checkTasksExist returns an error, if one of the ids isn't a task of the
+// user
+func (db *Db) checkTasksExist(q queryer, user string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query := "SELECT id FROM tasks WHERE username = $1 AND id IN ("
+	values := []any{user}
+	for i, id := range ids {
+		if i > 0 {
+			query += ", "
+		}
+		values = append(values, id)
+		query += fmt.Sprintf("$%d", len(values))
+	}
+	rows, err := q.Query(query+")", values...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[uint]bool)
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		existing[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !existing[id] {
+			return &TaskNotFoundError{id, "Referenced task %d not exists"}
+		}
+	}
+	return nil
+}
+
+func (db *Db) selectTaskGraph(q queryer, user string) (*graph.Graph, error) {
+	rows, err := q.Query(
+		"SELECT next_task_map.task_id, next_task_map.next_task_id "+
+			"FROM next_task_map JOIN tasks ON tasks.id = next_task_map.task_id "+
+			"WHERE tasks.username = $1", user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	g := graph.New()
+	for rows.Next() {
+		var from, to uint
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		g.AddEdge(from, to)
+	}
+	return g, rows.Err()
+}
+
+// checkCycle checks, if the dependency graph of the user would contain a
+// cycle, when the next and previous tasks of the task id are set to the given
+// ids. If replaceNext or replacePrevious are set, the existing edges of the
+// task are removed before. A cycle is returned as graph.CycleError. The graph
+// is only stable, if q is a transaction of inTransaction, which holds the
+// lock of the user.
+func (db *Db) checkCycle(
+	q queryer,
+	user string,
+	id uint,
+	nextTaskIds []uint,
+	previousTaskIds []uint,
+	replaceNext bool,
+	replacePrevious bool,
+) error {
+	g, err := db.selectTaskGraph(q, user)
+	if err != nil {
+		return err
+	}
+	g.AddNode(id)
+	if replaceNext {
+		g.RemoveEdgesFrom(id)
+	}
+	if replacePrevious {
+		g.RemoveEdgesTo(id)
+	}
+	for _, nt := range nextTaskIds {
+		g.AddEdge(id, nt)
+	}
+	for _, pt := range previousTaskIds {
+		g.AddEdge(pt, id)
+	}
+	if cycle := g.FindCycle(); cycle != nil {
+		return &graph.CycleError{Path: cycle}
 	}
 	return nil
 }
 
-func (db *Db) DeleteTask(id uint, user string) error {
+func (db *Db) DeleteTask(id uint, version uint64, user string) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		if err := db.checkVersion(tx, id, version, user); err != nil {
+			return err
+		}
+		return db.deleteTask(tx, id, user)
+	})
+}
+
+func (db *Db) deleteTask(tx *sql.Tx, id uint, user string) error {
+	var previousId uint
+	err := tx.QueryRow(
+		"SELECT task_id FROM next_task_map WHERE next_task_id = $1 LIMIT 1", id,
+	).Scan(&previousId)
+	if err == nil {
+		return errors.New(
+			fmt.Sprintf(
+				"Task %d is a follower for another task and must not be delete",
+				id,
+			),
+		)
+	} else if err.Error() != NO_ROW_IN_OUTPUT_ERROR_MSG {
+		return err
+	}
 	var deleteId uint
-	err := db.db.QueryRow(
+	err = tx.QueryRow(
 		"DELETE FROM tasks WHERE id = $1 AND username = $2 RETURNING id",
 		id, user,
 	).Scan(&deleteId)
 	if err != nil {
 		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
-			return errors.New(fmt.Sprintf("Task %d not found", id))
-		} else if strings.Contains(err.Error(), VOLATILE_FOREIGN_KEY_DELETE_UPDATE_ERROR_MSG) {
-			return errors.New(
-				fmt.Sprintf(
-					"Task %d is a follower for another task and must not be delete",
-					id,
-				),
-			)
-		} else {
-			return err
+			return &TaskNotFoundError{id, "Task %d not found"}
 		}
+		return err
+	}
+	db.emit(tx, user, EVENT_TASK_DELETED, id)
+	return nil
+}
+
+func (db *Db) LinkTasks(id uint, nextTaskId uint, user string) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		return db.linkTasks(tx, id, nextTaskId, user)
+	})
+}
+
+func (db *Db) linkTasks(tx *sql.Tx, id uint, nextTaskId uint, user string) error {
+	err := db.checkTasksExist(tx, user, []uint{id, nextTaskId})
+	if err != nil {
+		return err
+	}
+	var existing uint
+	err = tx.QueryRow(
+		"SELECT task_id FROM next_task_map WHERE task_id = $1 AND next_task_id = $2",
+		id, nextTaskId,
+	).Scan(&existing)
+	if err == nil {
+		return nil
+	} else if err.Error() != NO_ROW_IN_OUTPUT_ERROR_MSG {
+		return err
+	}
+	err = db.checkCycle(tx, user, id, []uint{nextTaskId}, nil, false, false)
+	if err != nil {
+		return err
+	}
+	err = db.insertNextTaskIds(tx, id, []uint{nextTaskId})
+	if err != nil {
+		return err
+	}
+	db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, id)
+	return nil
+}
+
+func (db *Db) UnlinkTasks(id uint, nextTaskId uint, user string) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		return db.unlinkTasks(tx, id, nextTaskId, user)
+	})
+}
+
+func (db *Db) unlinkTasks(tx *sql.Tx, id uint, nextTaskId uint, user string) error {
+	err := db.checkTasksExist(tx, user, []uint{id, nextTaskId})
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		"DELETE FROM next_task_map WHERE task_id = $1 AND next_task_id = $2",
+		id, nextTaskId,
+	)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, id)
 	}
 	return nil
 }
 
-func (db *Db) UpdateTask(id uint, patchTask CreateTask, patchKeys []string) error {
+func (db *Db) UpdateTask(
+	id uint,
+	patchTask CreateTask,
+	patchKeys []string,
+	version uint64,
+	user string,
+) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		if err := db.checkVersion(tx, id, version, user); err != nil {
+			return err
+		}
+		return db.updateTask(tx, id, patchTask, patchKeys, user)
+	})
+}
+
+func (db *Db) updateTask(
+	tx *sql.Tx,
+	id uint,
+	patchTask CreateTask,
+	patchKeys []string,
+	user string,
+) error {
 	var updateId uint
 	query := "UPDATE tasks SET "
 	i := 1
@@ -256,19 +1067,54 @@ func (db *Db) UpdateTask(id uint, patchTask CreateTask, patchKeys []string) erro
 	values := make([]any, 0)
 	nextTaskIdsIdx := false
 	previousTaskIdsIdx := false
+	tagsIdx := false
+	completed, err := db.isCompletedBy(tx, id, user, patchTask, patchKeys)
+	if err != nil {
+		return err
+	}
 	for _, key := range patchKeys {
-		if key != "nextTaskIds" && key != "previousTaskIds" {
+		if key == "tags" {
+			tagsIdx = true
+		} else if key != "nextTaskIds" && key != "previousTaskIds" {
 			columnName := key
 			value, ok := patchTask.GetByKey(key)
 			if !ok {
 				return errors.New(fmt.Sprintf("Canot get value for key %s", key))
 			}
+			if key == "estimatedDuration" {
+				columnName = "estimated_duration"
+			}
+			if key == "recurrenceCopyNext" {
+				columnName = "recurrence_copy_next"
+			}
 			if key == "date" || key == "time" {
 				columnName = "start_" + key
 				if value == "" {
 					value = sql.NullTime{}
 				}
 			}
+			if key == "dueDate" || key == "dueTime" {
+				columnName = "due_date"
+				if key == "dueTime" {
+					columnName = "due_time"
+				}
+				if value == "" {
+					value = sql.NullTime{}
+				}
+			}
+			if key == "status" {
+				if value == "" {
+					value = STATUS_OPEN
+				}
+				startedAt, completedAt, err := db.selectStatusTimestamps(tx, id, user, value.(string))
+				if err != nil {
+					return err
+				}
+				query += fmt.Sprintf("%sstarted_at = $%d, completed_at = $%d", delimiter, i, i+1)
+				values = append(values, startedAt, completedAt)
+				delimiter = ", "
+				i += 2
+			}
 			query += fmt.Sprintf("%s%s = $%d", delimiter, columnName, i)
 			values = append(values, value)
 			if i == 1 {
@@ -283,99 +1129,1007 @@ func (db *Db) UpdateTask(id uint, patchTask CreateTask, patchKeys []string) erro
 			}
 		}
 	}
+	if nextTaskIdsIdx || previousTaskIdsIdx || tagsIdx {
+		err := tx.
+			QueryRow("SELECT id FROM tasks WHERE id = $1 AND username = $2", id, user).
+			Scan(&updateId)
+		if err != nil {
+			if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+				return &TaskNotFoundError{id, "Task %d not found to update"}
+			}
+			return err
+		}
+	}
+	if nextTaskIdsIdx || previousTaskIdsIdx {
+		referencedIds := append(append([]uint{}, patchTask.NextTaskIds...), patchTask.PreviousTaskIds...)
+		err := db.checkTasksExist(tx, user, referencedIds)
+		if err != nil {
+			return err
+		}
+		err = db.checkCycle(
+			tx,
+			user,
+			id,
+			patchTask.NextTaskIds,
+			patchTask.PreviousTaskIds,
+			nextTaskIdsIdx,
+			previousTaskIdsIdx,
+		)
+		if err != nil {
+			return err
+		}
+	}
 	if len(values) > 0 {
-		values = append(values, id)
-		query += fmt.Sprintf(" WHERE id = $%d RETURNING id", i)
-		err := db.db.QueryRow(query, values...).Scan(&updateId)
+		values = append(values, id, user)
+		query += fmt.Sprintf(" WHERE id = $%d AND username = $%d RETURNING id", i, i+1)
+		err := tx.QueryRow(query, values...).Scan(&updateId)
 		if err != nil {
 			if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
-				return errors.New(fmt.Sprintf("Task %d not found to update", id))
+				return &TaskNotFoundError{id, "Task %d not found to update"}
 			}
 			return err
 		}
 	}
+	if len(values) > 0 || tagsIdx {
+		db.emit(tx, user, EVENT_TASK_UPDATED, id)
+	}
+	if nextTaskIdsIdx {
+		db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, id)
+	}
 	// Update next references
 	if nextTaskIdsIdx {
-		var deletedId uint
-		err := db.db.
-			QueryRow("DELETE FROM next_task_map WHERE task_id = $1 RETURNING task_id", id).
-			Scan(&deletedId)
+		_, err := tx.Exec("DELETE FROM next_task_map WHERE task_id = $1", id)
 		if err != nil {
-			if err.Error() != NO_ROW_IN_OUTPUT_ERROR_MSG {
-				return err
-			}
+			return err
 		}
 		if len(patchTask.NextTaskIds) > 0 {
-			err = db.insertNextTaskIds(id, patchTask.NextTaskIds)
+			err = db.insertNextTaskIds(tx, id, patchTask.NextTaskIds)
 			if err != nil {
-				if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
-					return errors.New(fmt.Sprintf("Task %d not found to update", id))
-				}
 				return err
 			}
 		}
 	}
 	// Update previous references
 	if previousTaskIdsIdx {
-		var deletedId uint
-		err := db.db.
-			QueryRow("DELETE FROM next_task_map WHERE next_task_id = $1 RETURNING task_id", id).
-			Scan(&deletedId)
+		g, err := db.selectTaskGraph(tx, user)
 		if err != nil {
-			if err.Error() != NO_ROW_IN_OUTPUT_ERROR_MSG {
-				return err
-			}
+			return err
+		}
+		db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, g.Previous(id)...)
+		_, err = tx.Exec("DELETE FROM next_task_map WHERE next_task_id = $1", id)
+		if err != nil {
+			return err
 		}
 		if len(patchTask.PreviousTaskIds) > 0 {
-			err = db.insertPreviousTaskIds(id, patchTask.PreviousTaskIds)
+			err = db.insertPreviousTaskIds(tx, id, patchTask.PreviousTaskIds)
 			if err != nil {
-				// if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
-				// 	return erros.New("Previous Task not exists")
-				// }
 				return err
 			}
+			db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, patchTask.PreviousTaskIds...)
+		}
+	}
+	if tagsIdx {
+		err := db.setTaskTags(tx, user, id, patchTask.Tags)
+		if err != nil {
+			return err
 		}
 	}
+	if completed {
+		db.emit(tx, user, EVENT_TASK_COMPLETED, id)
+		return db.insertNextOccurrence(tx, id, user)
+	}
 	return nil
 }
 
-func (db *Db) insertUser(user User) error {
-	var newUser string
-	err := db.db.QueryRow(
-		`INSERT INTO
-		users(username, fullname, email, password, salt)
-		VALUES ($1, $2, $3, $4, $5) RETURNING username`,
-		user.Username,
-		user.Fullname,
-		user.Email,
-		user.Password,
-		user.Salt,
-	).Scan(&newUser)
-	return err
+// isCompletedBy returns true, if the patch changes the status of the task to
+// done
+func (db *Db) isCompletedBy(
+	q queryer,
+	id uint,
+	user string,
+	patchTask CreateTask,
+	patchKeys []string,
+) (bool, error) {
+	for _, key := range patchKeys {
+		if key != "status" || patchTask.Status != STATUS_DONE {
+			continue
+		}
+		var status string
+		err := q.QueryRow(
+			"SELECT status FROM tasks WHERE id = $1 AND username = $2", id, user,
+		).Scan(&status)
+		if err != nil {
+			if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+				return false, &TaskNotFoundError{id, "Task %d not found to update"}
+			}
+			return false, err
+		}
+		return status != STATUS_DONE, nil
+	}
+	return false, nil
 }
 
-func (db *Db) getUser(username string) (User, error) {
-	var user User
-	rows, err := db.db.Query(
-		"SELECT username, fullname, email, password, salt FROM users "+
-			"WHERE username= $1 ORDER BY username", username,
+// insertNextOccurrence creates the next occurrence of a recurring task, which
+// is done. The rule moves to the next occurrence, so the done task doesn't
+// recur anymore.
+func (db *Db) insertNextOccurrence(tx *sql.Tx, id uint, user string) error {
+	task, err := db.selectTask(tx, id, user)
+	if err != nil {
+		return err
+	}
+	next, ok := NextOccurrence(&task, time.Now())
+	if !ok {
+		return nil
+	}
+	if _, err := db.insertTask(tx, next, user); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE tasks SET recurrence = '', recurrence_copy_next = $1 WHERE id = $2", false, id,
 	)
+	return err
+}
+
+// selectStatusTimestamps returns the started and completed timestamps of the
+// task id, after its status changed to newStatus
+func (db *Db) selectStatusTimestamps(
+	q queryer,
+	id uint,
+	user string,
+	newStatus string,
+) (sql.NullTime, sql.NullTime, error) {
+	var status string
+	var startedAt, completedAt sql.NullTime
+	err := q.QueryRow(
+		"SELECT status, started_at, completed_at FROM tasks WHERE id = $1 AND username = $2",
+		id, user,
+	).Scan(&status, &startedAt, &completedAt)
 	if err != nil {
-		return User{}, err
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return sql.NullTime{}, sql.NullTime{}, &TaskNotFoundError{id, "Task %d not found to update"}
+		}
+		return sql.NullTime{}, sql.NullTime{}, err
+	}
+	startedAt, completedAt = StatusTimestamps(status, startedAt, completedAt, newStatus, time.Now())
+	return startedAt, completedAt, nil
+}
+
+// ApplyBatch applies all operations in one transaction. If one of the
+// operations fails, a BatchError is returned and nothing is applied.
+func (db *Db) ApplyBatch(operations []BatchOperation, user string) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(operations))
+	err := db.inTransaction(user, func(tx *sql.Tx) error {
+		created := make(map[string]uint)
+		for i, op := range operations {
+			if err := op.resolve(created); err != nil {
+				return &BatchError{i, err}
+			}
+			var err error
+			id := op.Id
+			switch op.Action {
+			case BATCH_ACTION_CREATE:
+				id, err = db.insertTask(tx, op.Task, user)
+			case BATCH_ACTION_UPDATE:
+				err = db.checkVersion(tx, op.Id, op.Version, user)
+				if err == nil {
+					err = db.updateTask(tx, op.Id, op.Task, op.PatchKeys, user)
+				}
+			case BATCH_ACTION_DELETE:
+				err = db.checkVersion(tx, op.Id, op.Version, user)
+				if err == nil {
+					err = db.deleteTask(tx, op.Id, user)
+				}
+			case BATCH_ACTION_LINK:
+				err = db.linkTasks(tx, op.Id, op.NextTaskId, user)
+			case BATCH_ACTION_UNLINK:
+				err = db.unlinkTasks(tx, op.Id, op.NextTaskId, user)
+			default:
+				err = errors.New(fmt.Sprintf("Unknown action %s", op.Action))
+			}
+			if err != nil {
+				return &BatchError{i, err}
+			}
+			if op.TempId != "" {
+				created[op.TempId] = id
+			}
+			results = append(results, BatchResult{op.Action, id, op.TempId})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ImportTasks inserts the tasks in one transaction. If a task can't be
+// inserted, a BatchError with the index of the task is returned.
+func (db *Db) ImportTasks(tasks []ImportTask, tags []Tag, profile *User, user string) ([]uint, error) {
+	ids := make([]uint, len(tasks))
+	err := db.inTransaction(user, func(tx *sql.Tx) error {
+		// before the tasks, which would create the tags without color
+		if err := db.restoreTags(tx, tags, user); err != nil {
+			return err
+		}
+		if profile != nil {
+			_, err := tx.Exec(
+				"UPDATE users SET fullname = $1, email = $2 WHERE username = $3",
+				profile.Fullname, profile.Email, user,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		for i, task := range tasks {
+			id, err := db.insertTask(tx, task.Task, user)
+			if err != nil {
+				return &BatchError{i, err}
+			}
+			ids[i] = id
+			if task.StartedAt.Valid || task.CompletedAt.Valid {
+				_, err := tx.Exec(
+					"UPDATE tasks SET started_at = COALESCE($1, started_at), "+
+						"completed_at = COALESCE($2, completed_at) WHERE id = $3",
+					task.StartedAt, task.CompletedAt, id,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for i, task := range tasks {
+			if len(task.PreviousIndexes) == 0 {
+				continue
+			}
+			previousTaskIds := make([]uint, 0, len(task.PreviousIndexes))
+			for _, index := range task.PreviousIndexes {
+				previousTaskIds = append(previousTaskIds, ids[index])
+			}
+			if err := db.insertPreviousTaskIds(tx, ids[i], previousTaskIds); err != nil {
+				return &BatchError{i, err}
+			}
+			db.emit(tx, user, EVENT_DEPENDENCIES_CHANGED, previousTaskIds...)
+		}
+		g, err := db.selectTaskGraph(tx, user)
+		if err != nil {
+			return err
+		}
+		if cycle := g.FindCycle(); cycle != nil {
+			return &graph.CycleError{Path: cycle}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// restoreTags creates the missing tags and sets the colors of the existing
+// tags without color
+func (db *Db) restoreTags(tx *sql.Tx, tags []Tag, user string) error {
+	for _, tag := range tags {
+		var id uint
+		var color string
+		err := tx.QueryRow(
+			"SELECT id, color FROM tags WHERE username = $1 AND name = $2", user, tag.Name,
+		).Scan(&id, &color)
+		if err != nil && err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			_, err = tx.Exec(
+				"INSERT INTO tags(username, name, color) VALUES ($1, $2, $3)", user, tag.Name, tag.Color,
+			)
+		} else if err == nil && color == "" && tag.Color != "" {
+			_, err = tx.Exec("UPDATE tags SET color = $1 WHERE id = $2", tag.Color, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagExpressionSql translates a tag expression into a condition on the
+// tasks, the tag names are appended to the values
+func tagExpressionSql(expression *TagExpression, values *[]any) string {
+	switch expression.Op {
+	case TAG_EXPRESSION_TAG:
+		*values = append(*values, expression.Tag)
+		return fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM task_tags JOIN tags ON tags.id = task_tags.tag_id "+
+				"WHERE task_tags.task_id = tasks.id AND tags.name = $%d)",
+			len(*values),
+		)
+	case TAG_EXPRESSION_NOT:
+		return "NOT " + tagExpressionSql(expression.Operands[0], values)
+	}
+	operands := make([]string, 0, len(expression.Operands))
+	for _, operand := range expression.Operands {
+		operands = append(operands, tagExpressionSql(operand, values))
+	}
+	return "(" + strings.Join(operands, " "+expression.Op+" ") + ")"
+}
+
+// selectTaskTags sets the tags of the tasks of the user, only the tags of
+// the tasks are selected, if they aren't too many
+func (db *Db) selectTaskTags(q queryer, user string, tasks []Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	query := "SELECT task_tags.task_id, tags.name FROM task_tags " +
+		"JOIN tags ON tags.id = task_tags.tag_id " +
+		"WHERE tags.username = $1"
+	values := []any{user}
+	if len(tasks) <= MAX_SELECTED_TASK_IDS {
+		query += " AND " + taskIdsCondition("task_tags.task_id", tasks, &values)
+	}
+	rows, err := q.Query(query+" ORDER BY tags.name", values...)
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
-	count := 0
+	tagsOfTask := make(map[uint][]string)
 	for rows.Next() {
-		if count > 1 {
-			return User{}, errors.New(fmt.Sprintf("User with username %v not found", username))
-		}
-		if err := rows.Scan(&user.Username, &user.Fullname, &user.Email, &user.Password, &user.Salt); err != nil {
-			return User{}, err
+		var taskId uint
+		var name string
+		if err := rows.Scan(&taskId, &name); err != nil {
+			return err
 		}
-		count++
+		tagsOfTask[taskId] = append(tagsOfTask[taskId], name)
 	}
-	if count != 1 {
-		return User{}, errors.New(fmt.Sprintf("User with username %v not found", username))
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return user, nil
+	for i := range tasks {
+		tasks[i].Tags = make([]string, 0)
+		tasks[i].Tags = append(tasks[i].Tags, tagsOfTask[tasks[i].Id]...)
+	}
+	return nil
+}
+
+// setTaskTags replaces the tags of a task, missing tags are created
+func (db *Db) setTaskTags(tx *sql.Tx, user string, id uint, tags []string) error {
+	_, err := tx.Exec("DELETE FROM task_tags WHERE task_id = $1", id)
+	if err != nil {
+		return err
+	}
+	for _, name := range normalizeTags(tags) {
+		var tagId uint
+		err := tx.QueryRow(
+			"SELECT id FROM tags WHERE username = $1 AND name = $2", user, name,
+		).Scan(&tagId)
+		if err != nil && err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			err = tx.QueryRow(
+				"INSERT INTO tags(username, name) VALUES ($1, $2) RETURNING id", user, name,
+			).Scan(&tagId)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO task_tags VALUES ($1, $2)", id, tagId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Db) SelectTags(user string) ([]Tag, error) {
+	rows, err := db.db.Query(
+		"SELECT id, name, color FROM tags WHERE username = $1 ORDER BY name", user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]Tag, 0)
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Id, &tag.Name, &tag.Color); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// checkTagNameFree returns an error, if another tag of the user has the name
+func (db *Db) checkTagNameFree(q queryer, user string, name string, id uint) error {
+	var otherId uint
+	err := q.QueryRow(
+		"SELECT id FROM tags WHERE username = $1 AND name = $2", user, name,
+	).Scan(&otherId)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return nil
+		}
+		return err
+	}
+	if otherId != id {
+		return errors.New(fmt.Sprintf("Tag %s already exists", name))
+	}
+	return nil
+}
+
+func (db *Db) InsertTag(tag Tag, user string) (uint, error) {
+	var id uint
+	err := db.inTransaction(user, func(tx *sql.Tx) error {
+		if err := db.checkTagNameFree(tx, user, tag.Name, 0); err != nil {
+			return err
+		}
+		return tx.QueryRow(
+			"INSERT INTO tags(username, name, color) VALUES ($1, $2, $3) RETURNING id",
+			user, tag.Name, tag.Color,
+		).Scan(&id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (db *Db) UpdateTag(id uint, patchTag Tag, patchKeys []string, user string) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		var tagId uint
+		err := tx.QueryRow(
+			"SELECT id FROM tags WHERE id = $1 AND username = $2", id, user,
+		).Scan(&tagId)
+		if err != nil {
+			if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+				return errors.New(fmt.Sprintf("Tag %d not found", id))
+			}
+			return err
+		}
+		for _, key := range patchKeys {
+			switch key {
+			case "name":
+				if err := db.checkTagNameFree(tx, user, patchTag.Name, id); err != nil {
+					return err
+				}
+				_, err = tx.Exec("UPDATE tags SET name = $1 WHERE id = $2", patchTag.Name, id)
+				if err == nil {
+					err = db.emitTagged(tx, user, id)
+				}
+			case "color":
+				_, err = tx.Exec("UPDATE tags SET color = $1 WHERE id = $2", patchTag.Color, id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Db) DeleteTag(id uint, user string) error {
+	return db.inTransaction(user, func(tx *sql.Tx) error {
+		if err := db.emitTagged(tx, user, id); err != nil {
+			return err
+		}
+		result, err := tx.Exec("DELETE FROM tags WHERE id = $1 AND username = $2", id, user)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			return errors.New(fmt.Sprintf("Tag %d not found", id))
+		}
+		return nil
+	})
+}
+
+// emitTagged adds an update event for all tasks with the tag, whose name
+// changes
+func (db *Db) emitTagged(tx *sql.Tx, user string, tagId uint) error {
+	rows, err := tx.Query(
+		"SELECT task_id FROM task_tags WHERE tag_id = $1 ORDER BY task_id", tagId,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taskId uint
+		if err := rows.Scan(&taskId); err != nil {
+			return err
+		}
+		db.emit(tx, user, EVENT_TASK_UPDATED, taskId)
+	}
+	return rows.Err()
+}
+
+func (db *Db) InsertUser(user User) error {
+	var newUser string
+	err := db.db.QueryRow(
+		`INSERT INTO
+		users(username, fullname, email, password, salt)
+		VALUES ($1, $2, $3, $4, $5) RETURNING username`,
+		user.Username,
+		user.Fullname,
+		user.Email,
+		user.Password,
+		user.Salt,
+	).Scan(&newUser)
+	return err
+}
+
+func (db *Db) UpdateUserProfile(username string, fullname string, email string) error {
+	result, err := db.db.Exec(
+		"UPDATE users SET fullname = $1, email = $2 WHERE username = $3",
+		fullname, email, username,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return errors.New(fmt.Sprintf("User with username %v not found", username))
+	}
+	return nil
+}
+
+func (db *Db) GetUser(username string) (User, error) {
+	var user User
+	rows, err := db.db.Query(
+		"SELECT username, fullname, email, password, salt FROM users "+
+			"WHERE username= $1 ORDER BY username", username,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		if count > 1 {
+			return User{}, errors.New(fmt.Sprintf("User with username %v not found", username))
+		}
+		if err := rows.Scan(&user.Username, &user.Fullname, &user.Email, &user.Password, &user.Salt); err != nil {
+			return User{}, err
+		}
+		count++
+	}
+	if count != 1 {
+		return User{}, errors.New(fmt.Sprintf("User with username %v not found", username))
+	}
+	return user, nil
+}
+
+func (db *Db) InsertSession(tokenHash []byte, user string, userAgent string, ip string) (uint, error) {
+	var id uint
+	now := time.Now()
+	err := db.db.QueryRow(
+		`INSERT INTO
+		sessions(username, token_hash, created_at, last_seen_at, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		user,
+		tokenHash,
+		now,
+		now,
+		userAgent,
+		ip,
+	).Scan(&id)
+	return id, err
+}
+
+// UpsertSession inserts a session for the token or renews it, if it already
+// exists
+func (db *Db) UpsertSession(tokenHash []byte, user string) error {
+	now := time.Now()
+	_, err := db.db.Exec(
+		`INSERT INTO
+		sessions(username, token_hash, created_at, last_seen_at, user_agent, ip)
+		VALUES ($1, $2, $3, $4, '', '')
+		ON CONFLICT (token_hash) DO UPDATE SET username = $1, created_at = $3`,
+		user,
+		tokenHash,
+		now,
+		now,
+	)
+	return err
+}
+
+func parseRowToSession(rows *sql.Rows) (Session, error) {
+	var session Session
+	var userAgent, ip sql.NullString
+	err := rows.Scan(
+		&session.Id, &session.User, &session.CreatedAt, &session.LastSeenAt, &userAgent, &ip,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+	session.UserAgent = userAgent.String
+	session.Ip = ip.String
+	return session, nil
+}
+
+func (db *Db) SelectSessionByToken(tokenHash []byte) (Session, error) {
+	rows, err := db.db.Query(
+		"SELECT id, username, created_at, last_seen_at, user_agent, ip "+
+			"FROM sessions WHERE token_hash = $1", tokenHash,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return parseRowToSession(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return Session{}, err
+	}
+	return Session{}, errors.New("Session not found")
+}
+
+func (db *Db) SelectSessions(user string) ([]Session, error) {
+	rows, err := db.db.Query(
+		"SELECT id, username, created_at, last_seen_at, user_agent, ip "+
+			"FROM sessions WHERE username = $1 ORDER BY id", user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		session, err := parseRowToSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession updates the last seen timestamp of the session
+func (db *Db) TouchSession(id uint, lastSeen time.Time) error {
+	_, err := db.db.Exec("UPDATE sessions SET last_seen_at = $1 WHERE id = $2", lastSeen, id)
+	return err
+}
+
+func (db *Db) DeleteSession(id uint, user string) error {
+	var deleteId uint
+	err := db.db.QueryRow(
+		"DELETE FROM sessions WHERE id = $1 AND username = $2 RETURNING id",
+		id, user,
+	).Scan(&deleteId)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return errors.New(fmt.Sprintf("Session %d not found", id))
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteExpiredSessions deletes all sessions created before the given time
+func (db *Db) DeleteExpiredSessions(createdBefore time.Time) error {
+	_, err := db.db.Exec("DELETE FROM sessions WHERE created_at < $1", createdBefore)
+	return err
+}
+
+func (db *Db) InsertAccessToken(tokenHash []byte, token AccessToken) (uint, error) {
+	var id uint
+	var expiresAt sql.NullTime
+	if token.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *token.ExpiresAt, Valid: true}
+	}
+	err := db.db.QueryRow(
+		`INSERT INTO
+		access_tokens(username, name, token_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		token.User,
+		token.Name,
+		tokenHash,
+		strings.Join(token.Scopes, " "),
+		token.CreatedAt,
+		expiresAt,
+	).Scan(&id)
+	return id, err
+}
+
+func parseRowToAccessToken(rows *sql.Rows) (AccessToken, error) {
+	var token AccessToken
+	var scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+	err := rows.Scan(
+		&token.Id, &token.User, &token.Name, &scopes, &token.CreatedAt, &lastUsedAt, &expiresAt,
+	)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	return token, nil
+}
+
+func (db *Db) SelectAccessTokenByToken(tokenHash []byte) (AccessToken, error) {
+	rows, err := db.db.Query(
+		"SELECT id, username, name, scopes, created_at, last_used_at, expires_at "+
+			"FROM access_tokens WHERE token_hash = $1", tokenHash,
+	)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return parseRowToAccessToken(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return AccessToken{}, err
+	}
+	return AccessToken{}, errors.New("Access token not found")
+}
+
+func (db *Db) SelectAccessTokens(user string) ([]AccessToken, error) {
+	rows, err := db.db.Query(
+		"SELECT id, username, name, scopes, created_at, last_used_at, expires_at "+
+			"FROM access_tokens WHERE username = $1 ORDER BY id", user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]AccessToken, 0)
+	for rows.Next() {
+		token, err := parseRowToAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// TouchAccessToken updates the last used timestamp of the access token
+func (db *Db) TouchAccessToken(id uint, lastUsed time.Time) error {
+	_, err := db.db.Exec("UPDATE access_tokens SET last_used_at = $1 WHERE id = $2", lastUsed, id)
+	return err
+}
+
+func (db *Db) DeleteAccessToken(id uint, user string) error {
+	var deleteId uint
+	err := db.db.QueryRow(
+		"DELETE FROM access_tokens WHERE id = $1 AND username = $2 RETURNING id",
+		id, user,
+	).Scan(&deleteId)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return errors.New(fmt.Sprintf("Access token %d not found", id))
+		}
+		return err
+	}
+	return nil
+}
+
+// insertDeliveries queues the deliveries of the events to the webhooks of the
+// user and returns their number
+func (db *Db) insertDeliveries(tx *sql.Tx, pending *pendingEvents) (int, error) {
+	if len(pending.events) == 0 {
+		return 0, nil
+	}
+	webhooks, err := db.selectWebhooks(tx, pending.user)
+	if err != nil || len(webhooks) == 0 {
+		return 0, err
+	}
+	deliveries, err := NewWebhookDeliveries(
+		webhooks,
+		pending.events,
+		func(id uint) (*Task, error) {
+			task, err := db.selectTask(tx, id, pending.user)
+			if err != nil {
+				var notFoundErr *TaskNotFoundError
+				if errors.As(err, &notFoundErr) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			return &task, nil
+		},
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		_, err := tx.Exec(
+			`INSERT INTO
+			webhook_deliveries(webhook_id, event, payload, status, next_attempt_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			delivery.WebhookId,
+			delivery.Event,
+			string(delivery.Payload),
+			delivery.Status,
+			delivery.NextAttemptAt,
+			delivery.CreatedAt,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (db *Db) selectWebhooks(q queryer, user string) ([]Webhook, error) {
+	rows, err := q.Query(
+		"SELECT id, username, url, events, secret, created_at FROM webhooks WHERE username = $1 ORDER BY id",
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := make([]Webhook, 0)
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		err := rows.Scan(&webhook.Id, &webhook.User, &webhook.Url, &events, &webhook.Secret, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Events = strings.Fields(events)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *Db) SelectWebhooks(user string) ([]Webhook, error) {
+	return db.selectWebhooks(db.db, user)
+}
+
+func (db *Db) InsertWebhook(webhook Webhook) (uint, error) {
+	var id uint
+	err := db.db.QueryRow(
+		`INSERT INTO
+		webhooks(username, url, events, secret, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		webhook.User,
+		webhook.Url,
+		strings.Join(webhook.Events, " "),
+		webhook.Secret,
+		webhook.CreatedAt,
+	).Scan(&id)
+	return id, err
+}
+
+func (db *Db) DeleteWebhook(id uint, user string) error {
+	var deleteId uint
+	err := db.db.QueryRow(
+		"DELETE FROM webhooks WHERE id = $1 AND username = $2 RETURNING id",
+		id, user,
+	).Scan(&deleteId)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return errors.New(fmt.Sprintf("Webhook %d not found", id))
+		}
+		return err
+	}
+	return nil
+}
+
+const SELECT_DELIVERIES_QUERY = "SELECT webhook_deliveries.id, webhook_id, event, payload, status, attempts, " +
+	"next_attempt_at, last_attempt_at, response_status, error, webhook_deliveries.created_at "
+
+func parseRowToDelivery(rows *sql.Rows, dest ...any) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	var lastAttemptAt sql.NullTime
+	err := rows.Scan(append([]any{
+		&delivery.Id,
+		&delivery.WebhookId,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&lastAttemptAt,
+		&delivery.ResponseStatus,
+		&delivery.Error,
+		&delivery.CreatedAt,
+	}, dest...)...)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	if lastAttemptAt.Valid {
+		delivery.LastAttemptAt = &lastAttemptAt.Time
+	}
+	return delivery, nil
+}
+
+func (db *Db) SelectDeliveries(webhookId uint, user string, limit uint) ([]WebhookDelivery, error) {
+	var id uint
+	err := db.db.QueryRow(
+		"SELECT id FROM webhooks WHERE id = $1 AND username = $2", webhookId, user,
+	).Scan(&id)
+	if err != nil {
+		if err.Error() == NO_ROW_IN_OUTPUT_ERROR_MSG {
+			return nil, errors.New(fmt.Sprintf("Webhook %d not found", webhookId))
+		}
+		return nil, err
+	}
+	rows, err := db.db.Query(
+		SELECT_DELIVERIES_QUERY+"FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2",
+		webhookId, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := parseRowToDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (db *Db) SelectDueDeliveries(now time.Time, skipWebhookIds []uint, limit uint) ([]DueDelivery, error) {
+	query := SELECT_DELIVERIES_QUERY + ", webhooks.url, webhooks.secret FROM webhook_deliveries " +
+		"JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id " +
+		"WHERE status = $1 AND next_attempt_at <= $2"
+	values := []any{WEBHOOK_DELIVERY_PENDING, now}
+	if len(skipWebhookIds) > 0 {
+		placeholders := make([]string, 0, len(skipWebhookIds))
+		for _, id := range skipWebhookIds {
+			values = append(values, id)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+		}
+		query += fmt.Sprintf(" AND webhook_id NOT IN (%s)", strings.Join(placeholders, ", "))
+	}
+	values = append(values, limit)
+	query += fmt.Sprintf(" ORDER BY next_attempt_at, webhook_deliveries.id LIMIT $%d", len(values))
+	rows, err := db.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]DueDelivery, 0)
+	for rows.Next() {
+		var due DueDelivery
+		due.WebhookDelivery, err = parseRowToDelivery(rows, &due.Url, &due.Secret)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, due)
+	}
+	return deliveries, rows.Err()
+}
+
+func (db *Db) UpdateDelivery(delivery WebhookDelivery) error {
+	var lastAttemptAt sql.NullTime
+	if delivery.LastAttemptAt != nil {
+		lastAttemptAt = sql.NullTime{Time: *delivery.LastAttemptAt, Valid: true}
+	}
+	_, err := db.db.Exec(
+		`UPDATE webhook_deliveries SET
+		status = $1, attempts = $2, next_attempt_at = $3, last_attempt_at = $4, response_status = $5, error = $6
+		WHERE id = $7`,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		lastAttemptAt,
+		delivery.ResponseStatus,
+		delivery.Error,
+		delivery.Id,
+	)
+	return err
+}
+
+// DeleteDeliveries deletes the finished deliveries created before the given
+// time
+func (db *Db) DeleteDeliveries(createdBefore time.Time) error {
+	_, err := db.db.Exec(
+		"DELETE FROM webhook_deliveries WHERE status <> $1 AND created_at < $2",
+		WEBHOOK_DELIVERY_PENDING, createdBefore,
+	)
+	return err
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// events about changed tasks, which are pushed to the clients of the user
+// with Server-Sent Events
+
+const (
+	EVENT_TASK_CREATED         = "task.created"
+	EVENT_TASK_UPDATED         = "task.updated"
+	EVENT_TASK_DELETED         = "task.deleted"
+	EVENT_DEPENDENCIES_CHANGED = "dependencies.changed"
+	// the status changed to done, the task is updated as well
+	EVENT_TASK_COMPLETED = "task.completed"
+)
+
+const EVENT_STREAM_CONTENT_TYPE = "text/event-stream"
+
+// the stream is kept open by a comment, if there are no events
+const EVENT_KEEP_ALIVE_INTERVAL = 30 * time.Second
+
+// events, which are sent while a client is too slow, are dropped
+const EVENT_BUFFER_SIZE = 64
+
+type Event struct {
+	Id     uint64 `json:"-"`
+	Type   string `json:"type"` // one of the EVENT_* constants
+	TaskId uint   `json:"taskId"`
+}
+
+// EventBroker sends the events of a user to all of their subscribers
+type EventBroker struct {
+	mutex       sync.Mutex
+	lastId      uint64
+	subscribers map[string]map[chan Event]bool
+}
+
+var events = NewEventBroker()
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[string]map[chan Event]bool)}
+}
+
+// Subscribe returns a channel with the events of the user. The channel must
+// be passed to Unsubscribe, when it isn't used anymore.
+func (b *EventBroker) Subscribe(user string) chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := make(chan Event, EVENT_BUFFER_SIZE)
+	if b.subscribers[user] == nil {
+		b.subscribers[user] = make(map[chan Event]bool)
+	}
+	b.subscribers[user][ch] = true
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(user string, ch chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers[user], ch)
+	if len(b.subscribers[user]) == 0 {
+		delete(b.subscribers, user)
+	}
+}
+
+// Publish sends the events to the subscribers of the user, the events must
+// already be written
+func (b *EventBroker) Publish(user string, userEvents ...Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, event := range userEvents {
+		b.lastId++
+		event.Id = b.lastId
+		for ch := range b.subscribers[user] {
+			select {
+			case ch <- event:
+			default:
+				logger.Warning.Printf("event %d for %s dropped\n", event.Id, user)
+			}
+		}
+	}
+}
+
+// pendingEvents collects the events of a transaction, which are published
+// after the commit. Events for the same task are only sent once.
+type pendingEvents struct {
+	user   string
+	events []Event
+}
+
+func (p *pendingEvents) add(user string, eventType string, taskIds ...uint) {
+	p.user = user
+	for _, id := range taskIds {
+		event := Event{Type: eventType, TaskId: id}
+		duplicate := false
+		for _, e := range p.events {
+			duplicate = duplicate || e == event
+		}
+		if !duplicate {
+			p.events = append(p.events, event)
+		}
+	}
+}
+
+// changedTaskIds returns the tasks with update events, whose version must be
+// incremented
+func (p *pendingEvents) changedTaskIds() []uint {
+	ids := make([]uint, 0)
+	changed := make(map[uint]bool)
+	for _, event := range p.events {
+		if event.Type != EVENT_TASK_UPDATED && event.Type != EVENT_DEPENDENCIES_CHANGED {
+			continue
+		}
+		if !changed[event.TaskId] {
+			changed[event.TaskId] = true
+			ids = append(ids, event.TaskId)
+		}
+	}
+	return ids
+}
+
+func (p *pendingEvents) publish() {
+	if p.user != "" && len(p.events) > 0 {
+		events.Publish(p.user, p.events...)
+	}
+	p.events = nil
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+// queryTokenMiddleware passes the query parameter token as Authorization
+// header, because the EventSource of the browsers can't set headers
+func queryTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleEventsGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// the stream is open until the client disconnects
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	ch := events.Subscribe(user)
+	defer events.Unsubscribe(user, ch)
+
+	w.Header().Set("Content-Type", EVENT_STREAM_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EVENT_KEEP_ALIVE_INTERVAL)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
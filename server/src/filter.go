@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// sorting and pagination of the task list
+
+const (
+	TASK_SORT_ID       = "id"
+	TASK_SORT_TITLE    = "title"
+	TASK_SORT_DATE     = "date"
+	TASK_SORT_DURATION = "estimatedDuration"
+)
+
+// maximum number of tasks of one page
+const TASKS_MAX_LIMIT = 1000
+
+func ValidateTaskSort(sort string) bool {
+	switch sort {
+	case TASK_SORT_ID, TASK_SORT_TITLE, TASK_SORT_DATE, TASK_SORT_DURATION:
+		return true
+	}
+	return false
+}
+
+// taskSortValue returns the value of the task, which is sorted by. The date
+// is sorted with its time, tasks without date come first.
+func taskSortValue(task *Task, sort string) string {
+	switch sort {
+	case TASK_SORT_TITLE:
+		return task.Title
+	case TASK_SORT_DATE:
+		return task.Date + " " + task.Time
+	case TASK_SORT_DURATION:
+		return fmt.Sprint(task.EstimatedDuration)
+	}
+	return fmt.Sprint(task.Id)
+}
+
+// compareTaskToCursor returns -1, 0 or 1, if the task is before, at or after
+// the cursor in ascending order
+func compareTaskToCursor(task *Task, sort string, cursor TaskCursor) int {
+	result := 0
+	switch sort {
+	case "", TASK_SORT_ID:
+	case TASK_SORT_DURATION:
+		duration, _ := strconv.ParseUint(cursor.Value, 10, 32)
+		if uint64(task.EstimatedDuration) < duration {
+			result = -1
+		} else if uint64(task.EstimatedDuration) > duration {
+			result = 1
+		}
+	default:
+		result = strings.Compare(taskSortValue(task, sort), cursor.Value)
+	}
+	if result == 0 {
+		if task.Id < cursor.Id {
+			result = -1
+		} else if task.Id > cursor.Id {
+			result = 1
+		}
+	}
+	return result
+}
+
+// the cursor, which is passed to the clients, also contains the sort order to
+// detect cursors of other queries
+type encodedTaskCursor struct {
+	TaskCursor
+	Sort       string `json:"sort"`
+	Descending bool   `json:"descending"`
+}
+
+func EncodeTaskCursor(task *Task, filter *TaskFilter) string {
+	sort := filter.Sort
+	if sort == "" {
+		sort = TASK_SORT_ID
+	}
+	data, _ := json.Marshal(encodedTaskCursor{
+		TaskCursor{task.Id, taskSortValue(task, sort)},
+		sort,
+		filter.Descending,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeTaskCursor(cursor string, filter *TaskFilter) (*TaskCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	var decoded encodedTaskCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	sort := filter.Sort
+	if sort == "" {
+		sort = TASK_SORT_ID
+	}
+	if decoded.Sort != sort || decoded.Descending != filter.Descending {
+		return nil, errors.New("Cursor belongs to another sort order")
+	}
+	return &decoded.TaskCursor, nil
+}
+
+func parseBoolQuery(query url.Values, key string) (*bool, error) {
+	value := query.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s must be true or false", key))
+	}
+	return &b, nil
+}
+
+// ParseTaskFilter reads the filter of the task list from the query
+// parameters status, from, to, q, hasDependencies, hasDependents, tags, sort
+// (with a leading '-' for descending order), limit and cursor
+func ParseTaskFilter(query url.Values) (TaskFilter, error) {
+	var filter TaskFilter
+	var err error
+	if statusStr := query.Get("status"); statusStr != "" {
+		for _, status := range strings.Split(statusStr, ",") {
+			if status == "" || !ValidateStatus(status) {
+				return filter, errors.New(fmt.Sprintf("unknown status '%s'", status))
+			}
+			filter.Status = append(filter.Status, status)
+		}
+	}
+	filter.DateFrom = query.Get("from")
+	filter.DateTo = query.Get("to")
+	if !ValidateDate(filter.DateFrom) || !ValidateDate(filter.DateTo) {
+		return filter, errors.New("from and to must be dates (yyyy-mm-dd)")
+	}
+	filter.Query = query.Get("q")
+	if filter.HasDependencies, err = parseBoolQuery(query, "hasDependencies"); err != nil {
+		return filter, err
+	}
+	if filter.HasDependents, err = parseBoolQuery(query, "hasDependents"); err != nil {
+		return filter, err
+	}
+	if tags := query.Get("tags"); tags != "" {
+		if filter.Tags, err = ParseTagExpression(tags); err != nil {
+			return filter, err
+		}
+	}
+	if sort := query.Get("sort"); sort != "" {
+		filter.Descending = strings.HasPrefix(sort, "-")
+		filter.Sort = strings.TrimPrefix(sort, "-")
+		if !ValidateTaskSort(filter.Sort) {
+			return filter, errors.New(fmt.Sprintf(
+				"sort must be one of '%s', '%s', '%s' or '%s'",
+				TASK_SORT_ID, TASK_SORT_TITLE, TASK_SORT_DATE, TASK_SORT_DURATION,
+			))
+		}
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.ParseUint(limitStr, 10, 32)
+		if err != nil || limit == 0 || limit > TASKS_MAX_LIMIT {
+			return filter, errors.New(fmt.Sprintf("limit must be between 1 and %d", TASKS_MAX_LIMIT))
+		}
+		filter.Limit = uint(limit)
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.Limit == 0 {
+			return filter, errors.New("cursor needs a limit")
+		}
+		if filter.After, err = DecodeTaskCursor(cursor, &filter); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
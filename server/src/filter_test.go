@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTaskCursor(t *testing.T) {
+	task := Task{Id: 7, Title: "write tests", Date: "2023-05-01", Time: "10:00", EstimatedDuration: 30}
+	tests := []struct {
+		filter TaskFilter
+		value  string
+	}{
+		{TaskFilter{}, "7"},
+		{TaskFilter{Sort: TASK_SORT_ID, Descending: true}, "7"},
+		{TaskFilter{Sort: TASK_SORT_TITLE}, "write tests"},
+		{TaskFilter{Sort: TASK_SORT_DATE}, "2023-05-01 10:00"},
+		{TaskFilter{Sort: TASK_SORT_DURATION, Descending: true}, "30"},
+	}
+	for _, test := range tests {
+		cursor, err := DecodeTaskCursor(EncodeTaskCursor(&task, &test.filter), &test.filter)
+		if err != nil {
+			t.Errorf("DecodeTaskCursor() with %+v returned %v", test.filter, err)
+			continue
+		}
+		if cursor.Id != task.Id || cursor.Value != test.value {
+			t.Errorf("DecodeTaskCursor() with %+v = %+v, want value %s", test.filter, cursor, test.value)
+		}
+	}
+}
+
+func TestDecodeTaskCursorErrors(t *testing.T) {
+	task := Task{Id: 7, Title: "write tests"}
+	byTitle := EncodeTaskCursor(&task, &TaskFilter{Sort: TASK_SORT_TITLE})
+	tests := []struct {
+		name   string
+		cursor string
+		filter TaskFilter
+	}{
+		{"no base64", "!!!", TaskFilter{}},
+		{"no json", "bm8ganNvbg", TaskFilter{}},
+		{"other sort", byTitle, TaskFilter{Sort: TASK_SORT_DATE}},
+		{"other direction", byTitle, TaskFilter{Sort: TASK_SORT_TITLE, Descending: true}},
+		{"default sort", byTitle, TaskFilter{}},
+	}
+	for _, test := range tests {
+		if _, err := DecodeTaskCursor(test.cursor, &test.filter); err == nil {
+			t.Errorf("%s: DecodeTaskCursor() returned no error", test.name)
+		}
+	}
+}
+
+func TestTaskListFilter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		first := c.createTask(map[string]interface{}{"title": "b first", "date": "2023-05-02"})
+		second := c.createTask(map[string]interface{}{"title": "a second", "previousTaskIds": []uint{first}})
+		third := c.createTask(map[string]interface{}{"title": "c third", "date": "2023-05-01", "status": STATUS_DONE})
+		tests := []struct {
+			query string
+			ids   []uint
+		}{
+			{"", []uint{first, second, third}},
+			{"?hasDependencies=true", []uint{second}},
+			{"?hasDependencies=false", []uint{first, third}},
+			{"?hasDependents=true", []uint{first}},
+			{"?status=open", []uint{first, second}},
+			{"?from=2023-05-02", []uint{first}},
+			{"?q=SECOND", []uint{second}},
+			{"?sort=title", []uint{second, first, third}},
+			{"?sort=-date", []uint{first, third, second}},
+		}
+		for _, test := range tests {
+			var tasks []Task
+			if status := c.request("GET", "/tasks"+test.query, nil, &tasks); status != http.StatusOK {
+				t.Errorf("%s responded with %d", test.query, status)
+				continue
+			}
+			ids := make([]uint, 0, len(tasks))
+			for _, task := range tasks {
+				ids = append(ids, task.Id)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("%s returned %v, want %v", test.query, ids, test.ids)
+			}
+		}
+
+		// the pages of the tasks sorted by title
+		ids := make([]uint, 0)
+		next := ""
+		for page := 0; page == 0 || next != ""; page++ {
+			var response struct {
+				Tasks []Task `json:"tasks"`
+				Next  string `json:"next"`
+			}
+			if status := c.request("GET", "/tasks?sort=title&limit=2&cursor="+next, nil, &response); status != http.StatusOK {
+				t.Fatalf("page %d responded with %d", page, status)
+			}
+			for _, task := range response.Tasks {
+				ids = append(ids, task.Id)
+			}
+			next = response.Next
+		}
+		if !reflect.DeepEqual(ids, []uint{second, first, third}) {
+			t.Errorf("pages returned %v", ids)
+		}
+		if status := c.request("GET", "/tasks?sort=date&limit=2&cursor=x", nil, nil); status != http.StatusBadRequest {
+			t.Errorf("invalid cursor responded with %d", status)
+		}
+	})
+}
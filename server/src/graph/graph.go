@@ -0,0 +1,325 @@
+// Package graph contains the algorithms working on the dependency graph of
+// the tasks. An edge from -> to means, that the task from has to be done
+// before the task to (see the next_task_map table).
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CycleError is returned, if the graph contains a cycle, but the algorithm
+// requires an acyclic graph
+type CycleError struct {
+	Path []uint
+}
+
+func (e *CycleError) Error() string {
+	pathStr := make([]string, 0, len(e.Path))
+	for _, id := range e.Path {
+		pathStr = append(pathStr, fmt.Sprint(id))
+	}
+	return fmt.Sprintf("Dependency cycle detected: %s", strings.Join(pathStr, " -> "))
+}
+
+type Graph struct {
+	nodes map[uint]struct{}
+	next  map[uint][]uint
+	// the inverted edges, so the predecessors are found without a scan of
+	// all nodes
+	prev map[uint][]uint
+}
+
+func New() *Graph {
+	return &Graph{
+		nodes: make(map[uint]struct{}),
+		next:  make(map[uint][]uint),
+		prev:  make(map[uint][]uint),
+	}
+}
+
+func (g *Graph) AddNode(id uint) {
+	g.nodes[id] = struct{}{}
+}
+
+func (g *Graph) AddEdge(from, to uint) {
+	g.AddNode(from)
+	g.AddNode(to)
+	for _, n := range g.next[from] {
+		if n == to {
+			return
+		}
+	}
+	g.next[from] = append(g.next[from], to)
+	g.prev[to] = append(g.prev[to], from)
+}
+
+// without removes the id from the ids
+func without(ids []uint, id uint) []uint {
+	filtered := ids[:0]
+	for _, n := range ids {
+		if n != id {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// RemoveEdgesFrom removes all edges starting at the node id
+func (g *Graph) RemoveEdgesFrom(id uint) {
+	for _, n := range g.next[id] {
+		g.prev[n] = without(g.prev[n], id)
+	}
+	delete(g.next, id)
+}
+
+// RemoveEdgesTo removes all edges ending at the node id
+func (g *Graph) RemoveEdgesTo(id uint) {
+	for _, from := range g.prev[id] {
+		g.next[from] = without(g.next[from], id)
+	}
+	delete(g.prev, id)
+}
+
+// Nodes returns all node ids in ascending order
+func (g *Graph) Nodes() []uint {
+	nodes := make([]uint, 0, len(g.nodes))
+	for id := range g.nodes {
+		nodes = append(nodes, id)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+// Next returns the ids of the direct followers of the node id in ascending
+// order
+func (g *Graph) Next(id uint) []uint {
+	next := append([]uint{}, g.next[id]...)
+	sort.Slice(next, func(i, j int) bool { return next[i] < next[j] })
+	return next
+}
+
+// FindCycle searches the graph for a cycle. If there is one, the path of the
+// cycle is returned, where the first and the last id are the same node
+// (e.g. [1, 2, 3, 1]). A self reference results in a path like [1, 1]. If
+// the graph has no cycle, nil is returned.
+func (g *Graph) FindCycle() []uint {
+	const (
+		unvisited = iota
+		inPath
+		checked
+	)
+	state := make(map[uint]int)
+	path := make([]uint, 0)
+
+	var visit func(id uint) []uint
+	visit = func(id uint) []uint {
+		state[id] = inPath
+		path = append(path, id)
+		for _, n := range g.Next(id) {
+			switch state[n] {
+			case inPath:
+				for i, p := range path {
+					if p == n {
+						cycle := append([]uint{}, path[i:]...)
+						return append(cycle, n)
+					}
+				}
+			case unvisited:
+				if cycle := visit(n); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = checked
+		return nil
+	}
+
+	for _, id := range g.Nodes() {
+		if state[id] == unvisited {
+			if cycle := visit(id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Previous returns the ids of the direct predecessors of the node id in
+// ascending order
+func (g *Graph) Previous(id uint) []uint {
+	previous := append([]uint{}, g.prev[id]...)
+	sort.Slice(previous, func(i, j int) bool { return previous[i] < previous[j] })
+	return previous
+}
+
+// Roots returns all nodes without predecessors in ascending order
+func (g *Graph) Roots() []uint {
+	inDegree := g.inDegree()
+	roots := make([]uint, 0)
+	for _, id := range g.Nodes() {
+		if inDegree[id] == 0 {
+			roots = append(roots, id)
+		}
+	}
+	return roots
+}
+
+// Leaves returns all nodes without followers in ascending order
+func (g *Graph) Leaves() []uint {
+	leaves := make([]uint, 0)
+	for _, id := range g.Nodes() {
+		if len(g.next[id]) == 0 {
+			leaves = append(leaves, id)
+		}
+	}
+	return leaves
+}
+
+func (g *Graph) inDegree() map[uint]int {
+	inDegree := make(map[uint]int)
+	for id, previous := range g.prev {
+		inDegree[id] = len(previous)
+	}
+	return inDegree
+}
+
+// TopologicalOrder returns all nodes in an order, where every node comes
+// after all of its predecessors. Of the nodes, which can be next, the one
+// with the lowest id is taken first, so the order is stable. If the graph
+// contains a cycle, a CycleError is returned.
+func (g *Graph) TopologicalOrder() ([]uint, error) {
+	inDegree := g.inDegree()
+	available := g.Roots()
+	order := make([]uint, 0, len(g.nodes))
+	for len(available) > 0 {
+		id := available[0]
+		available = available[1:]
+		order = append(order, id)
+		for _, n := range g.Next(id) {
+			inDegree[n]--
+			if inDegree[n] == 0 {
+				idx := sort.Search(len(available), func(i int) bool { return available[i] > n })
+				available = append(available, 0)
+				copy(available[idx+1:], available[idx:])
+				available[idx] = n
+			}
+		}
+	}
+	if len(order) != len(g.nodes) {
+		return nil, &CycleError{g.FindCycle()}
+	}
+	return order, nil
+}
+
+// Levels assigns every node the length of the longest path from a root to
+// it. Roots have the level 0. If the graph contains a cycle, a CycleError is
+// returned.
+func (g *Graph) Levels() (map[uint]int, error) {
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		return nil, err
+	}
+	levels := make(map[uint]int)
+	for _, id := range order {
+		if _, ok := levels[id]; !ok {
+			levels[id] = 0
+		}
+		for _, n := range g.next[id] {
+			if levels[id]+1 > levels[n] {
+				levels[n] = levels[id] + 1
+			}
+		}
+	}
+	return levels, nil
+}
+
+// Schedule of a single node, all values are relative to the start of the
+// whole graph and use the unit of the durations
+type NodeSchedule struct {
+	Id             uint `json:"id"`
+	Duration       uint `json:"duration"`
+	EarliestStart  uint `json:"earliestStart"`
+	EarliestFinish uint `json:"earliestFinish"`
+	LatestStart    uint `json:"latestStart"`
+	LatestFinish   uint `json:"latestFinish"`
+	Slack          uint `json:"slack"`
+	Critical       bool `json:"critical"` // a delay of this node delays the end of the graph
+}
+
+type CriticalPathResult struct {
+	Duration uint           `json:"duration"` // duration of the whole graph
+	Path     []uint         `json:"path"`     // longest chain of nodes
+	Nodes    []NodeSchedule `json:"nodes"`    // ordered topologically
+}
+
+// CriticalPath runs the critical path method on the graph. Nodes which are
+// missing in durations have a duration of 0. If the graph contains a cycle,
+// a CycleError is returned.
+func (g *Graph) CriticalPath(durations map[uint]uint) (CriticalPathResult, error) {
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		return CriticalPathResult{}, err
+	}
+	schedules := make(map[uint]*NodeSchedule)
+	var end uint
+	// forward pass
+	for _, id := range order {
+		s := &NodeSchedule{Id: id, Duration: durations[id]}
+		for _, p := range g.prev[id] {
+			if schedules[p].EarliestFinish > s.EarliestStart {
+				s.EarliestStart = schedules[p].EarliestFinish
+			}
+		}
+		s.EarliestFinish = s.EarliestStart + s.Duration
+		if s.EarliestFinish > end {
+			end = s.EarliestFinish
+		}
+		schedules[id] = s
+	}
+	// backward pass
+	for i := len(order) - 1; i >= 0; i-- {
+		s := schedules[order[i]]
+		s.LatestFinish = end
+		for _, n := range g.next[s.Id] {
+			if schedules[n].LatestStart < s.LatestFinish {
+				s.LatestFinish = schedules[n].LatestStart
+			}
+		}
+		s.LatestStart = s.LatestFinish - s.Duration
+		s.Slack = s.LatestStart - s.EarliestStart
+		s.Critical = s.Slack == 0
+	}
+
+	result := CriticalPathResult{
+		Duration: end,
+		Path:     make([]uint, 0),
+		Nodes:    make([]NodeSchedule, 0, len(order)),
+	}
+	for _, id := range order {
+		result.Nodes = append(result.Nodes, *schedules[id])
+	}
+	// follow the critical nodes from a critical root to the end
+	var current *NodeSchedule
+	for _, id := range g.Roots() {
+		if schedules[id].Critical {
+			current = schedules[id]
+			break
+		}
+	}
+	for current != nil {
+		result.Path = append(result.Path, current.Id)
+		var next *NodeSchedule
+		for _, n := range g.Next(current.Id) {
+			s := schedules[n]
+			if s.Critical && s.EarliestStart == current.EarliestFinish {
+				next = s
+				break
+			}
+		}
+		current = next
+	}
+	return result, nil
+}
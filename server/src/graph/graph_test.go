@@ -0,0 +1,201 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newGraph(nodes []uint, edges [][2]uint) *Graph {
+	g := New()
+	for _, id := range nodes {
+		g.AddNode(id)
+	}
+	for _, edge := range edges {
+		g.AddEdge(edge[0], edge[1])
+	}
+	return g
+}
+
+func TestFindCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []uint
+		edges [][2]uint
+		cycle []uint
+	}{
+		{"empty", nil, nil, nil},
+		{"single node", []uint{1}, nil, nil},
+		{"chain", nil, [][2]uint{{1, 2}, {2, 3}}, nil},
+		{"diamond", nil, [][2]uint{{1, 2}, {1, 3}, {2, 4}, {3, 4}}, nil},
+		{"self reference", nil, [][2]uint{{1, 1}}, []uint{1, 1}},
+		{"two nodes", nil, [][2]uint{{1, 2}, {2, 1}}, []uint{1, 2, 1}},
+		{"three nodes", nil, [][2]uint{{1, 2}, {2, 3}, {3, 1}}, []uint{1, 2, 3, 1}},
+		{"cycle after a chain", nil, [][2]uint{{1, 2}, {2, 3}, {3, 4}, {4, 2}}, []uint{2, 3, 4, 2}},
+		{"duplicate edge", nil, [][2]uint{{1, 2}, {1, 2}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cycle := newGraph(test.nodes, test.edges).FindCycle()
+			if !reflect.DeepEqual(cycle, test.cycle) {
+				t.Errorf("FindCycle() = %v, want %v", cycle, test.cycle)
+			}
+		})
+	}
+}
+
+func TestTopologicalOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []uint
+		edges  [][2]uint
+		order  []uint
+		levels map[uint]int
+	}{
+		{"empty", nil, nil, []uint{}, map[uint]int{}},
+		{"unconnected nodes", []uint{3, 1, 2}, nil, []uint{1, 2, 3}, map[uint]int{1: 0, 2: 0, 3: 0}},
+		{"chain", nil, [][2]uint{{3, 2}, {2, 1}}, []uint{3, 2, 1}, map[uint]int{3: 0, 2: 1, 1: 2}},
+		{
+			"lowest id first",
+			[]uint{5},
+			[][2]uint{{4, 1}, {2, 3}, {3, 1}},
+			[]uint{2, 3, 4, 1, 5},
+			map[uint]int{1: 2, 2: 0, 3: 1, 4: 0, 5: 0},
+		},
+		{
+			"level is the longest path",
+			nil,
+			[][2]uint{{1, 2}, {2, 3}, {3, 4}, {1, 4}},
+			[]uint{1, 2, 3, 4},
+			map[uint]int{1: 0, 2: 1, 3: 2, 4: 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newGraph(test.nodes, test.edges)
+			order, err := g.TopologicalOrder()
+			if err != nil || !reflect.DeepEqual(order, test.order) {
+				t.Errorf("TopologicalOrder() = %v, %v, want %v", order, err, test.order)
+			}
+			levels, err := g.Levels()
+			if err != nil || !reflect.DeepEqual(levels, test.levels) {
+				t.Errorf("Levels() = %v, %v, want %v", levels, err, test.levels)
+			}
+		})
+	}
+
+	g := newGraph(nil, [][2]uint{{1, 2}, {2, 3}, {3, 2}})
+	if _, err := g.TopologicalOrder(); err == nil {
+		t.Errorf("TopologicalOrder() of a cycle returned no error")
+	}
+	_, err := g.Levels()
+	if cycleErr, ok := err.(*CycleError); !ok || !reflect.DeepEqual(cycleErr.Path, []uint{2, 3, 2}) {
+		t.Errorf("Levels() of a cycle returned %v", err)
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		nodes     []uint
+		edges     [][2]uint
+		durations map[uint]uint
+		duration  uint
+		path      []uint
+		slack     map[uint]uint
+	}{
+		{
+			name:     "empty",
+			duration: 0,
+			path:     []uint{},
+			slack:    map[uint]uint{},
+		},
+		{
+			name:      "single node",
+			nodes:     []uint{1},
+			durations: map[uint]uint{1: 5},
+			duration:  5,
+			path:      []uint{1},
+			slack:     map[uint]uint{1: 0},
+		},
+		{
+			name:      "chain",
+			edges:     [][2]uint{{1, 2}, {2, 3}},
+			durations: map[uint]uint{1: 2, 2: 3, 3: 4},
+			duration:  9,
+			path:      []uint{1, 2, 3},
+			slack:     map[uint]uint{1: 0, 2: 0, 3: 0},
+		},
+		{
+			name:      "diamond with a shorter branch",
+			edges:     [][2]uint{{1, 2}, {1, 3}, {2, 4}, {3, 4}},
+			durations: map[uint]uint{1: 1, 2: 5, 3: 2, 4: 1},
+			duration:  7,
+			path:      []uint{1, 2, 4},
+			slack:     map[uint]uint{1: 0, 2: 0, 3: 3, 4: 0},
+		},
+		{
+			name:      "missing durations are 0",
+			nodes:     []uint{3},
+			edges:     [][2]uint{{1, 2}},
+			durations: map[uint]uint{2: 4},
+			duration:  4,
+			path:      []uint{1, 2},
+			slack:     map[uint]uint{1: 0, 2: 0, 3: 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := newGraph(test.nodes, test.edges).CriticalPath(test.durations)
+			if err != nil {
+				t.Fatalf("CriticalPath() returned %v", err)
+			}
+			if result.Duration != test.duration {
+				t.Errorf("Duration = %d, want %d", result.Duration, test.duration)
+			}
+			if !reflect.DeepEqual(result.Path, test.path) {
+				t.Errorf("Path = %v, want %v", result.Path, test.path)
+			}
+			slack := make(map[uint]uint)
+			for _, node := range result.Nodes {
+				slack[node.Id] = node.Slack
+				if node.Critical != (node.Slack == 0) {
+					t.Errorf("node %d is critical %v with slack %d", node.Id, node.Critical, node.Slack)
+				}
+			}
+			if !reflect.DeepEqual(slack, test.slack) {
+				t.Errorf("slack = %v, want %v", slack, test.slack)
+			}
+		})
+	}
+}
+
+func TestCriticalPathCycle(t *testing.T) {
+	_, err := newGraph(nil, [][2]uint{{1, 2}, {2, 1}}).CriticalPath(nil)
+	if _, ok := err.(*CycleError); !ok {
+		t.Errorf("CriticalPath() returned %v, want a CycleError", err)
+	}
+}
+
+func TestPrevious(t *testing.T) {
+	g := newGraph(nil, [][2]uint{{3, 1}, {2, 1}, {1, 4}, {2, 4}, {4, 5}})
+	tests := []struct {
+		name     string
+		remove   func()
+		previous map[uint][]uint
+	}{
+		{"edges", func() {}, map[uint][]uint{1: {2, 3}, 2: {}, 3: {}, 4: {1, 2}, 5: {4}}},
+		{"without the edges from 2", func() { g.RemoveEdgesFrom(2) }, map[uint][]uint{1: {3}, 4: {1}, 5: {4}}},
+		{"without the edges to 4", func() { g.RemoveEdgesTo(4) }, map[uint][]uint{1: {3}, 4: {}, 5: {4}}},
+	}
+	for _, test := range tests {
+		test.remove()
+		for id, previous := range test.previous {
+			if got := g.Previous(id); !reflect.DeepEqual(got, previous) {
+				t.Errorf("%s: Previous(%d) = %v, want %v", test.name, id, got, previous)
+			}
+		}
+	}
+	if roots := g.Roots(); !reflect.DeepEqual(roots, []uint{2, 3, 4}) {
+		t.Errorf("Roots() = %v", roots)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"smart-todo-server/graph"
+)
+
+// collaborative editing of the dependency graph over a WebSocket. Clients
+// subscribe to the graph of their user and send operations, which add or
+// remove an edge. The operations of a user are applied one after another and
+// are validated like an update of the next tasks: both tasks must exist and
+// an added edge must not create a cycle. If concurrent operations conflict,
+// the first one wins and the later one is rejected. Every client receives the
+// accepted operations in the same order with increasing versions, changes of
+// the graph by the other endpoints are sent as operations as well.
+
+const (
+	GRAPH_MESSAGE_SUBSCRIBE = "subscribe"
+	GRAPH_MESSAGE_SNAPSHOT  = "snapshot"
+	GRAPH_MESSAGE_ADD       = "add"
+	GRAPH_MESSAGE_REMOVE    = "remove"
+	GRAPH_MESSAGE_REJECTED  = "rejected"
+	GRAPH_MESSAGE_ERROR     = "error"
+)
+
+const (
+	GRAPH_PING_INTERVAL = 30 * time.Second
+	// the connection is closed, if the client doesn't answer a ping in time
+	GRAPH_PONG_TIMEOUT  = 60 * time.Second
+	GRAPH_WRITE_TIMEOUT = 10 * time.Second
+)
+
+const GRAPH_MAX_MESSAGE_SIZE = 4096
+
+// clients, which are too slow to receive their messages, are disconnected
+const GRAPH_SEND_BUFFER_SIZE = 64
+
+type GraphEdge struct {
+	TaskId     uint `json:"taskId"`
+	NextTaskId uint `json:"nextTaskId"`
+}
+
+// GraphMessage is sent by the clients and the server, the fields depend on
+// the type
+type GraphMessage struct {
+	Type string `json:"type"` // one of the GRAPH_MESSAGE_* constants
+	// chosen by the client, the answers to its operations contain it
+	Id         string `json:"id,omitempty"`
+	Version    uint64 `json:"version,omitempty"`
+	TaskId     uint   `json:"taskId,omitempty"`
+	NextTaskId uint   `json:"nextTaskId,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Cycle      []uint `json:"cycle,omitempty"`
+}
+
+// GraphSnapshot is the answer to a subscription, the following operations
+// have greater versions
+type GraphSnapshot struct {
+	Type    string      `json:"type"`
+	Version uint64      `json:"version"`
+	Edges   []GraphEdge `json:"edges"`
+}
+
+// the API is authorized by tokens instead of cookies, so other origins are
+// allowed like by the CORS headers
+var graphUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type graphClient struct {
+	conn       *websocket.Conn
+	send       chan any
+	subscribed bool
+}
+
+// graphHub orders the operations of the connected clients of a user
+type graphHub struct {
+	user    string
+	mutex   sync.Mutex
+	version uint64
+	// the graph, which is known by the subscribed clients
+	edges   map[GraphEdge]bool
+	clients map[*graphClient]bool
+	events  chan Event
+	done    chan bool
+}
+
+var graphHubsMutex sync.Mutex
+var graphHubs = make(map[string]*graphHub)
+
+// joinGraphHub adds the client to the hub of the user, which is created for
+// the first client
+func joinGraphHub(user string, client *graphClient) *graphHub {
+	graphHubsMutex.Lock()
+	defer graphHubsMutex.Unlock()
+	hub, ok := graphHubs[user]
+	if !ok {
+		hub = &graphHub{
+			user:    user,
+			clients: make(map[*graphClient]bool),
+			events:  events.Subscribe(user),
+			done:    make(chan bool),
+		}
+		graphHubs[user] = hub
+		go hub.run()
+	}
+	hub.mutex.Lock()
+	hub.clients[client] = true
+	hub.mutex.Unlock()
+	return hub
+}
+
+// leaveGraphHub removes the client, the hub is stopped after the last client
+func leaveGraphHub(hub *graphHub, client *graphClient) {
+	graphHubsMutex.Lock()
+	defer graphHubsMutex.Unlock()
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.remove(client)
+	if len(hub.clients) == 0 && graphHubs[hub.user] == hub {
+		delete(graphHubs, hub.user)
+		events.Unsubscribe(hub.user, hub.events)
+		close(hub.done)
+	}
+}
+
+// run sends the changes of the graph by the other endpoints to the clients
+func (h *graphHub) run() {
+	for {
+		select {
+		case <-h.done:
+			return
+		case event := <-h.events:
+			if event.Type == EVENT_TASK_UPDATED || event.Type == EVENT_TASK_COMPLETED {
+				continue
+			}
+			h.mutex.Lock()
+			if err := h.sync(); err != nil {
+				logger.Error.Println(err)
+			}
+			h.mutex.Unlock()
+		}
+	}
+}
+
+// remove disconnects the client, the hub must be locked
+func (h *graphHub) remove(client *graphClient) {
+	if h.clients[client] {
+		delete(h.clients, client)
+		close(client.send)
+	}
+}
+
+// sendTo queues a message for the client, the hub must be locked
+func (h *graphHub) sendTo(client *graphClient, message any) {
+	if !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+		logger.Warning.Printf("graph client of %s is too slow\n", h.user)
+		h.remove(client)
+	}
+}
+
+// broadcast sends an operation with the next version to all subscribed
+// clients, only the client of the operation gets its id. The hub must be
+// locked.
+func (h *graphHub) broadcast(message GraphMessage, origin *graphClient) {
+	h.version++
+	message.Version = h.version
+	id := message.Id
+	for client := range h.clients {
+		if !client.subscribed {
+			continue
+		}
+		message.Id = ""
+		if client == origin {
+			message.Id = id
+		}
+		h.sendTo(client, message)
+	}
+}
+
+func (h *graphHub) loadEdges() (map[GraphEdge]bool, error) {
+	tasks, err := store.SelectAllTasks(h.user, TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+	edges := make(map[GraphEdge]bool)
+	for _, task := range tasks {
+		for _, nt := range task.NextTaskIds {
+			edges[GraphEdge{task.Id, nt}] = true
+		}
+	}
+	return edges, nil
+}
+
+func sortedGraphEdges(edges map[GraphEdge]bool) []GraphEdge {
+	result := make([]GraphEdge, 0, len(edges))
+	for edge := range edges {
+		result = append(result, edge)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TaskId != result[j].TaskId {
+			return result[i].TaskId < result[j].TaskId
+		}
+		return result[i].NextTaskId < result[j].NextTaskId
+	})
+	return result
+}
+
+// sync loads the graph and broadcasts the edges, which were removed or added
+// since the last sync. The hub must be locked.
+func (h *graphHub) sync() error {
+	edges, err := h.loadEdges()
+	if err != nil {
+		return err
+	}
+	if h.edges != nil {
+		for _, edge := range sortedGraphEdges(h.edges) {
+			if !edges[edge] {
+				h.broadcast(GraphMessage{Type: GRAPH_MESSAGE_REMOVE, TaskId: edge.TaskId, NextTaskId: edge.NextTaskId}, nil)
+			}
+		}
+		for _, edge := range sortedGraphEdges(edges) {
+			if !h.edges[edge] {
+				h.broadcast(GraphMessage{Type: GRAPH_MESSAGE_ADD, TaskId: edge.TaskId, NextTaskId: edge.NextTaskId}, nil)
+			}
+		}
+	}
+	h.edges = edges
+	return nil
+}
+
+// handle answers a message of the client
+func (h *graphHub) handle(client *graphClient, message GraphMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch message.Type {
+	case GRAPH_MESSAGE_SUBSCRIBE:
+		if err := h.sync(); err != nil {
+			logger.Error.Println(err)
+			h.sendTo(client, GraphMessage{Type: GRAPH_MESSAGE_ERROR, Error: err.Error()})
+			return
+		}
+		client.subscribed = true
+		h.sendTo(client, GraphSnapshot{GRAPH_MESSAGE_SNAPSHOT, h.version, sortedGraphEdges(h.edges)})
+	case GRAPH_MESSAGE_ADD, GRAPH_MESSAGE_REMOVE:
+		if !client.subscribed {
+			h.sendTo(client, GraphMessage{Type: GRAPH_MESSAGE_ERROR, Id: message.Id, Error: "Not subscribed"})
+			return
+		}
+		h.apply(client, message)
+	default:
+		h.sendTo(client, GraphMessage{
+			Type:  GRAPH_MESSAGE_ERROR,
+			Id:    message.Id,
+			Error: "Unknown message type '" + message.Type + "'",
+		})
+	}
+}
+
+// apply validates and stores an operation of the client. Adding an existing
+// or removing a missing edge is only confirmed to the client. The hub must be
+// locked.
+func (h *graphHub) apply(client *graphClient, message GraphMessage) {
+	operation := GraphMessage{
+		Type:       message.Type,
+		Id:         message.Id,
+		TaskId:     message.TaskId,
+		NextTaskId: message.NextTaskId,
+	}
+	edge := GraphEdge{message.TaskId, message.NextTaskId}
+	var err error
+	if message.Type == GRAPH_MESSAGE_ADD {
+		err = store.LinkTasks(edge.TaskId, edge.NextTaskId, h.user)
+	} else {
+		err = store.UnlinkTasks(edge.TaskId, edge.NextTaskId, h.user)
+	}
+	if err != nil {
+		rejection := GraphMessage{Type: GRAPH_MESSAGE_REJECTED, Id: message.Id, Error: err.Error()}
+		var cycleErr *graph.CycleError
+		if errors.As(err, &cycleErr) {
+			rejection.Cycle = cycleErr.Path
+		}
+		h.sendTo(client, rejection)
+		return
+	}
+	if h.edges[edge] == (message.Type == GRAPH_MESSAGE_ADD) {
+		operation.Version = h.version
+		h.sendTo(client, operation)
+		return
+	}
+	if message.Type == GRAPH_MESSAGE_ADD {
+		h.edges[edge] = true
+	} else {
+		delete(h.edges, edge)
+	}
+	h.broadcast(operation, client)
+}
+
+// writeMessages sends the queued messages and pings to the client, until the
+// queue is closed
+func (c *graphClient) writeMessages() {
+	ping := time.NewTicker(GRAPH_PING_INTERVAL)
+	defer ping.Stop()
+	defer c.conn.Close()
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(GRAPH_WRITE_TIMEOUT))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(message); err != nil {
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(GRAPH_WRITE_TIMEOUT))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func handleTasksGraphSocket(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	// the upgrader responds with an error itself
+	conn, err := graphUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	client := &graphClient{conn: conn, send: make(chan any, GRAPH_SEND_BUFFER_SIZE)}
+	hub := joinGraphHub(user, client)
+	defer leaveGraphHub(hub, client)
+	go client.writeMessages()
+
+	conn.SetReadLimit(GRAPH_MAX_MESSAGE_SIZE)
+	conn.SetReadDeadline(time.Now().Add(GRAPH_PONG_TIMEOUT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(GRAPH_PONG_TIMEOUT))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Warning.Println(err)
+			}
+			return
+		}
+		var message GraphMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			hub.mutex.Lock()
+			hub.sendTo(client, GraphMessage{Type: GRAPH_MESSAGE_ERROR, Error: "Invalid JSON"})
+			hub.mutex.Unlock()
+			continue
+		}
+		hub.handle(client, message)
+	}
+}
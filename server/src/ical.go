@@ -0,0 +1,614 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iCalendar (RFC 5545) export and import of the tasks
+
+const ICAL_CONTENT_TYPE = "text/calendar"
+
+const ICAL_DATE_FORMAT = "20060102"
+const ICAL_DATE_TIME_FORMAT = "20060102T150405"
+const ICAL_MAX_LINE_LENGTH = 75
+
+// escapeIcalText escapes a value of the type TEXT
+func escapeIcalText(text string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\;",
+		",", "\\,",
+		"\r\n", "\\n",
+		"\n", "\\n",
+	).Replace(text)
+}
+
+// foldIcalLine splits a content line into lines of at most 75 octets, the
+// following lines start with a space
+func foldIcalLine(line string) string {
+	var builder strings.Builder
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > ICAL_MAX_LINE_LENGTH {
+			builder.WriteString("\r\n ")
+			length = 1
+		}
+		builder.WriteRune(r)
+		length += size
+	}
+	builder.WriteString("\r\n")
+	return builder.String()
+}
+
+func icalUid(id uint) string {
+	return fmt.Sprintf("task-%d@%s", id, config.Server.Domain)
+}
+
+func icalTodoStatus(status string) string {
+	switch status {
+	case STATUS_IN_PROGRESS:
+		return "IN-PROCESS"
+	case STATUS_DONE:
+		return "COMPLETED"
+	case STATUS_CANCELLED:
+		return "CANCELLED"
+	}
+	return "NEEDS-ACTION"
+}
+
+// values of PRIORITY, 1 is the highest and 9 the lowest priority
+var icalPriorities = map[string]int{
+	PRIORITY_HIGH:   1,
+	PRIORITY_MEDIUM: 5,
+	PRIORITY_LOW:    9,
+}
+
+// icalDue returns the DUE property of a task, a due date without time is a
+// DATE value
+func icalDue(task *Task) (string, error) {
+	if task.DueTime == "" {
+		due, err := time.Parse("2006-01-02", task.DueDate)
+		if err != nil {
+			return "", err
+		}
+		return "DUE;VALUE=DATE:" + due.Format(ICAL_DATE_FORMAT), nil
+	}
+	due, err := time.Parse("2006-01-02T15:04", task.DueDate+"T"+task.DueTime)
+	if err != nil {
+		return "", err
+	}
+	return "DUE:" + due.Format(ICAL_DATE_TIME_FORMAT), nil
+}
+
+// RenderCalendar renders all tasks with a date or a due date. Tasks with a
+// time are rendered as VEVENT, the other tasks as VTODO with DUE. The previous tasks
+// are referenced with RELATED-TO;RELTYPE=DEPENDS-ON (RFC 9253).
+func RenderCalendar(tasks []Task, now time.Time) string {
+	previous := make(map[uint][]uint)
+	for _, task := range tasks {
+		for _, nt := range task.NextTaskIds {
+			previous[nt] = append(previous[nt], task.Id)
+		}
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//smart-todo//smart-todo-server//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:smart-todo",
+	}
+	for _, task := range tasks {
+		if task.Date == "" && task.DueDate == "" {
+			continue
+		}
+		component, err := renderIcalComponent(&task, previous[task.Id], now)
+		if err != nil {
+			logger.Error.Println(err)
+			continue
+		}
+		lines = append(lines, component...)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var builder strings.Builder
+	for _, line := range lines {
+		builder.WriteString(foldIcalLine(line))
+	}
+	return builder.String()
+}
+
+// renderIcalComponent renders the VEVENT or VTODO of a task. The lines are
+// only returned, if the whole component could be rendered.
+func renderIcalComponent(task *Task, previousIds []uint, now time.Time) ([]string, error) {
+	component := "VTODO"
+	if task.Time != "" {
+		component = "VEVENT"
+	}
+	lines := []string{
+		"BEGIN:" + component,
+		"UID:" + icalUid(task.Id),
+		"DTSTAMP:" + now.UTC().Format(ICAL_DATE_TIME_FORMAT) + "Z",
+		"SUMMARY:" + escapeIcalText(task.Title),
+	}
+	if component == "VEVENT" {
+		start, err := time.Parse("2006-01-02T15:04", task.Date+"T"+task.Time)
+		if err != nil {
+			return nil, err
+		}
+		// without a time zone the time is floating, so it's the local time
+		// of the calendar
+		lines = append(lines, "DTSTART:"+start.Format(ICAL_DATE_TIME_FORMAT))
+		if task.EstimatedDuration > 0 {
+			lines = append(lines, fmt.Sprintf("DURATION:PT%dM", task.EstimatedDuration))
+		}
+		if task.Status == STATUS_CANCELLED {
+			lines = append(lines, "STATUS:CANCELLED")
+		} else {
+			lines = append(lines, "STATUS:CONFIRMED")
+		}
+	} else {
+		if task.Date != "" {
+			date, err := time.Parse("2006-01-02", task.Date)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, "DTSTART;VALUE=DATE:"+date.Format(ICAL_DATE_FORMAT))
+		}
+		if task.DueDate != "" {
+			due, err := icalDue(task)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, due)
+		}
+		lines = append(lines, "STATUS:"+icalTodoStatus(task.Status))
+		if task.CompletedAt != "" && task.Status == STATUS_DONE {
+			completed, err := time.Parse(time.RFC3339, task.CompletedAt)
+			if err == nil {
+				lines = append(lines, "COMPLETED:"+completed.UTC().Format(ICAL_DATE_TIME_FORMAT)+"Z")
+			}
+		}
+	}
+	if task.Priority != "" {
+		lines = append(lines, fmt.Sprintf("PRIORITY:%d", icalPriorities[task.Priority]))
+	}
+	if rule, err := ParseRecurrenceRule(task.Recurrence); task.Recurrence != "" && err == nil {
+		lines = append(lines, "RRULE:"+rule.String())
+	}
+	if task.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeIcalText(task.Description))
+	}
+	if task.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeIcalText(task.Location))
+	}
+	if len(task.Tags) > 0 {
+		categories := make([]string, 0, len(task.Tags))
+		for _, tag := range task.Tags {
+			categories = append(categories, escapeIcalText(tag))
+		}
+		lines = append(lines, "CATEGORIES:"+strings.Join(categories, ","))
+	}
+	sort.Slice(previousIds, func(i, j int) bool { return previousIds[i] < previousIds[j] })
+	for _, pt := range previousIds {
+		lines = append(lines, "RELATED-TO;RELTYPE=DEPENDS-ON:"+icalUid(pt))
+	}
+	return append(lines, "END:"+component), nil
+}
+
+// feedAuthMiddleware authorizes requests of calendar clients, which can't
+// set the Authorization header. Only access tokens are allowed, which are
+// passed with the query parameter token.
+func feedAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if !strings.HasPrefix(token, ACCESS_TOKEN_PREFIX) {
+			writeError(w, "query parameter token must be an access token", http.StatusUnauthorized)
+			return
+		}
+		user, error, status := authorizeAccessToken(r, token)
+		if error != "" {
+			writeError(w, error, status)
+			return
+		}
+		r.Header.Del("username")
+		r.Header.Add("username", user)
+		r.Header.Del("sessionId")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleCalendarGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	tasks, err := store.SelectAllTasks(user, TaskFilter{})
+	if err != nil {
+		logger.Error.Println(err)
+		w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", ICAL_CONTENT_TYPE+"; charset=utf-8")
+	w.Header().Add("Content-Disposition", "inline; filename=\"smart-todo.ics\"")
+	fmt.Fprint(w, RenderCalendar(tasks, time.Now()))
+}
+
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// a VTODO or VEVENT of a calendar, nested components like VALARM are
+// skipped
+type icalComponent struct {
+	Name       string
+	Properties []icalProperty
+}
+
+func (c *icalComponent) property(name string) (icalProperty, bool) {
+	for _, property := range c.Properties {
+		if property.Name == name {
+			return property, true
+		}
+	}
+	return icalProperty{}, false
+}
+
+func unescapeIcalText(text string) string {
+	return strings.NewReplacer(
+		"\\\\", "\\",
+		"\\;", ";",
+		"\\,", ",",
+		"\\n", "\n",
+		"\\N", "\n",
+	).Replace(text)
+}
+
+// splitIcalList splits a list of TEXT values at the commas, which aren't
+// escaped
+func splitIcalList(value string) []string {
+	values := make([]string, 0)
+	current := ""
+	escaped := false
+	for _, r := range value {
+		if r == ',' && !escaped {
+			values = append(values, current)
+			current = ""
+			continue
+		}
+		escaped = r == '\\' && !escaped
+		current += string(r)
+	}
+	return append(values, current)
+}
+
+// parseIcalLine splits a content line into name, parameters and value.
+// Parameter values can be quoted to contain ':' and ';'.
+func parseIcalLine(line string) (icalProperty, error) {
+	property := icalProperty{Params: make(map[string]string)}
+	end := strings.IndexAny(line, ";:")
+	if end <= 0 {
+		return property, errors.New(fmt.Sprintf("Invalid content line '%s'", line))
+	}
+	property.Name = strings.ToUpper(line[:end])
+	rest := line[end:]
+	for strings.HasPrefix(rest, ";") {
+		rest = rest[1:]
+		equals := strings.Index(rest, "=")
+		if equals <= 0 {
+			return property, errors.New(fmt.Sprintf("Invalid parameter in line '%s'", line))
+		}
+		name := strings.ToUpper(rest[:equals])
+		rest = rest[equals+1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			quote := strings.Index(rest[1:], "\"")
+			if quote < 0 {
+				return property, errors.New(fmt.Sprintf("Unterminated quote in line '%s'", line))
+			}
+			value = rest[1 : quote+1]
+			rest = rest[quote+2:]
+		} else {
+			valueEnd := strings.IndexAny(rest, ";:")
+			if valueEnd < 0 {
+				return property, errors.New(fmt.Sprintf("Missing value in line '%s'", line))
+			}
+			value = rest[:valueEnd]
+			rest = rest[valueEnd:]
+		}
+		property.Params[name] = value
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return property, errors.New(fmt.Sprintf("Missing value in line '%s'", line))
+	}
+	property.Value = rest[1:]
+	return property, nil
+}
+
+// ParseCalendar returns the VTODO and VEVENT components of a calendar. An
+// error is returned, if the calendar isn't well-formed.
+func ParseCalendar(data string) ([]icalComponent, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	// unfold the lines
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	components := make([]icalComponent, 0)
+	var current *icalComponent
+	stack := make([]string, 0)
+	for i, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		property, err := parseIcalLine(line)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Content line %d: %v", i+1, err))
+		}
+		switch property.Name {
+		case "BEGIN":
+			name := strings.ToUpper(property.Value)
+			if len(stack) == 0 && name != "VCALENDAR" {
+				return nil, errors.New(fmt.Sprintf("Content line %d: expected BEGIN:VCALENDAR", i+1))
+			}
+			if len(stack) == 1 && (name == "VTODO" || name == "VEVENT") {
+				current = &icalComponent{Name: name}
+			}
+			stack = append(stack, name)
+		case "END":
+			name := strings.ToUpper(property.Value)
+			if len(stack) == 0 || stack[len(stack)-1] != name {
+				return nil, errors.New(fmt.Sprintf("Content line %d: unexpected END:%s", i+1, name))
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 1 && current != nil {
+				components = append(components, *current)
+				current = nil
+			}
+		default:
+			if len(stack) == 0 {
+				return nil, errors.New(fmt.Sprintf("Content line %d: expected BEGIN:VCALENDAR", i+1))
+			}
+			if current != nil && len(stack) == 2 {
+				current.Properties = append(current.Properties, property)
+			}
+		}
+	}
+	if len(stack) != 0 {
+		return nil, errors.New(fmt.Sprintf("Missing END:%s", stack[len(stack)-1]))
+	}
+	return components, nil
+}
+
+// parseIcalDateTime parses a DATE or DATE-TIME value. Times in UTC are
+// converted to the local time of the server. Like the times of the tasks,
+// times with a TZID are taken as local time of the user.
+func parseIcalDateTime(property icalProperty) (time.Time, bool, error) {
+	value := property.Value
+	if property.Params["VALUE"] == "DATE" || len(value) == len(ICAL_DATE_FORMAT) {
+		date, err := time.Parse(ICAL_DATE_FORMAT, value)
+		return date, false, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		dateTime, err := time.Parse(ICAL_DATE_TIME_FORMAT, strings.TrimSuffix(value, "Z"))
+		return dateTime.Local(), true, err
+	}
+	dateTime, err := time.Parse(ICAL_DATE_TIME_FORMAT, value)
+	return dateTime, true, err
+}
+
+var icalDurationRegex = regexp.MustCompile(
+	`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`,
+)
+
+// parseIcalDuration returns the minutes of a DURATION value
+func parseIcalDuration(value string) (uint, error) {
+	match := icalDurationRegex.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, errors.New(fmt.Sprintf("Invalid duration '%s'", value))
+	}
+	factors := []uint{7 * 24 * 60, 24 * 60, 60, 1, 0}
+	var minutes uint
+	for i, factor := range factors {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(match[i+1], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		minutes += uint(n) * factor
+	}
+	return minutes, nil
+}
+
+func taskStatusOfIcal(component *icalComponent) (string, error) {
+	property, ok := component.property("STATUS")
+	if !ok {
+		if _, completed := component.property("COMPLETED"); completed {
+			return STATUS_DONE, nil
+		}
+		return STATUS_OPEN, nil
+	}
+	switch strings.ToUpper(property.Value) {
+	case "NEEDS-ACTION", "TENTATIVE", "CONFIRMED":
+		return STATUS_OPEN, nil
+	case "IN-PROCESS":
+		return STATUS_IN_PROGRESS, nil
+	case "COMPLETED":
+		return STATUS_DONE, nil
+	case "CANCELLED":
+		return STATUS_CANCELLED, nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown STATUS '%s'", property.Value))
+}
+
+// priorityOfIcal maps the values of PRIORITY like RFC 5545 to the three
+// levels, 0 is undefined
+func priorityOfIcal(value uint) string {
+	switch {
+	case value == 0:
+		return ""
+	case value < 5:
+		return PRIORITY_HIGH
+	case value == 5:
+		return PRIORITY_MEDIUM
+	}
+	return PRIORITY_LOW
+}
+
+// createTaskOfIcal converts a VTODO or VEVENT into a task
+func createTaskOfIcal(component *icalComponent) (CreateTask, error) {
+	task := CreateTask{}
+	summary, ok := component.property("SUMMARY")
+	if !ok || strings.TrimSpace(summary.Value) == "" {
+		return task, errors.New("SUMMARY is missing")
+	}
+	task.Title = unescapeIcalText(summary.Value)
+	if description, ok := component.property("DESCRIPTION"); ok {
+		task.Description = unescapeIcalText(description.Value)
+	}
+	if location, ok := component.property("LOCATION"); ok {
+		task.Location = unescapeIcalText(location.Value)
+	}
+	var start time.Time
+	hasTime := false
+	if dtstart, ok := component.property("DTSTART"); ok {
+		var err error
+		start, hasTime, err = parseIcalDateTime(dtstart)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("Invalid DTSTART '%s'", dtstart.Value))
+		}
+		task.Date = start.Format("2006-01-02")
+		if hasTime {
+			task.Time = start.Format("15:04")
+		}
+	}
+	if duration, ok := component.property("DURATION"); ok {
+		minutes, err := parseIcalDuration(duration.Value)
+		if err != nil {
+			return task, err
+		}
+		task.EstimatedDuration = minutes
+	} else if dtend, ok := component.property("DTEND"); ok && hasTime {
+		end, _, err := parseIcalDateTime(dtend)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("Invalid DTEND '%s'", dtend.Value))
+		}
+		if end.After(start) {
+			task.EstimatedDuration = uint(end.Sub(start).Minutes())
+		}
+	}
+	if due, ok := component.property("DUE"); ok {
+		dueTime, hasDueTime, err := parseIcalDateTime(due)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("Invalid DUE '%s'", due.Value))
+		}
+		task.DueDate = dueTime.Format("2006-01-02")
+		if hasDueTime {
+			task.DueTime = dueTime.Format("15:04")
+		}
+	}
+	if priority, ok := component.property("PRIORITY"); ok {
+		value, err := strconv.ParseUint(priority.Value, 10, 8)
+		if err != nil || value > 9 {
+			return task, errors.New(fmt.Sprintf("Invalid PRIORITY '%s'", priority.Value))
+		}
+		task.Priority = priorityOfIcal(uint(value))
+	}
+	if rrule, ok := component.property("RRULE"); ok {
+		rule, err := ParseRecurrenceRule(rrule.Value)
+		if err != nil {
+			return task, errors.New(fmt.Sprintf("Unsupported RRULE '%s': %v", rrule.Value, err))
+		}
+		task.Recurrence = rule.String()
+	}
+	// tags can't contain whitespace
+	for _, property := range component.Properties {
+		if property.Name == "CATEGORIES" {
+			for _, category := range splitIcalList(property.Value) {
+				if tag := strings.Join(strings.Fields(unescapeIcalText(category)), "_"); tag != "" {
+					task.Tags = append(task.Tags, tag)
+				}
+			}
+		}
+	}
+	status, err := taskStatusOfIcal(component)
+	if err != nil {
+		return task, err
+	}
+	task.Status = status
+	if !ValidateCreateTask(&task) {
+		return task, errors.New("Task is not valid")
+	}
+	return task, nil
+}
+
+// ImportCalendar converts the components of a calendar into tasks. The
+// RELATED-TO properties are mapped to dependencies: DEPENDS-ON makes the
+// related item a previous task, a PARENT depends on its children. One result
+// per component is returned, if one of them has an error, the tasks must not
+// be imported.
+func ImportCalendar(components []icalComponent) ([]ImportTask, []ImportResult, bool) {
+	tasks := make([]ImportTask, len(components))
+	results := make([]ImportResult, len(components))
+	indexOfUid := make(map[string]int)
+	for i := range components {
+		results[i].Index = i
+		if uid, ok := components[i].property("UID"); ok {
+			results[i].Ref = uid.Value
+			if _, duplicate := indexOfUid[uid.Value]; duplicate {
+				results[i].Error = fmt.Sprintf("Duplicate UID '%s'", uid.Value)
+				continue
+			}
+			indexOfUid[uid.Value] = i
+		}
+	}
+	valid := true
+	for i := range components {
+		if results[i].Error != "" {
+			valid = false
+			continue
+		}
+		task, err := createTaskOfIcal(&components[i])
+		if err != nil {
+			results[i].Error = err.Error()
+			valid = false
+			continue
+		}
+		tasks[i].Task = task
+	}
+	for i := range components {
+		for _, property := range components[i].Properties {
+			if property.Name != "RELATED-TO" {
+				continue
+			}
+			related, ok := indexOfUid[property.Value]
+			if !ok {
+				results[i].Error = fmt.Sprintf("RELATED-TO references unknown UID '%s'", property.Value)
+				valid = false
+				break
+			}
+			relType, ok := property.Params["RELTYPE"]
+			if !ok {
+				relType = "PARENT"
+			}
+			switch strings.ToUpper(relType) {
+			case "DEPENDS-ON", "CHILD":
+				tasks[i].addPreviousIndex(related)
+			case "PARENT":
+				tasks[related].addPreviousIndex(i)
+			}
+		}
+	}
+	if valid {
+		valid = checkImportCycle(tasks, results)
+	}
+	return tasks, results, valid
+}
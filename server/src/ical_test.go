@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCalendar(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		components []icalComponent
+		valid      bool
+	}{
+		{
+			name:       "empty calendar",
+			data:       "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nEND:VCALENDAR\r\n",
+			components: []icalComponent{},
+			valid:      true,
+		},
+		{
+			name: "todo and event",
+			data: "BEGIN:VCALENDAR\nBEGIN:VTODO\nSUMMARY:one\nEND:VTODO\n" +
+				"BEGIN:VEVENT\nSUMMARY:two\nDTSTART;TZID=Europe/Berlin:20230501T100000\nEND:VEVENT\nEND:VCALENDAR",
+			components: []icalComponent{
+				{"VTODO", []icalProperty{{"SUMMARY", map[string]string{}, "one"}}},
+				{"VEVENT", []icalProperty{
+					{"SUMMARY", map[string]string{}, "two"},
+					{"DTSTART", map[string]string{"TZID": "Europe/Berlin"}, "20230501T100000"},
+				}},
+			},
+			valid: true,
+		},
+		{
+			name: "folded lines and quoted parameters",
+			data: "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nSUMMARY:a long\r\n  title\r\n" +
+				"LOCATION;ALTREP=\"http://a.b/c;d\":room\r\nEND:VTODO\r\nEND:VCALENDAR\r\n",
+			components: []icalComponent{
+				{"VTODO", []icalProperty{
+					{"SUMMARY", map[string]string{}, "a long title"},
+					{"LOCATION", map[string]string{"ALTREP": "http://a.b/c;d"}, "room"},
+				}},
+			},
+			valid: true,
+		},
+		{
+			name: "nested components are skipped",
+			data: "BEGIN:VCALENDAR\nBEGIN:VTODO\nSUMMARY:one\nBEGIN:VALARM\nACTION:DISPLAY\nEND:VALARM\n" +
+				"END:VTODO\nBEGIN:VTIMEZONE\nTZID:UTC\nEND:VTIMEZONE\nEND:VCALENDAR",
+			components: []icalComponent{
+				{"VTODO", []icalProperty{{"SUMMARY", map[string]string{}, "one"}}},
+			},
+			valid: true,
+		},
+		{"no calendar", "BEGIN:VTODO\nEND:VTODO", nil, false},
+		{"property outside of the calendar", "SUMMARY:one\nBEGIN:VCALENDAR\nEND:VCALENDAR", nil, false},
+		{"missing end", "BEGIN:VCALENDAR\nBEGIN:VTODO\nEND:VCALENDAR", nil, false},
+		{"unterminated component", "BEGIN:VCALENDAR\nBEGIN:VTODO\n", nil, false},
+		{"invalid line", "BEGIN:VCALENDAR\nSUMMARY\nEND:VCALENDAR", nil, false},
+		{"unterminated quote", "BEGIN:VCALENDAR\nX;A=\"b:c\nEND:VCALENDAR", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			components, err := ParseCalendar(test.data)
+			if test.valid != (err == nil) {
+				t.Fatalf("ParseCalendar() returned %v, want valid %v", err, test.valid)
+			}
+			if test.valid && !reflect.DeepEqual(components, test.components) {
+				t.Errorf("ParseCalendar() = %+v, want %+v", components, test.components)
+			}
+		})
+	}
+}
+
+func TestRenderCalendar(t *testing.T) {
+	tasks := []Task{
+		{Id: 1, Title: "event", Date: "2023-05-01", Time: "10:00", EstimatedDuration: 30, NextTaskIds: []uint{2}},
+		{Id: 2, Title: "todo, with comma", DueDate: "2023-05-02", Tags: []string{"work"}},
+		{Id: 3, Title: "invalid due date", Date: "2023-05-01", DueDate: "2023-13-01"},
+		{Id: 4, Title: "invalid time", Date: "2023-05-01", Time: "25:00"},
+		{Id: 5, Title: "without date"},
+	}
+	calendar := RenderCalendar(tasks, time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC))
+	components, err := ParseCalendar(calendar)
+	if err != nil {
+		t.Fatalf("ParseCalendar() of the rendered calendar returned %v:\n%s", err, calendar)
+	}
+	// the tasks with invalid dates are skipped completely
+	if len(components) != 2 || strings.Count(calendar, "BEGIN:") != 3 || strings.Count(calendar, "END:") != 3 {
+		t.Fatalf("RenderCalendar() rendered:\n%s", calendar)
+	}
+	event, todo := components[0], components[1]
+	expected := map[string]string{
+		"SUMMARY":    "event",
+		"DTSTART":    "20230501T100000",
+		"DURATION":   "PT30M",
+		"DTSTAMP":    "20230401T000000Z",
+		"UID":        icalUid(1),
+		"STATUS":     "CONFIRMED",
+		"RELATED-TO": "",
+	}
+	if event.Name != "VEVENT" {
+		t.Errorf("task 1 rendered as %s", event.Name)
+	}
+	for name, value := range expected {
+		property, ok := event.property(name)
+		if value == "" {
+			if ok {
+				t.Errorf("VEVENT has %s", name)
+			}
+		} else if property.Value != value {
+			t.Errorf("%s of VEVENT = %s, want %s", name, property.Value, value)
+		}
+	}
+	expected = map[string]string{
+		"SUMMARY":    "todo\\, with comma",
+		"DUE":        "20230502",
+		"CATEGORIES": "work",
+		"RELATED-TO": icalUid(1),
+	}
+	if todo.Name != "VTODO" {
+		t.Errorf("task 2 rendered as %s", todo.Name)
+	}
+	for name, value := range expected {
+		if property, _ := todo.property(name); property.Value != value {
+			t.Errorf("%s of VTODO = %s, want %s", name, property.Value, value)
+		}
+	}
+}
+
+func TestImportCalendar(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		// the relation between a and b is stated on both items, c depends on
+		// a twice
+		calendar := strings.Join([]string{
+			"BEGIN:VCALENDAR",
+			"BEGIN:VTODO", "UID:a", "SUMMARY:a", "RELATED-TO;RELTYPE=PARENT:b", "END:VTODO",
+			"BEGIN:VTODO", "UID:b", "SUMMARY:b", "RELATED-TO;RELTYPE=CHILD:a", "END:VTODO",
+			"BEGIN:VEVENT", "UID:c", "SUMMARY:c", "DTSTART:20230501T100000",
+			"RELATED-TO;RELTYPE=DEPENDS-ON:a", "RELATED-TO;RELTYPE=DEPENDS-ON:a", "END:VEVENT",
+			"END:VCALENDAR",
+		}, "\r\n")
+		var response importResponse
+		if status := c.upload("/import", ICAL_CONTENT_TYPE, calendar, &response); status != http.StatusCreated {
+			t.Fatalf("import responded with %d %+v", status, response)
+		}
+		ids := make(map[string]uint)
+		for _, item := range response.Items {
+			ids[item.Ref] = item.Id
+		}
+		if next := c.getTask(ids["a"]).NextTaskIds; !reflect.DeepEqual(next, []uint{ids["b"], ids["c"]}) {
+			t.Errorf("nextTaskIds of a are %v", next)
+		}
+		if task := c.getTask(ids["c"]); task.Date != "2023-05-01" || task.Time != "10:00" {
+			t.Errorf("imported event is %+v", task)
+		}
+
+		invalid := []string{
+			"BEGIN:VCALENDAR\nBEGIN:VTODO\nUID:a\nEND:VTODO\nEND:VCALENDAR",
+			"BEGIN:VCALENDAR\nBEGIN:VTODO\nUID:a\nSUMMARY:a\nRELATED-TO:x\nEND:VTODO\nEND:VCALENDAR",
+			"BEGIN:VCALENDAR\nBEGIN:VTODO\nUID:a\nSUMMARY:a\nRELATED-TO;RELTYPE=DEPENDS-ON:a\nEND:VTODO\nEND:VCALENDAR",
+		}
+		for _, calendar := range invalid {
+			var response importResponse
+			if status := c.upload("/import", ICAL_CONTENT_TYPE, calendar, &response); status != http.StatusUnprocessableEntity {
+				t.Errorf("import of %q responded with %d", calendar, status)
+			}
+		}
+		if tasks := c.getTasks(); len(tasks) != 3 {
+			t.Errorf("%d tasks exist after invalid imports", len(tasks))
+		}
+	})
+}
+
+// the feed is only served with an access token with the calendar scope
+func TestCalendarFeed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		c.createTask(map[string]interface{}{"title": "meeting", "date": "2023-05-01", "time": "10:00"})
+		tokens := make(map[string]string)
+		for _, scope := range []string{SCOPE_CALENDAR_READ, SCOPE_TASKS_READ} {
+			var created struct {
+				Token string `json:"token"`
+			}
+			body := map[string]interface{}{"name": scope, "scopes": []string{scope}}
+			if status := c.request("POST", "/tokens", body, &created); status != http.StatusOK {
+				t.Fatalf("create token responded with %d", status)
+			}
+			tokens[scope] = created.Token
+		}
+		feed := func(token string) (int, string) {
+			response, err := http.Get(c.server.URL + config.Server.ApiPath + "/calendar.ics?token=" + url.QueryEscape(token))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			data, _ := io.ReadAll(response.Body)
+			return response.StatusCode, string(data)
+		}
+		status, calendar := feed(tokens[SCOPE_CALENDAR_READ])
+		if status != http.StatusOK || !strings.Contains(calendar, "SUMMARY:meeting") {
+			t.Errorf("feed responded with %d:\n%s", status, calendar)
+		}
+		if status, _ := feed(tokens[SCOPE_TASKS_READ]); status != http.StatusForbidden {
+			t.Errorf("feed with the scope %s responded with %d", SCOPE_TASKS_READ, status)
+		}
+		if status, _ := feed(c.token); status != http.StatusUnauthorized {
+			t.Errorf("feed with a session token responded with %d", status)
+		}
+		status = c.request("GET", "/tasks", nil, nil, "Authorization", "Bearer "+tokens[SCOPE_CALENDAR_READ])
+		if status != http.StatusForbidden {
+			t.Errorf("tasks with the scope %s responded with %d", SCOPE_CALENDAR_READ, status)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"smart-todo-server/graph"
+)
+
+// maximum size of an imported file in bytes
+const IMPORT_MAX_SIZE = 10 << 20
+
+// result of one item of an import. Ref identifies the item in the imported
+// file, e.g. the UID of an iCalendar component.
+type ImportResult struct {
+	Index int    `json:"index"`
+	Ref   string `json:"ref,omitempty"`
+	Id    uint   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// checkImportCycle checks, if the dependencies between the imported tasks
+// contain a cycle. The tasks of a cycle get an error in their result.
+func checkImportCycle(tasks []ImportTask, results []ImportResult) bool {
+	g := graph.New()
+	for i, task := range tasks {
+		g.AddNode(uint(i))
+		for _, index := range task.PreviousIndexes {
+			g.AddEdge(uint(index), uint(i))
+		}
+	}
+	cycle := g.FindCycle()
+	if cycle == nil {
+		return true
+	}
+	for _, node := range cycle {
+		results[node].Error = "Dependencies of the item contain a cycle"
+	}
+	return false
+}
+
+// linkImportTasks sets the previous tasks of the imported tasks, which are
+// referenced by their ids. A task without id is referenced by the Ref of its
+// result instead, unless another task has this id. nextRefs are the
+// references of the next tasks of every task. Duplicate ids and unknown
+// references are marked as error in the results, repeated references are
+// linked once.
+func linkImportTasks(tasks []ImportTask, results []ImportResult, ids []string, nextRefs [][]string) bool {
+	valid := true
+	indexOfRef := make(map[string]int)
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, duplicate := indexOfRef[id]; duplicate {
+			results[i].Error = fmt.Sprintf("Duplicate id '%s'", id)
+			valid = false
+			continue
+		}
+		indexOfRef[id] = i
+	}
+	for i, id := range ids {
+		if _, taken := indexOfRef[results[i].Ref]; id == "" && !taken {
+			indexOfRef[results[i].Ref] = i
+		}
+	}
+	for i, refs := range nextRefs {
+		for _, ref := range refs {
+			next, ok := indexOfRef[ref]
+			if !ok {
+				results[i].Error = fmt.Sprintf("Next task '%s' not found", ref)
+				valid = false
+				break
+			}
+			tasks[next].addPreviousIndex(i)
+		}
+	}
+	return valid
+}
+
+func writeImportResults(w http.ResponseWriter, results []ImportResult, status int, error string) {
+	w.WriteHeader(status)
+	response := map[string]any{"items": results}
+	if error != "" {
+		response["error"] = error
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleImportPost imports the tasks of a file, whose format is selected by
+// the Content-Type. Either all items are imported or none of them. The
+// profile of an archive is only restored with the query parameter
+// profile=true.
+func handleImportPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, "Invalid Content-Type", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, IMPORT_MAX_SIZE))
+	if err != nil {
+		writeError(w, "Can't read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var tasks []ImportTask
+	var results []ImportResult
+	var valid bool
+	var profile *User
+	var tags []Tag
+	switch mediaType {
+	case JSON_CONTENT_TYPE:
+		var archive Archive
+		if err := json.Unmarshal(body, &archive); err != nil {
+			writeError(w, "Can't parse json body", http.StatusBadRequest)
+			return
+		}
+		tasks, results, valid, err = ImportArchive(archive)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("profile") == "true" {
+			if r.Header.Get("sessionId") == "" {
+				writeError(w, "profile can only be restored with the token of a session", http.StatusForbidden)
+				return
+			}
+			profile = &User{Fullname: archive.Profile.Fullname, Email: archive.Profile.Email}
+		}
+		tags = ArchiveTagsToRestore(archive.Tags)
+	case ICAL_CONTENT_TYPE:
+		components, err := ParseCalendar(string(body))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tasks, results, valid = ImportCalendar(components)
+	case CSV_CONTENT_TYPE:
+		columns, err := ParseCsvColumns(r.URL.Query().Get("columns"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		delimiter, err := ParseCsvDelimiter(r.URL.Query().Get("delimiter"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tasks, results, valid, err = ImportCsv(bytes.NewReader(body), columns, delimiter)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case TODO_TXT_CONTENT_TYPE:
+		tasks, results, valid = ImportTodoTxt(string(body))
+	default:
+		writeError(
+			w,
+			fmt.Sprintf(
+				"Content-Type must be one of '%s', '%s', '%s' or '%s'",
+				JSON_CONTENT_TYPE, ICAL_CONTENT_TYPE, CSV_CONTENT_TYPE, TODO_TXT_CONTENT_TYPE,
+			),
+			http.StatusUnsupportedMediaType,
+		)
+		return
+	}
+	if !valid {
+		writeImportResults(w, results, http.StatusUnprocessableEntity, "Import contains invalid items, nothing was imported")
+		return
+	}
+
+	ids, err := store.ImportTasks(tasks, tags, profile, user)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		results[batchErr.Index].Error = batchErr.Err.Error()
+		writeImportResults(w, results, http.StatusUnprocessableEntity, "Import contains invalid items, nothing was imported")
+		return
+	} else if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, id := range ids {
+		results[i].Id = id
+	}
+	writeImportResults(w, results, http.StatusCreated, "")
+}
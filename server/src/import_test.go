@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestImportRepeatedNextTasks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		uploads := []struct {
+			contentType string
+			data        string
+		}{
+			{TODO_TXT_CONTENT_TYPE, "a id:1 next:2,2\nb id:2\n"},
+			{CSV_CONTENT_TYPE, "id,title,nextTaskIds\n1,a,2 2\n2,b,\n"},
+			{CSV_CONTENT_TYPE, "id,title,nextTaskIds\n,a,2\n,b,\n"},
+		}
+		for _, upload := range uploads {
+			var response importResponse
+			if status := c.upload("/import", upload.contentType, upload.data, &response); status != http.StatusCreated {
+				t.Errorf("import of %q responded with %d %+v", upload.data, status, response)
+				continue
+			}
+			first, second := response.Items[0].Id, response.Items[1].Id
+			if next := c.getTask(first).NextTaskIds; !reflect.DeepEqual(next, []uint{second}) {
+				t.Errorf("import of %q: nextTaskIds are %v", upload.data, next)
+			}
+		}
+	})
+}
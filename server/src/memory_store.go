@@ -0,0 +1,1245 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-todo-server/graph"
+)
+
+// MemoryStore keeps everything in memory, so all data is lost on a restart.
+// It's meant for tests and for trying out the server.
+type MemoryStore struct {
+	mutex             sync.Mutex
+	users             map[string]User
+	tasks             *memoryTasks
+	sessions          map[uint]*memorySession
+	lastSessionId     uint
+	accessTokens      map[uint]*memoryAccessToken
+	lastAccessTokenId uint
+	changes           []memoryChange
+	lastChangeId      uint64
+	// the greatest id of the deleted changes
+	changesPrunedUntil uint64
+	webhooks           map[uint]*Webhook
+	lastWebhookId      uint
+	deliveries         []*WebhookDelivery
+	lastDeliveryId     uint64
+}
+
+type memoryTask struct {
+	Task
+	user        string
+	startedAt   sql.NullTime
+	completedAt sql.NullTime
+	tagIds      []uint
+}
+
+type memoryTag struct {
+	Tag
+	user string
+}
+
+// the tasks and tags, which are changed together in transactions
+type memoryTasks struct {
+	tasks     map[uint]*memoryTask
+	lastId    uint
+	tags      map[uint]*memoryTag
+	lastTagId uint
+	// events of the transaction
+	pending pendingEvents
+}
+
+type memoryChange struct {
+	Event
+	user      string
+	createdAt time.Time
+}
+
+type memorySession struct {
+	Session
+	tokenHash []byte
+}
+
+type memoryAccessToken struct {
+	AccessToken
+	tokenHash []byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users: make(map[string]User),
+		tasks: &memoryTasks{
+			tasks: make(map[uint]*memoryTask),
+			tags:  make(map[uint]*memoryTag),
+		},
+		sessions:     make(map[uint]*memorySession),
+		accessTokens: make(map[uint]*memoryAccessToken),
+		webhooks:     make(map[uint]*Webhook),
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// inTransaction runs fn on a copy of the tasks, which replaces the tasks, if
+// fn returns no error. Like in Db.inTransaction the events of the transaction
+// are written to the change log, the versions of the changed tasks are
+// incremented, the deliveries to the webhooks are queued and the events are
+// published then.
+func (m *MemoryStore) inTransaction(fn func(tasks *memoryTasks) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tasks := m.tasks.clone()
+	err := fn(tasks)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, event := range tasks.pending.events {
+		m.lastChangeId++
+		event.Id = m.lastChangeId
+		m.changes = append(m.changes, memoryChange{event, tasks.pending.user, now})
+	}
+	for _, id := range tasks.pending.changedTaskIds() {
+		if task, ok := tasks.tasks[id]; ok {
+			task.Version++
+		}
+	}
+	queued, err := m.insertDeliveries(tasks)
+	if err != nil {
+		return err
+	}
+	m.tasks = tasks
+	tasks.pending.publish()
+	if queued > 0 {
+		notifyWebhookWorker()
+	}
+	return nil
+}
+
+func (t *memoryTasks) clone() *memoryTasks {
+	clone := &memoryTasks{
+		tasks:     make(map[uint]*memoryTask),
+		lastId:    t.lastId,
+		tags:      make(map[uint]*memoryTag),
+		lastTagId: t.lastTagId,
+	}
+	for id, task := range t.tasks {
+		taskClone := *task
+		taskClone.NextTaskIds = append([]uint{}, task.NextTaskIds...)
+		taskClone.tagIds = append([]uint{}, task.tagIds...)
+		clone.tasks[id] = &taskClone
+	}
+	for id, tag := range t.tags {
+		tagClone := *tag
+		clone.tags[id] = &tagClone
+	}
+	return clone
+}
+
+// toTask returns a copy of the task, which can be passed to the handlers
+func (t *memoryTasks) toTask(task *memoryTask) Task {
+	result := task.Task
+	result.Tags = make([]string, 0, len(task.tagIds))
+	for _, tagId := range task.tagIds {
+		result.Tags = append(result.Tags, t.tags[tagId].Name)
+	}
+	sort.Strings(result.Tags)
+	result.DueConflicts = make([]uint, 0)
+	result.NextTaskIds = append(make([]uint, 0), task.NextTaskIds...)
+	sort.Slice(result.NextTaskIds, func(i, j int) bool {
+		return result.NextTaskIds[i] < result.NextTaskIds[j]
+	})
+	result.StartedAt = ""
+	if task.startedAt.Valid {
+		result.StartedAt = task.startedAt.Time.Format(time.RFC3339)
+	}
+	result.CompletedAt = ""
+	if task.completedAt.Valid {
+		result.CompletedAt = task.completedAt.Time.Format(time.RFC3339)
+	}
+	return result
+}
+
+func (m *MemoryStore) SelectAllTasks(user string, filter TaskFilter) ([]Task, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the tasks with previous tasks, for the filter hasDependencies
+	hasPrevious := make(map[uint]bool)
+	for _, task := range m.tasks.tasks {
+		if task.user == user {
+			for _, nt := range task.NextTaskIds {
+				hasPrevious[nt] = true
+			}
+		}
+	}
+	var ids map[uint]bool
+	if filter.Ids != nil {
+		ids = make(map[uint]bool)
+		for _, id := range filter.Ids {
+			ids[id] = true
+		}
+	}
+	tasks := make([]Task, 0)
+	for _, task := range m.tasks.tasks {
+		if task.user != user {
+			continue
+		}
+		if ids != nil && !ids[task.Id] {
+			continue
+		}
+		if len(filter.Status) > 0 {
+			found := false
+			for _, status := range filter.Status {
+				found = found || task.Status == status
+			}
+			if !found {
+				continue
+			}
+		}
+		if filter.DateFrom != "" && (task.Date == "" || task.Date < filter.DateFrom) {
+			continue
+		}
+		if filter.DateTo != "" && (task.Date == "" || task.Date > filter.DateTo) {
+			continue
+		}
+		if filter.Query != "" {
+			query := strings.ToLower(filter.Query)
+			if !strings.Contains(strings.ToLower(task.Title), query) &&
+				!strings.Contains(strings.ToLower(task.Description), query) &&
+				!strings.Contains(strings.ToLower(task.Location), query) {
+				continue
+			}
+		}
+		if filter.HasDependencies != nil && hasPrevious[task.Id] != *filter.HasDependencies {
+			continue
+		}
+		if filter.HasDependents != nil && (len(task.NextTaskIds) > 0) != *filter.HasDependents {
+			continue
+		}
+		t := m.tasks.toTask(task)
+		if filter.Tags != nil && !filter.Tags.Matches(t.Tags) {
+			continue
+		}
+		if filter.After != nil {
+			comparison := compareTaskToCursor(&t, filter.Sort, *filter.After)
+			if (!filter.Descending && comparison <= 0) || (filter.Descending && comparison >= 0) {
+				continue
+			}
+		}
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		comparison := compareTaskToCursor(
+			&tasks[i],
+			filter.Sort,
+			TaskCursor{tasks[j].Id, taskSortValue(&tasks[j], filter.Sort)},
+		)
+		if filter.Descending {
+			return comparison > 0
+		}
+		return comparison < 0
+	})
+	if filter.Limit > 0 && uint(len(tasks)) > filter.Limit {
+		tasks = tasks[:filter.Limit]
+	}
+	return tasks, nil
+}
+
+func (m *MemoryStore) SearchTasks(user string, query string, limit uint) ([]SearchResult, error) {
+	tasks, err := m.SelectAllTasks(user, TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+	return SearchTasks(tasks, query, limit), nil
+}
+
+func (m *MemoryStore) SelectOneSpecialTasks(id uint, user string) (Task, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	task, ok := m.tasks.tasks[id]
+	if !ok || task.user != user {
+		return Task{}, &TaskNotFoundError{id, "Can't find task with id %d"}
+	}
+	return m.tasks.toTask(task), nil
+}
+
+func (m *MemoryStore) SelectPreviousTasks(ids []uint, user string) ([]Task, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previousOf := make(map[uint][]uint)
+	for _, task := range m.tasks.tasks {
+		if task.user != user {
+			continue
+		}
+		for _, nt := range task.NextTaskIds {
+			previousOf[nt] = append(previousOf[nt], task.Id)
+		}
+	}
+	visited := make(map[uint]bool)
+	queue := append([]uint{}, ids...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, pt := range previousOf[id] {
+			if !visited[pt] {
+				visited[pt] = true
+				queue = append(queue, pt)
+			}
+		}
+	}
+	tasks := make([]Task, 0, len(visited))
+	for id := range visited {
+		task := m.tasks.toTask(m.tasks.tasks[id])
+		task.Tags = nil
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+	return tasks, nil
+}
+
+func (m *MemoryStore) InsertTask(task CreateTask, user string) (uint, error) {
+	var id uint
+	err := m.inTransaction(func(tasks *memoryTasks) error {
+		var err error
+		id, err = tasks.insertTask(task, user)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) UpdateTask(
+	id uint,
+	patchTask CreateTask,
+	patchKeys []string,
+	version uint64,
+	user string,
+) error {
+	return m.inTransaction(func(tasks *memoryTasks) error {
+		if err := tasks.checkVersion(id, version, user); err != nil {
+			return err
+		}
+		return tasks.updateTask(id, patchTask, patchKeys, user)
+	})
+}
+
+func (m *MemoryStore) LinkTasks(id uint, nextTaskId uint, user string) error {
+	return m.inTransaction(func(tasks *memoryTasks) error {
+		return tasks.linkTasks(id, nextTaskId, user)
+	})
+}
+
+func (m *MemoryStore) UnlinkTasks(id uint, nextTaskId uint, user string) error {
+	return m.inTransaction(func(tasks *memoryTasks) error {
+		return tasks.unlinkTasks(id, nextTaskId, user)
+	})
+}
+
+func (t *memoryTasks) linkTasks(id uint, nextTaskId uint, user string) error {
+	err := t.checkTasksExist(user, []uint{id, nextTaskId})
+	if err != nil {
+		return err
+	}
+	for _, nt := range t.tasks[id].NextTaskIds {
+		if nt == nextTaskId {
+			return nil
+		}
+	}
+	err = t.checkCycle(user, id, []uint{nextTaskId}, nil, false, false)
+	if err != nil {
+		return err
+	}
+	t.addNextTaskId(id, nextTaskId)
+	t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, id)
+	return nil
+}
+
+func (t *memoryTasks) unlinkTasks(id uint, nextTaskId uint, user string) error {
+	err := t.checkTasksExist(user, []uint{id, nextTaskId})
+	if err != nil {
+		return err
+	}
+	task := t.tasks[id]
+	for i, nt := range task.NextTaskIds {
+		if nt == nextTaskId {
+			task.NextTaskIds = append(task.NextTaskIds[:i], task.NextTaskIds[i+1:]...)
+			t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, id)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteTask(id uint, version uint64, user string) error {
+	return m.inTransaction(func(tasks *memoryTasks) error {
+		if err := tasks.checkVersion(id, version, user); err != nil {
+			return err
+		}
+		return tasks.deleteTask(id, user)
+	})
+}
+
+func (m *MemoryStore) ApplyBatch(operations []BatchOperation, user string) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(operations))
+	err := m.inTransaction(func(tasks *memoryTasks) error {
+		created := make(map[string]uint)
+		for i, op := range operations {
+			if err := op.resolve(created); err != nil {
+				return &BatchError{i, err}
+			}
+			var err error
+			id := op.Id
+			switch op.Action {
+			case BATCH_ACTION_CREATE:
+				id, err = tasks.insertTask(op.Task, user)
+			case BATCH_ACTION_UPDATE:
+				err = tasks.checkVersion(op.Id, op.Version, user)
+				if err == nil {
+					err = tasks.updateTask(op.Id, op.Task, op.PatchKeys, user)
+				}
+			case BATCH_ACTION_DELETE:
+				err = tasks.checkVersion(op.Id, op.Version, user)
+				if err == nil {
+					err = tasks.deleteTask(op.Id, user)
+				}
+			case BATCH_ACTION_LINK:
+				err = tasks.linkTasks(op.Id, op.NextTaskId, user)
+			case BATCH_ACTION_UNLINK:
+				err = tasks.unlinkTasks(op.Id, op.NextTaskId, user)
+			default:
+				err = errors.New(fmt.Sprintf("Unknown action %s", op.Action))
+			}
+			if err != nil {
+				return &BatchError{i, err}
+			}
+			if op.TempId != "" {
+				created[op.TempId] = id
+			}
+			results = append(results, BatchResult{op.Action, id, op.TempId})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ImportTasks works like Db.ImportTasks
+func (m *MemoryStore) ImportTasks(tasks []ImportTask, tags []Tag, profile *User, user string) ([]uint, error) {
+	ids := make([]uint, len(tasks))
+	err := m.inTransaction(func(t *memoryTasks) error {
+		for _, tag := range tags {
+			existing := t.tagByName(user, tag.Name)
+			if existing == nil {
+				t.lastTagId++
+				t.tags[t.lastTagId] = &memoryTag{Tag{Id: t.lastTagId, Name: tag.Name, Color: tag.Color}, user}
+			} else if existing.Color == "" {
+				existing.Color = tag.Color
+			}
+		}
+		for i, task := range tasks {
+			id, err := t.insertTask(task.Task, user)
+			if err != nil {
+				return &BatchError{i, err}
+			}
+			ids[i] = id
+			if task.StartedAt.Valid {
+				t.tasks[id].startedAt = task.StartedAt
+			}
+			if task.CompletedAt.Valid {
+				t.tasks[id].completedAt = task.CompletedAt
+			}
+		}
+		for i, task := range tasks {
+			for _, index := range task.PreviousIndexes {
+				t.addNextTaskId(ids[index], ids[i])
+				t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, ids[index])
+			}
+		}
+		if cycle := t.graph(user).FindCycle(); cycle != nil {
+			return &graph.CycleError{Path: cycle}
+		}
+		// the users aren't copied by the transaction, so the profile is
+		// changed after everything else succeeded
+		if profile != nil {
+			if userData, ok := m.users[user]; ok {
+				userData.Fullname = profile.Fullname
+				userData.Email = profile.Email
+				m.users[user] = userData
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (t *memoryTasks) graph(user string) *graph.Graph {
+	g := graph.New()
+	for id, task := range t.tasks {
+		if task.user != user {
+			continue
+		}
+		for _, nt := range task.NextTaskIds {
+			g.AddEdge(id, nt)
+		}
+	}
+	return g
+}
+
+// checkVersion works like Db.checkVersion
+func (t *memoryTasks) checkVersion(id uint, version uint64, user string) error {
+	task, ok := t.tasks[id]
+	if version == 0 || !ok || task.user != user {
+		return nil
+	}
+	if task.Version != version {
+		return &VersionError{id, task.Version}
+	}
+	return nil
+}
+
+// checkTasksExist returns an error, if one of the ids isn't a task of the
+// user
+func (t *memoryTasks) checkTasksExist(user string, ids []uint) error {
+	for _, id := range ids {
+		if task, ok := t.tasks[id]; !ok || task.user != user {
+			return &TaskNotFoundError{id, "Referenced task %d not exists"}
+		}
+	}
+	return nil
+}
+
+// checkCycle works like Db.checkCycle
+func (t *memoryTasks) checkCycle(
+	user string,
+	id uint,
+	nextTaskIds []uint,
+	previousTaskIds []uint,
+	replaceNext bool,
+	replacePrevious bool,
+) error {
+	g := t.graph(user)
+	g.AddNode(id)
+	if replaceNext {
+		g.RemoveEdgesFrom(id)
+	}
+	if replacePrevious {
+		g.RemoveEdgesTo(id)
+	}
+	for _, nt := range nextTaskIds {
+		g.AddEdge(id, nt)
+	}
+	for _, pt := range previousTaskIds {
+		g.AddEdge(pt, id)
+	}
+	if cycle := g.FindCycle(); cycle != nil {
+		return &graph.CycleError{Path: cycle}
+	}
+	return nil
+}
+
+func (t *memoryTasks) addNextTaskId(id uint, nextTaskId uint) {
+	task := t.tasks[id]
+	for _, nt := range task.NextTaskIds {
+		if nt == nextTaskId {
+			return
+		}
+	}
+	task.NextTaskIds = append(task.NextTaskIds, nextTaskId)
+}
+
+func (t *memoryTasks) tagByName(user string, name string) *memoryTag {
+	for _, tag := range t.tags {
+		if tag.user == user && tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// setTaskTags replaces the tags of a task, missing tags are created
+func (t *memoryTasks) setTaskTags(task *memoryTask, user string, tags []string) {
+	task.tagIds = make([]uint, 0, len(tags))
+	for _, name := range normalizeTags(tags) {
+		tag := t.tagByName(user, name)
+		if tag == nil {
+			t.lastTagId++
+			tag = &memoryTag{Tag{Id: t.lastTagId, Name: name}, user}
+			t.tags[tag.Id] = tag
+		}
+		task.tagIds = append(task.tagIds, tag.Id)
+	}
+}
+
+func (m *MemoryStore) SelectChanges(user string, since uint64) ([]Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if since < m.changesPrunedUntil {
+		return nil, &ExpiredCursorError{since}
+	}
+	changes := make([]Event, 0)
+	for _, change := range m.changes {
+		if change.user == user && change.Id > since {
+			changes = append(changes, change.Event)
+		}
+	}
+	return changes, nil
+}
+
+func (m *MemoryStore) LastChange(user string) (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	last := m.changesPrunedUntil
+	for _, change := range m.changes {
+		if change.user == user {
+			last = change.Id
+		}
+	}
+	return last, nil
+}
+
+func (m *MemoryStore) DeleteChanges(createdBefore time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the changes are ordered by their ids and times
+	deleted := 0
+	for deleted < len(m.changes) && m.changes[deleted].createdAt.Before(createdBefore) {
+		m.changesPrunedUntil = m.changes[deleted].Id
+		deleted++
+	}
+	m.changes = append([]memoryChange{}, m.changes[deleted:]...)
+	return nil
+}
+
+func (m *MemoryStore) SelectTags(user string) ([]Tag, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tags := make([]Tag, 0)
+	for _, tag := range m.tasks.tags {
+		if tag.user == user {
+			tags = append(tags, tag.Tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (m *MemoryStore) InsertTag(tag Tag, user string) (uint, error) {
+	var id uint
+	err := m.inTransaction(func(t *memoryTasks) error {
+		if t.tagByName(user, tag.Name) != nil {
+			return errors.New(fmt.Sprintf("Tag %s already exists", tag.Name))
+		}
+		t.lastTagId++
+		id = t.lastTagId
+		t.tags[id] = &memoryTag{Tag{Id: id, Name: tag.Name, Color: tag.Color}, user}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) UpdateTag(id uint, patchTag Tag, patchKeys []string, user string) error {
+	return m.inTransaction(func(t *memoryTasks) error {
+		tag, ok := t.tags[id]
+		if !ok || tag.user != user {
+			return errors.New(fmt.Sprintf("Tag %d not found", id))
+		}
+		for _, key := range patchKeys {
+			switch key {
+			case "name":
+				if other := t.tagByName(user, patchTag.Name); other != nil && other.Id != id {
+					return errors.New(fmt.Sprintf("Tag %s already exists", patchTag.Name))
+				}
+				tag.Name = patchTag.Name
+				t.emitTagged(user, id)
+			case "color":
+				tag.Color = patchTag.Color
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MemoryStore) DeleteTag(id uint, user string) error {
+	return m.inTransaction(func(t *memoryTasks) error {
+		tag, ok := t.tags[id]
+		if !ok || tag.user != user {
+			return errors.New(fmt.Sprintf("Tag %d not found", id))
+		}
+		t.emitTagged(user, id)
+		delete(t.tags, id)
+		for _, task := range t.tasks {
+			filtered := make([]uint, 0, len(task.tagIds))
+			for _, tagId := range task.tagIds {
+				if tagId != id {
+					filtered = append(filtered, tagId)
+				}
+			}
+			task.tagIds = filtered
+		}
+		return nil
+	})
+}
+
+// emitTagged adds an update event for all tasks with the tag, whose name
+// changes
+func (t *memoryTasks) emitTagged(user string, tagId uint) {
+	taskIds := make([]uint, 0)
+	for id, task := range t.tasks {
+		for _, tid := range task.tagIds {
+			if tid == tagId {
+				taskIds = append(taskIds, id)
+			}
+		}
+	}
+	sort.Slice(taskIds, func(i, j int) bool { return taskIds[i] < taskIds[j] })
+	t.pending.add(user, EVENT_TASK_UPDATED, taskIds...)
+}
+
+func (t *memoryTasks) insertTask(task CreateTask, user string) (uint, error) {
+	if !ValidateCreateTask(&task) {
+		return 0, errors.New("CreateTask not valid")
+	}
+	referencedIds := append(append([]uint{}, task.NextTaskIds...), task.PreviousTaskIds...)
+	if err := t.checkTasksExist(user, referencedIds); err != nil {
+		return 0, err
+	}
+	if len(task.NextTaskIds) > 0 && len(task.PreviousTaskIds) > 0 {
+		err := t.checkCycle(user, NEW_TASK_ID, task.NextTaskIds, task.PreviousTaskIds, true, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if task.Status == "" {
+		task.Status = STATUS_OPEN
+	}
+	t.lastId++
+	newTask := &memoryTask{
+		Task: Task{
+			Id:                 t.lastId,
+			Title:              task.Title,
+			Description:        task.Description,
+			Location:           task.Location,
+			Date:               task.Date,
+			Time:               task.Time,
+			NextTaskIds:        make([]uint, 0),
+			Status:             task.Status,
+			Version:            1,
+			EstimatedDuration:  task.EstimatedDuration,
+			DueDate:            task.DueDate,
+			DueTime:            task.DueTime,
+			Priority:           task.Priority,
+			Recurrence:         task.Recurrence,
+			RecurrenceCopyNext: task.RecurrenceCopyNext,
+		},
+		user: user,
+	}
+	newTask.startedAt, newTask.completedAt = StatusTimestamps(
+		STATUS_OPEN, sql.NullTime{}, sql.NullTime{}, task.Status, time.Now(),
+	)
+	t.tasks[newTask.Id] = newTask
+	t.setTaskTags(newTask, user, task.Tags)
+	t.pending.add(user, EVENT_TASK_CREATED, newTask.Id)
+	for _, pt := range task.PreviousTaskIds {
+		t.addNextTaskId(pt, newTask.Id)
+	}
+	t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, task.PreviousTaskIds...)
+	for _, nt := range task.NextTaskIds {
+		t.addNextTaskId(newTask.Id, nt)
+	}
+	return newTask.Id, nil
+}
+
+func (t *memoryTasks) updateTask(id uint, patchTask CreateTask, patchKeys []string, user string) error {
+	task, ok := t.tasks[id]
+	if !ok || task.user != user {
+		return &TaskNotFoundError{id, "Task %d not found to update"}
+	}
+	nextTaskIdsIdx := false
+	previousTaskIdsIdx := false
+	updated := false
+	completed := false
+	for _, key := range patchKeys {
+		if key == "nextTaskIds" {
+			nextTaskIdsIdx = true
+		} else if key == "previousTaskIds" {
+			previousTaskIdsIdx = true
+		} else {
+			updated = true
+		}
+		if key == "status" {
+			completed = patchTask.Status == STATUS_DONE && task.Status != STATUS_DONE
+		}
+	}
+	previousTaskIds := t.graph(user).Previous(id)
+	if nextTaskIdsIdx || previousTaskIdsIdx {
+		referencedIds := append(append([]uint{}, patchTask.NextTaskIds...), patchTask.PreviousTaskIds...)
+		if err := t.checkTasksExist(user, referencedIds); err != nil {
+			return err
+		}
+		err := t.checkCycle(
+			user,
+			id,
+			patchTask.NextTaskIds,
+			patchTask.PreviousTaskIds,
+			nextTaskIdsIdx,
+			previousTaskIdsIdx,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range patchKeys {
+		switch key {
+		case "title":
+			task.Title = patchTask.Title
+		case "description":
+			task.Description = patchTask.Description
+		case "location":
+			task.Location = patchTask.Location
+		case "date":
+			task.Date = patchTask.Date
+		case "time":
+			task.Time = patchTask.Time
+		case "estimatedDuration":
+			task.EstimatedDuration = patchTask.EstimatedDuration
+		case "dueDate":
+			task.DueDate = patchTask.DueDate
+		case "dueTime":
+			task.DueTime = patchTask.DueTime
+		case "priority":
+			task.Priority = patchTask.Priority
+		case "recurrence":
+			task.Recurrence = patchTask.Recurrence
+		case "recurrenceCopyNext":
+			task.RecurrenceCopyNext = patchTask.RecurrenceCopyNext
+		case "tags":
+			t.setTaskTags(task, user, patchTask.Tags)
+		case "status":
+			status := patchTask.Status
+			if status == "" {
+				status = STATUS_OPEN
+			}
+			task.startedAt, task.completedAt = StatusTimestamps(
+				task.Status, task.startedAt, task.completedAt, status, time.Now(),
+			)
+			task.Status = status
+		case "nextTaskIds":
+			task.NextTaskIds = make([]uint, 0)
+			for _, nt := range patchTask.NextTaskIds {
+				t.addNextTaskId(id, nt)
+			}
+		case "previousTaskIds":
+			for _, other := range t.tasks {
+				filtered := make([]uint, 0, len(other.NextTaskIds))
+				for _, nt := range other.NextTaskIds {
+					if nt != id {
+						filtered = append(filtered, nt)
+					}
+				}
+				other.NextTaskIds = filtered
+			}
+			for _, pt := range patchTask.PreviousTaskIds {
+				t.addNextTaskId(pt, id)
+			}
+		default:
+			return errors.New(fmt.Sprintf("Canot get value for key %s", key))
+		}
+	}
+	if updated {
+		t.pending.add(user, EVENT_TASK_UPDATED, id)
+	}
+	if nextTaskIdsIdx {
+		t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, id)
+	}
+	if previousTaskIdsIdx {
+		t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, previousTaskIds...)
+		t.pending.add(user, EVENT_DEPENDENCIES_CHANGED, patchTask.PreviousTaskIds...)
+	}
+	if completed {
+		t.pending.add(user, EVENT_TASK_COMPLETED, id)
+		return t.insertNextOccurrence(task, user)
+	}
+	return nil
+}
+
+// insertNextOccurrence creates the next occurrence of a recurring task, which
+// is done. The rule moves to the next occurrence, so the done task doesn't
+// recur anymore.
+func (t *memoryTasks) insertNextOccurrence(task *memoryTask, user string) error {
+	current := t.toTask(task)
+	next, ok := NextOccurrence(&current, time.Now())
+	if !ok {
+		return nil
+	}
+	if _, err := t.insertTask(next, user); err != nil {
+		return err
+	}
+	task.Recurrence = ""
+	task.RecurrenceCopyNext = false
+	return nil
+}
+
+func (t *memoryTasks) deleteTask(id uint, user string) error {
+	task, ok := t.tasks[id]
+	if !ok || task.user != user {
+		return &TaskNotFoundError{id, "Task %d not found"}
+	}
+	for _, other := range t.tasks {
+		for _, nt := range other.NextTaskIds {
+			if nt == id {
+				return errors.New(
+					fmt.Sprintf(
+						"Task %d is a follower for another task and must not be delete",
+						id,
+					),
+				)
+			}
+		}
+	}
+	delete(t.tasks, id)
+	t.pending.add(user, EVENT_TASK_DELETED, id)
+	return nil
+}
+
+func (m *MemoryStore) InsertUser(user User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.users[user.Username]; ok {
+		return errors.New(fmt.Sprintf("User with username %v already exists", user.Username))
+	}
+	m.users[user.Username] = user
+	return nil
+}
+
+func (m *MemoryStore) UpdateUserProfile(username string, fullname string, email string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[username]
+	if !ok {
+		return errors.New(fmt.Sprintf("User with username %v not found", username))
+	}
+	user.Fullname = fullname
+	user.Email = email
+	m.users[username] = user
+	return nil
+}
+
+func (m *MemoryStore) GetUser(username string) (User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[username]
+	if !ok {
+		return User{}, errors.New(fmt.Sprintf("User with username %v not found", username))
+	}
+	return user, nil
+}
+
+func (m *MemoryStore) InsertSession(tokenHash []byte, user string, userAgent string, ip string) (uint, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.lastSessionId++
+	m.sessions[m.lastSessionId] = &memorySession{
+		Session: Session{
+			Id:         m.lastSessionId,
+			User:       user,
+			CreatedAt:  now,
+			LastSeenAt: now,
+			UserAgent:  userAgent,
+			Ip:         ip,
+		},
+		tokenHash: tokenHash,
+	}
+	return m.lastSessionId, nil
+}
+
+func (m *MemoryStore) UpsertSession(tokenHash []byte, user string) error {
+	m.mutex.Lock()
+	for _, session := range m.sessions {
+		if bytes.Equal(session.tokenHash, tokenHash) {
+			session.User = user
+			session.CreatedAt = time.Now()
+			m.mutex.Unlock()
+			return nil
+		}
+	}
+	m.mutex.Unlock()
+	_, err := m.InsertSession(tokenHash, user, "", "")
+	return err
+}
+
+func (m *MemoryStore) SelectSessionByToken(tokenHash []byte) (Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, session := range m.sessions {
+		if bytes.Equal(session.tokenHash, tokenHash) {
+			return session.Session, nil
+		}
+	}
+	return Session{}, errors.New("Session not found")
+}
+
+func (m *MemoryStore) SelectSessions(user string) ([]Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sessions := make([]Session, 0)
+	for _, session := range m.sessions {
+		if session.User == user {
+			sessions = append(sessions, session.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions, nil
+}
+
+func (m *MemoryStore) TouchSession(id uint, lastSeen time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if session, ok := m.sessions[id]; ok {
+		session.LastSeenAt = lastSeen
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteSession(id uint, user string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, ok := m.sessions[id]
+	if !ok || session.User != user {
+		return errors.New(fmt.Sprintf("Session %d not found", id))
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredSessions(createdBefore time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, session := range m.sessions {
+		if session.CreatedAt.Before(createdBefore) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertAccessToken(tokenHash []byte, token AccessToken) (uint, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastAccessTokenId++
+	token.Id = m.lastAccessTokenId
+	m.accessTokens[token.Id] = &memoryAccessToken{token, tokenHash}
+	return token.Id, nil
+}
+
+func (m *MemoryStore) SelectAccessTokenByToken(tokenHash []byte) (AccessToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, token := range m.accessTokens {
+		if bytes.Equal(token.tokenHash, tokenHash) {
+			return token.AccessToken, nil
+		}
+	}
+	return AccessToken{}, errors.New("Access token not found")
+}
+
+func (m *MemoryStore) SelectAccessTokens(user string) ([]AccessToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tokens := make([]AccessToken, 0)
+	for _, token := range m.accessTokens {
+		if token.User == user {
+			tokens = append(tokens, token.AccessToken)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Id < tokens[j].Id })
+	return tokens, nil
+}
+
+func (m *MemoryStore) TouchAccessToken(id uint, lastUsed time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if token, ok := m.accessTokens[id]; ok {
+		token.LastUsedAt = &lastUsed
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteAccessToken(id uint, user string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	token, ok := m.accessTokens[id]
+	if !ok || token.User != user {
+		return errors.New(fmt.Sprintf("Access token %d not found", id))
+	}
+	delete(m.accessTokens, id)
+	return nil
+}
+
+// insertDeliveries queues the deliveries of the pending events to the webhooks
+// of the user, m must be locked
+func (m *MemoryStore) insertDeliveries(tasks *memoryTasks) (int, error) {
+	webhooks := make([]Webhook, 0)
+	for _, webhook := range m.webhooks {
+		if webhook.User == tasks.pending.user {
+			webhooks = append(webhooks, *webhook)
+		}
+	}
+	if len(webhooks) == 0 || len(tasks.pending.events) == 0 {
+		return 0, nil
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Id < webhooks[j].Id })
+	deliveries, err := NewWebhookDeliveries(
+		webhooks,
+		tasks.pending.events,
+		func(id uint) (*Task, error) {
+			task, ok := tasks.tasks[id]
+			if !ok {
+				return nil, nil
+			}
+			result := tasks.toTask(task)
+			return &result, nil
+		},
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	for i := range deliveries {
+		m.lastDeliveryId++
+		deliveries[i].Id = m.lastDeliveryId
+		m.deliveries = append(m.deliveries, &deliveries[i])
+	}
+	return len(deliveries), nil
+}
+
+func (m *MemoryStore) SelectWebhooks(user string) ([]Webhook, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	webhooks := make([]Webhook, 0)
+	for _, webhook := range m.webhooks {
+		if webhook.User == user {
+			webhooks = append(webhooks, *webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Id < webhooks[j].Id })
+	return webhooks, nil
+}
+
+func (m *MemoryStore) InsertWebhook(webhook Webhook) (uint, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastWebhookId++
+	webhook.Id = m.lastWebhookId
+	webhook.Events = append([]string{}, webhook.Events...)
+	m.webhooks[webhook.Id] = &webhook
+	return webhook.Id, nil
+}
+
+func (m *MemoryStore) DeleteWebhook(id uint, user string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	webhook, ok := m.webhooks[id]
+	if !ok || webhook.User != user {
+		return errors.New(fmt.Sprintf("Webhook %d not found", id))
+	}
+	delete(m.webhooks, id)
+	deliveries := make([]*WebhookDelivery, 0, len(m.deliveries))
+	for _, delivery := range m.deliveries {
+		if delivery.WebhookId != id {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+func (m *MemoryStore) SelectDeliveries(webhookId uint, user string, limit uint) ([]WebhookDelivery, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	webhook, ok := m.webhooks[webhookId]
+	if !ok || webhook.User != user {
+		return nil, errors.New(fmt.Sprintf("Webhook %d not found", webhookId))
+	}
+	deliveries := make([]WebhookDelivery, 0)
+	for i := len(m.deliveries) - 1; i >= 0 && uint(len(deliveries)) < limit; i-- {
+		if m.deliveries[i].WebhookId == webhookId {
+			deliveries = append(deliveries, *m.deliveries[i])
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryStore) SelectDueDeliveries(now time.Time, skipWebhookIds []uint, limit uint) ([]DueDelivery, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	skip := make(map[uint]bool)
+	for _, id := range skipWebhookIds {
+		skip[id] = true
+	}
+	deliveries := make([]DueDelivery, 0)
+	for _, delivery := range m.deliveries {
+		if skip[delivery.WebhookId] {
+			continue
+		}
+		if delivery.Status == WEBHOOK_DELIVERY_PENDING && !delivery.NextAttemptAt.After(now) {
+			webhook := m.webhooks[delivery.WebhookId]
+			deliveries = append(deliveries, DueDelivery{*delivery, webhook.Url, webhook.Secret})
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt.Before(deliveries[j].NextAttemptAt)
+	})
+	if uint(len(deliveries)) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryStore) UpdateDelivery(delivery WebhookDelivery) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, d := range m.deliveries {
+		if d.Id == delivery.Id {
+			d.Status = delivery.Status
+			d.Attempts = delivery.Attempts
+			d.NextAttemptAt = delivery.NextAttemptAt
+			d.LastAttemptAt = delivery.LastAttemptAt
+			d.ResponseStatus = delivery.ResponseStatus
+			d.Error = delivery.Error
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteDeliveries(createdBefore time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	deliveries := make([]*WebhookDelivery, 0, len(m.deliveries))
+	for _, delivery := range m.deliveries {
+		if delivery.Status == WEBHOOK_DELIVERY_PENDING || !delivery.CreatedAt.Before(createdBefore) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the migrations of every driver are stored in migrations/<driver> as
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time // nil if the migration is pending
+}
+
+// Migrator is implemented by the stores, which have a schema
+type Migrator interface {
+	MigrateUp() ([]Migration, error)
+	MigrateDown() (Migration, error)
+	MigrationStatus() ([]MigrationState, error)
+}
+
+// loadMigrations returns the migrations of the driver ordered by version
+func loadMigrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make(map[uint]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		if strings.HasSuffix(name, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(name, ".down.sql") {
+			direction = "down"
+		} else {
+			continue
+		}
+		versionStr, migrationName, ok := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid migration file name %s", name))
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid migration version in %s", name))
+		}
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := migrations[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: migrationName}
+			migrations[uint(version)] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	result := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, errors.New(
+				fmt.Sprintf("migration %d needs an up and a down file", migration.Version),
+			)
+		}
+		result = append(result, *migration)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+func (db *Db) createMigrationsTable() error {
+	_, err := db.db.Exec(
+		`create table if not exists schema_migrations (
+			version int primary key,
+			name varchar not null,
+			applied_at timestamp not null
+		)`,
+	)
+	return err
+}
+
+func (db *Db) selectAppliedMigrations() (map[uint]time.Time, error) {
+	err := db.createMigrationsTable()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[uint]time.Time)
+	for rows.Next() {
+		var version uint
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (db *Db) MigrationStatus() ([]MigrationState, error) {
+	migrations, err := loadMigrations(db.driver)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.selectAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, migration := range migrations {
+		state := MigrationState{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &appliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// MigrateUp applies all pending migrations, each in its own transaction
+func (db *Db) MigrateUp() ([]Migration, error) {
+	states, err := db.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	migrated := make([]Migration, 0)
+	for _, state := range states {
+		if state.AppliedAt != nil {
+			continue
+		}
+		err := db.inTransaction("", func(tx *sql.Tx) error {
+			if _, err := tx.Exec(state.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(
+				"INSERT INTO schema_migrations(version, name, applied_at) VALUES ($1, $2, $3)",
+				state.Version, state.Name, time.Now(),
+			)
+			return err
+		})
+		if err != nil {
+			return migrated, errors.New(
+				fmt.Sprintf("migration %d_%s failed: %v", state.Version, state.Name, err),
+			)
+		}
+		migrated = append(migrated, state.Migration)
+	}
+	return migrated, nil
+}
+
+// MigrateDown reverts the last applied migration
+func (db *Db) MigrateDown() (Migration, error) {
+	states, err := db.MigrationStatus()
+	if err != nil {
+		return Migration{}, err
+	}
+	for i := len(states) - 1; i >= 0; i-- {
+		state := states[i]
+		if state.AppliedAt == nil {
+			continue
+		}
+		err := db.inTransaction("", func(tx *sql.Tx) error {
+			if _, err := tx.Exec(state.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", state.Version)
+			return err
+		})
+		if err != nil {
+			return Migration{}, errors.New(
+				fmt.Sprintf("migration %d_%s failed: %v", state.Version, state.Name, err),
+			)
+		}
+		return state.Migration, nil
+	}
+	return Migration{}, errors.New("no migration is applied")
+}
+
+// runMigrateCommand runs the migrate subcommand, args are the arguments after
+// "migrate"
+func runMigrateCommand(migrator Migrator, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+	switch args[0] {
+	case "up":
+		migrations, err := migrator.MigrateUp()
+		for _, migration := range migrations {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(migrations) == 0 {
+			fmt.Println("database is up to date")
+		}
+	case "down":
+		migration, err := migrator.MigrateDown()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+	case "status":
+		states, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, applied)
+		}
+	default:
+		return errors.New("usage: migrate up|down|status")
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+drop table next_task_map;
+drop table tasks;
+drop table users;
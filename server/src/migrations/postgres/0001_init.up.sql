@@ -1,4 +1,4 @@
-create table users (
+create table if not exists users (
   username varchar primary key,
   fullname varchar not null,
   email varchar not null,
@@ -6,7 +6,7 @@ create table users (
   salt bytea not null
 );
 
-create table tasks (
+create table if not exists tasks (
   id SERIAL primary key,
   username varchar not null references users(username),
   title varchar not null,
@@ -15,8 +15,8 @@ create table tasks (
   start_date date,
   start_time time
 );
- 
-create table next_task_map (
+
+create table if not exists next_task_map (
   task_id int not null references tasks(id) on delete cascade,
   next_task_id int not null references tasks(id),
   primary key (task_id, next_task_id)
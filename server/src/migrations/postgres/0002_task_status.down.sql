@@ -0,0 +1,4 @@
+alter table tasks
+  drop column status,
+  drop column started_at,
+  drop column completed_at;
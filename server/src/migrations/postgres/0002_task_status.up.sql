@@ -0,0 +1,5 @@
+alter table tasks
+  add column if not exists status varchar not null default 'open'
+    check (status in ('open', 'in_progress', 'done', 'cancelled')),
+  add column if not exists started_at timestamptz,
+  add column if not exists completed_at timestamptz;
@@ -0,0 +1,4 @@
+-- in minutes
+alter table tasks
+  add column if not exists estimated_duration int not null default 0
+    check (estimated_duration >= 0);
@@ -0,0 +1,10 @@
+create table if not exists sessions (
+  id SERIAL primary key,
+  username varchar not null references users(username) on delete cascade,
+  -- sha256 of the token
+  token_hash bytea not null unique,
+  created_at timestamptz not null,
+  last_seen_at timestamptz not null,
+  user_agent varchar,
+  ip varchar
+);
@@ -0,0 +1,12 @@
+create table if not exists access_tokens (
+  id SERIAL primary key,
+  username varchar not null references users(username) on delete cascade,
+  name varchar not null,
+  -- sha256 of the token
+  token_hash bytea not null unique,
+  -- separated by spaces
+  scopes varchar not null,
+  created_at timestamptz not null,
+  last_used_at timestamptz,
+  expires_at timestamptz
+);
@@ -0,0 +1,2 @@
+drop index if exists tasks_search_vector_idx;
+alter table tasks drop column if exists search_vector;
@@ -0,0 +1,10 @@
+-- full-text search over the tasks, the 'simple' configuration doesn't depend
+-- on the language of the tasks
+alter table tasks add column if not exists search_vector tsvector
+  generated always as (
+    setweight(to_tsvector('simple', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(description, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(location, '')), 'C')
+  ) stored;
+
+create index if not exists tasks_search_vector_idx on tasks using gin (search_vector);
@@ -0,0 +1,4 @@
+alter table tasks
+  drop column due_date,
+  drop column due_time,
+  drop column priority;
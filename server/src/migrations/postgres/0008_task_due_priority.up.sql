@@ -0,0 +1,5 @@
+alter table tasks
+  add column if not exists due_date date,
+  add column if not exists due_time time,
+  add column if not exists priority varchar not null default ''
+    check (priority in ('', 'low', 'medium', 'high'));
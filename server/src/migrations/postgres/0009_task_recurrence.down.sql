@@ -0,0 +1,3 @@
+alter table tasks
+  drop column recurrence,
+  drop column recurrence_copy_next;
@@ -0,0 +1,4 @@
+-- subset of RRULE, empty if the task doesn't recur
+alter table tasks
+  add column if not exists recurrence varchar not null default '',
+  add column if not exists recurrence_copy_next boolean not null default false;
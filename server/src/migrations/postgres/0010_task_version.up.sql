@@ -0,0 +1,2 @@
+-- incremented on every change of the task, sent as ETag
+alter table tasks add column if not exists version bigint not null default 1;
@@ -0,0 +1,10 @@
+-- log of the events of the tasks for the delta sync, the id is the cursor
+create table if not exists changes (
+  id bigserial primary key,
+  username varchar not null references users(username) on delete cascade,
+  type varchar not null,
+  -- no reference, deleted tasks stay in the log
+  task_id integer not null
+);
+
+create index if not exists changes_username_id on changes (username, id);
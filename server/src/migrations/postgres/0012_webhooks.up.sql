@@ -0,0 +1,31 @@
+create table if not exists webhooks (
+  id SERIAL primary key,
+  username varchar not null references users(username) on delete cascade,
+  url varchar not null,
+  -- types of the events separated by spaces, empty for all events
+  events varchar not null default '',
+  -- key of the HMAC signature of the payloads
+  secret varchar not null,
+  created_at timestamptz not null
+);
+
+-- queue and history of the deliveries, the times are in UTC
+create table if not exists webhook_deliveries (
+  id bigserial primary key,
+  webhook_id integer not null references webhooks(id) on delete cascade,
+  event varchar not null,
+  payload text not null,
+  -- pending, delivered or failed
+  status varchar not null default 'pending',
+  attempts integer not null default 0,
+  next_attempt_at timestamptz not null,
+  last_attempt_at timestamptz,
+  -- 0 if there was no response
+  response_status integer not null default 0,
+  error varchar not null default '',
+  created_at timestamptz not null
+);
+
+create index if not exists webhook_deliveries_status_next_attempt_at
+  on webhook_deliveries (status, next_attempt_at);
+create index if not exists webhook_deliveries_webhook_id on webhook_deliveries (webhook_id, id);
@@ -0,0 +1,3 @@
+drop table changes_pruned;
+drop index changes_created_at;
+alter table changes drop column created_at;
@@ -0,0 +1,11 @@
+-- changes older than the retention time are deleted
+alter table changes add column if not exists created_at timestamptz not null default now();
+
+create index if not exists changes_created_at on changes (created_at);
+
+-- the greatest id of the deleted changes, older cursors need a full sync
+create table if not exists changes_pruned (
+  pruned_until bigint not null
+);
+
+insert into changes_pruned (pruned_until) values (0);
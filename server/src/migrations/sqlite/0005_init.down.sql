@@ -0,0 +1,5 @@
+drop table access_tokens;
+drop table sessions;
+drop table next_task_map;
+drop table tasks;
+drop table users;
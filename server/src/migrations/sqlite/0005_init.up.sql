@@ -0,0 +1,57 @@
+-- SQLite is supported since version 5 of the schema, so its history starts here
+
+create table if not exists users (
+  username varchar primary key,
+  fullname varchar not null,
+  email varchar not null,
+  password blob not null,
+  salt blob not null
+);
+
+create table if not exists tasks (
+  id integer primary key autoincrement,
+  username varchar not null references users(username),
+  title varchar not null,
+  description text,
+  location varchar,
+  -- yyyy-mm-dd
+  start_date text,
+  -- hh:mm
+  start_time text,
+  status varchar not null default 'open'
+    check (status in ('open', 'in_progress', 'done', 'cancelled')),
+  started_at timestamp,
+  completed_at timestamp,
+  -- in minutes
+  estimated_duration integer not null default 0 check (estimated_duration >= 0)
+);
+
+create table if not exists next_task_map (
+  task_id integer not null references tasks(id) on delete cascade,
+  next_task_id integer not null references tasks(id),
+  primary key (task_id, next_task_id)
+);
+
+create table if not exists sessions (
+  id integer primary key autoincrement,
+  username varchar not null references users(username) on delete cascade,
+  -- sha256 of the token
+  token_hash blob not null unique,
+  created_at timestamp not null,
+  last_seen_at timestamp not null,
+  user_agent varchar,
+  ip varchar
+);
+
+create table if not exists access_tokens (
+  id integer primary key autoincrement,
+  username varchar not null references users(username) on delete cascade,
+  name varchar not null,
+  -- sha256 of the token
+  token_hash blob not null unique,
+  -- separated by spaces
+  scopes varchar not null,
+  created_at timestamp not null,
+  last_used_at timestamp,
+  expires_at timestamp
+);
@@ -0,0 +1,14 @@
+create table if not exists tags (
+  id integer primary key autoincrement,
+  username varchar not null references users(username) on delete cascade,
+  name varchar not null,
+  -- #rrggbb or empty
+  color varchar not null default '',
+  unique (username, name)
+);
+
+create table if not exists task_tags (
+  task_id integer not null references tasks(id) on delete cascade,
+  tag_id integer not null references tags(id) on delete cascade,
+  primary key (task_id, tag_id)
+);
@@ -0,0 +1,3 @@
+alter table tasks drop column due_date;
+alter table tasks drop column due_time;
+alter table tasks drop column priority;
@@ -0,0 +1,6 @@
+-- yyyy-mm-dd
+alter table tasks add column due_date text;
+-- hh:mm
+alter table tasks add column due_time text;
+alter table tasks add column priority varchar not null default ''
+  check (priority in ('', 'low', 'medium', 'high'));
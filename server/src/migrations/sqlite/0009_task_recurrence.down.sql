@@ -0,0 +1,2 @@
+alter table tasks drop column recurrence;
+alter table tasks drop column recurrence_copy_next;
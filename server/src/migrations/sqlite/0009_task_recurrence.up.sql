@@ -0,0 +1,3 @@
+-- subset of RRULE, empty if the task doesn't recur
+alter table tasks add column recurrence varchar not null default '';
+alter table tasks add column recurrence_copy_next boolean not null default false;
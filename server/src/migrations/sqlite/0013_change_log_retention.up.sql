@@ -0,0 +1,14 @@
+-- changes older than the retention time are deleted, the existing changes
+-- are kept for the full retention time
+alter table changes add column created_at timestamp not null default '';
+
+update changes set created_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
+
+create index if not exists changes_created_at on changes (created_at);
+
+-- the greatest id of the deleted changes, older cursors need a full sync
+create table if not exists changes_pruned (
+  pruned_until integer not null
+);
+
+insert into changes_pruned (pruned_until) values (0);
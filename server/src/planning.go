@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"smart-todo-server/graph"
+)
+
+type TaskGraph struct {
+	Order      []uint       `json:"order"`      // topological order
+	Levels     [][]uint     `json:"levels"`     // ids of the tasks per level, starting with the roots
+	TaskLevels map[uint]int `json:"taskLevels"` // level per task id
+	Roots      []uint       `json:"roots"`      // tasks without previous tasks
+	Leaves     []uint       `json:"leaves"`     // tasks without next tasks
+}
+
+// buildTaskGraph returns the dependency graph of the tasks
+func buildTaskGraph(tasks []Task) *graph.Graph {
+	g := graph.New()
+	for _, task := range tasks {
+		g.AddNode(task.Id)
+		for _, nt := range task.NextTaskIds {
+			g.AddEdge(task.Id, nt)
+		}
+	}
+	return g
+}
+
+func NewTaskGraph(g *graph.Graph) (TaskGraph, error) {
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		return TaskGraph{}, err
+	}
+	taskLevels, err := g.Levels()
+	if err != nil {
+		return TaskGraph{}, err
+	}
+	levels := make([][]uint, 0)
+	for _, id := range g.Nodes() {
+		level := taskLevels[id]
+		for len(levels) <= level {
+			levels = append(levels, make([]uint, 0))
+		}
+		levels[level] = append(levels[level], id)
+	}
+	return TaskGraph{order, levels, taskLevels, g.Roots(), g.Leaves()}, nil
+}
+
+// isResolved returns true, if the task doesn't block its next tasks anymore
+func isResolved(task *Task) bool {
+	return task.Status == STATUS_DONE || task.Status == STATUS_CANCELLED
+}
+
+// parseTaskDateTime parses a date and an optional time of a task, a date
+// without a time is the beginning of the day
+func parseTaskDateTime(date string, clock string, location *time.Location) (time.Time, error) {
+	layout := "2006-01-02"
+	if clock != "" {
+		date += "T" + clock
+		layout += "T15:04"
+	}
+	return time.ParseInLocation(layout, date, location)
+}
+
+// hasStarted returns true, if the start date and time of the task has
+// arrived. Tasks without a start date can always be started.
+func hasStarted(task *Task, now time.Time) bool {
+	if task.Date == "" {
+		return true
+	}
+	startTime, err := parseTaskDateTime(task.Date, task.Time, now.Location())
+	if err != nil {
+		logger.Error.Println(err)
+		return false
+	}
+	return !startTime.After(now)
+}
+
+// taskDue returns the deadline of the task. A task without a due time is due
+// at the end of the day. False is returned, if the task has no due date.
+func taskDue(task *Task, location *time.Location) (time.Time, bool) {
+	if task.DueDate == "" {
+		return time.Time{}, false
+	}
+	due, err := parseTaskDateTime(task.DueDate, task.DueTime, location)
+	if err != nil {
+		logger.Error.Println(err)
+		return time.Time{}, false
+	}
+	if task.DueTime == "" {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due, true
+}
+
+// startsAfter returns true, if there is a start and it isn't before the due
+func startsAfter(start time.Time, due time.Time) bool {
+	return !start.IsZero() && !start.Before(due)
+}
+
+// FlagTasks sets Overdue and DueConflicts of the tasks. A task is overdue, if
+// its deadline has passed and it isn't done or cancelled. Its due conflicts
+// are the previous tasks, also the indirect ones, which aren't done or
+// cancelled and don't start before the deadline. The tasks must contain the
+// previous tasks, also the indirect ones, of the tasks, whose flags are used.
+func FlagTasks(tasks []Task, now time.Time) {
+	g := buildTaskGraph(tasks)
+	// start of the tasks, which can conflict with a deadline
+	starts := make(map[uint]time.Time)
+	for i := range tasks {
+		task := &tasks[i]
+		task.Overdue = false
+		task.DueConflicts = make([]uint, 0)
+		if isResolved(task) || task.Date == "" {
+			continue
+		}
+		start, err := parseTaskDateTime(task.Date, task.Time, now.Location())
+		if err == nil {
+			starts[task.Id] = start
+		}
+	}
+	// the graph of stored tasks has no cycles
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	// the latest start of the previous tasks, also the indirect ones, so the
+	// previous tasks are only searched for deadlines before it
+	latestPrevious := make(map[uint]time.Time)
+	for _, id := range order {
+		var latest time.Time
+		for _, p := range g.Previous(id) {
+			if start := starts[p]; start.After(latest) {
+				latest = start
+			}
+			if start := latestPrevious[p]; start.After(latest) {
+				latest = start
+			}
+		}
+		latestPrevious[id] = latest
+	}
+	for i := range tasks {
+		task := &tasks[i]
+		due, ok := taskDue(task, now.Location())
+		if !ok || isResolved(task) {
+			continue
+		}
+		task.Overdue = !now.Before(due)
+		if !startsAfter(latestPrevious[task.Id], due) {
+			continue
+		}
+		// only the previous tasks, which lead to a conflict, are visited
+		visited := map[uint]bool{task.Id: true}
+		stack := []uint{task.Id}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, p := range g.Previous(id) {
+				if visited[p] || !(startsAfter(starts[p], due) || startsAfter(latestPrevious[p], due)) {
+					continue
+				}
+				visited[p] = true
+				stack = append(stack, p)
+				if startsAfter(starts[p], due) {
+					task.DueConflicts = append(task.DueConflicts, p)
+				}
+			}
+		}
+		sort.Slice(task.DueConflicts, func(i, j int) bool {
+			return task.DueConflicts[i] < task.DueConflicts[j]
+		})
+	}
+}
+
+// flagTasksOfUser sets the flags of FlagTasks, which depend on the previous
+// tasks. Only the previous tasks of the given tasks are loaded, so a page of
+// tasks doesn't load all tasks of the user. For more tasks than a page all
+// tasks are loaded at once.
+func flagTasksOfUser(user string, tasks []*Task) error {
+	ids := make([]uint, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+	var previous []Task
+	var err error
+	if len(tasks) > TASKS_MAX_LIMIT {
+		previous, err = store.SelectAllTasks(user, TaskFilter{})
+	} else {
+		previous, err = store.SelectPreviousTasks(ids, user)
+	}
+	if err != nil {
+		return err
+	}
+	flagged := make([]Task, 0, len(tasks)+len(previous))
+	given := make(map[uint]bool)
+	for _, task := range tasks {
+		flagged = append(flagged, *task)
+		given[task.Id] = true
+	}
+	for _, task := range previous {
+		if !given[task.Id] {
+			flagged = append(flagged, task)
+		}
+	}
+	FlagTasks(flagged, time.Now())
+	for i, task := range tasks {
+		task.Overdue = flagged[i].Overdue
+		task.DueConflicts = flagged[i].DueConflicts
+	}
+	return nil
+}
+
+// ReadyTasks returns all tasks, which are neither done nor cancelled, whose
+// previous tasks are all done or cancelled and whose start has arrived
+func ReadyTasks(tasks []Task, now time.Time) []Task {
+	blocked := make(map[uint]bool)
+	for i := range tasks {
+		if isResolved(&tasks[i]) {
+			continue
+		}
+		for _, nt := range tasks[i].NextTaskIds {
+			blocked[nt] = true
+		}
+	}
+	ready := make([]Task, 0)
+	for i := range tasks {
+		task := &tasks[i]
+		if !isResolved(task) && !blocked[task.Id] && hasStarted(task, now) {
+			ready = append(ready, *task)
+		}
+	}
+	return ready
+}
+
+func handleTasksReadyGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	tasks, err := store.SelectAllTasks(user, TaskFilter{})
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	FlagTasks(tasks, now)
+	json.NewEncoder(w).Encode(ReadyTasks(tasks, now))
+}
+
+func handleTasksGraphGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	tasks, err := store.SelectAllTasks(user, TaskFilter{})
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	taskGraph, err := NewTaskGraph(buildTaskGraph(tasks))
+	var cycleErr *graph.CycleError
+	if errors.As(err, &cycleErr) {
+		writeCycleError(w, cycleErr)
+		return
+	} else if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(taskGraph)
+}
+
+// CriticalPath runs the critical path method on the dependency graph of the
+// tasks. Done and cancelled tasks don't need any time anymore, so their
+// duration is 0.
+func CriticalPath(tasks []Task) (graph.CriticalPathResult, error) {
+	durations := make(map[uint]uint)
+	for _, task := range tasks {
+		if !isResolved(&task) {
+			durations[task.Id] = task.EstimatedDuration
+		}
+	}
+	return buildTaskGraph(tasks).CriticalPath(durations)
+}
+
+func handleTasksCriticalPathGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	tasks, err := store.SelectAllTasks(user, TaskFilter{})
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	criticalPath, err := CriticalPath(tasks)
+	var cycleErr *graph.CycleError
+	if errors.As(err, &cycleErr) {
+		writeCycleError(w, cycleErr)
+		return
+	} else if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(criticalPath)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlagTasks(t *testing.T) {
+	now := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		tasks     []Task
+		overdue   map[uint]bool
+		conflicts map[uint][]uint
+	}{
+		{
+			name: "overdue",
+			tasks: []Task{
+				{Id: 1, DueDate: "2023-05-09", Status: STATUS_OPEN},
+				{Id: 2, DueDate: "2023-05-10", Status: STATUS_OPEN},
+				{Id: 3, DueDate: "2023-05-10", DueTime: "12:00", Status: STATUS_IN_PROGRESS},
+				{Id: 4, DueDate: "2023-05-01", Status: STATUS_DONE},
+				{Id: 5, Status: STATUS_OPEN},
+			},
+			overdue: map[uint]bool{1: true, 3: true},
+		},
+		{
+			name: "previous task starts after the deadline",
+			tasks: []Task{
+				{Id: 1, Date: "2023-05-20", Status: STATUS_OPEN, NextTaskIds: []uint{2}},
+				{Id: 2, DueDate: "2023-05-15", Status: STATUS_OPEN},
+			},
+			conflicts: map[uint][]uint{2: {1}},
+		},
+		{
+			name: "deadline without time is the end of the day",
+			tasks: []Task{
+				{Id: 1, Date: "2023-05-15", Time: "23:00", Status: STATUS_OPEN, NextTaskIds: []uint{3}},
+				{Id: 2, Date: "2023-05-16", Status: STATUS_OPEN, NextTaskIds: []uint{3}},
+				{Id: 3, DueDate: "2023-05-15", Status: STATUS_OPEN},
+			},
+			conflicts: map[uint][]uint{3: {2}},
+		},
+		{
+			name: "indirect previous tasks",
+			tasks: []Task{
+				{Id: 1, Date: "2023-06-01", Status: STATUS_OPEN, NextTaskIds: []uint{2}},
+				{Id: 2, Status: STATUS_OPEN, NextTaskIds: []uint{3, 4}},
+				{Id: 3, Date: "2023-05-30", Status: STATUS_OPEN, NextTaskIds: []uint{5}},
+				{Id: 4, Date: "2023-05-01", Status: STATUS_OPEN, NextTaskIds: []uint{5}},
+				{Id: 5, DueDate: "2023-05-31", Status: STATUS_OPEN},
+			},
+			conflicts: map[uint][]uint{5: {1}},
+		},
+		{
+			name: "resolved tasks",
+			tasks: []Task{
+				{Id: 1, Date: "2023-06-01", Status: STATUS_DONE, NextTaskIds: []uint{2}},
+				{Id: 2, Date: "2023-06-01", Status: STATUS_CANCELLED, NextTaskIds: []uint{3, 4}},
+				{Id: 3, DueDate: "2023-05-31", Status: STATUS_OPEN},
+				{Id: 4, DueDate: "2023-05-01", Status: STATUS_DONE},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			FlagTasks(test.tasks, now)
+			for _, task := range test.tasks {
+				if task.Overdue != test.overdue[task.Id] {
+					t.Errorf("task %d is overdue %v", task.Id, task.Overdue)
+				}
+				conflicts := test.conflicts[task.Id]
+				if conflicts == nil {
+					conflicts = []uint{}
+				}
+				if !reflect.DeepEqual(task.DueConflicts, conflicts) {
+					t.Errorf("due conflicts of task %d are %v, want %v", task.Id, task.DueConflicts, conflicts)
+				}
+			}
+		})
+	}
+}
+
+// every task of a long chain has a deadline, which used to search all
+// previous tasks of every task. Only the deadlines of a few tasks are before
+// the start of a previous task.
+func TestFlagTasksLongChain(t *testing.T) {
+	const length = 5000
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tasks := make([]Task, length)
+	for i := range tasks {
+		day := start.AddDate(0, 0, i)
+		tasks[i] = Task{
+			Id:      uint(i + 1),
+			Date:    day.Format("2006-01-02"),
+			DueDate: day.Format("2006-01-02"),
+			Status:  STATUS_OPEN,
+		}
+		if i+1 < length {
+			tasks[i].NextTaskIds = []uint{uint(i + 2)}
+		}
+	}
+	// the tasks 102 to 109 are due before task 101 starts
+	tasks[100].Date = start.AddDate(0, 0, 109).Format("2006-01-02")
+	began := time.Now()
+	FlagTasks(tasks, start)
+	if elapsed := time.Since(began); elapsed > 5*time.Second {
+		t.Errorf("FlagTasks() of %d tasks took %v", length, elapsed)
+	}
+	for _, task := range tasks {
+		conflicts := []uint{}
+		if task.Id >= 102 && task.Id <= 109 {
+			conflicts = []uint{101}
+		}
+		if !reflect.DeepEqual(task.DueConflicts, conflicts) {
+			t.Fatalf("due conflicts of task %d are %v, want %v", task.Id, task.DueConflicts, conflicts)
+		}
+	}
+}
+
+func TestReadyTasks(t *testing.T) {
+	now := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+	tasks := []Task{
+		{Id: 1, Status: STATUS_DONE, NextTaskIds: []uint{2}},
+		{Id: 2, Status: STATUS_OPEN, NextTaskIds: []uint{3}},
+		{Id: 3, Status: STATUS_OPEN},
+		{Id: 4, Status: STATUS_IN_PROGRESS, Date: "2023-05-10", Time: "12:00"},
+		{Id: 5, Status: STATUS_OPEN, Date: "2023-05-10", Time: "12:01"},
+		{Id: 6, Status: STATUS_OPEN, Date: "2023-05-11"},
+		{Id: 7, Status: STATUS_CANCELLED, NextTaskIds: []uint{8}},
+		{Id: 8, Status: STATUS_OPEN},
+		{Id: 9, Status: STATUS_DONE},
+		{Id: 10, Status: STATUS_OPEN, Date: "2023-13-01"},
+	}
+	ids := make([]uint, 0)
+	for _, task := range ReadyTasks(tasks, now) {
+		ids = append(ids, task.Id)
+	}
+	if !reflect.DeepEqual(ids, []uint{2, 4, 8}) {
+		t.Errorf("ReadyTasks() = %v", ids)
+	}
+}
+
+func TestCriticalPathOfTasks(t *testing.T) {
+	tasks := []Task{
+		{Id: 1, Status: STATUS_DONE, EstimatedDuration: 100, NextTaskIds: []uint{3}},
+		{Id: 2, Status: STATUS_OPEN, EstimatedDuration: 20, NextTaskIds: []uint{3}},
+		{Id: 3, Status: STATUS_IN_PROGRESS, EstimatedDuration: 10},
+		{Id: 4, Status: STATUS_CANCELLED, EstimatedDuration: 50},
+	}
+	result, err := CriticalPath(tasks)
+	if err != nil {
+		t.Fatalf("CriticalPath() returned %v", err)
+	}
+	// the durations of the done and cancelled tasks are 0
+	if result.Duration != 30 || !reflect.DeepEqual(result.Path, []uint{2, 3}) {
+		t.Errorf("CriticalPath() = %d %v, want 30 [2 3]", result.Duration, result.Path)
+	}
+	for _, node := range result.Nodes {
+		if (node.Id == 1 || node.Id == 4) && node.Duration != 0 {
+			t.Errorf("resolved task %d has the duration %d", node.Id, node.Duration)
+		}
+	}
+}
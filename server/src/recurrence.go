@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrence rules of tasks, a subset of RRULE (RFC 5545)
+
+const (
+	RECURRENCE_DAILY   = "DAILY"
+	RECURRENCE_WEEKLY  = "WEEKLY"
+	RECURRENCE_MONTHLY = "MONTHLY"
+)
+
+// weekdays of BYDAY, a week starts on monday
+var recurrenceWeekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// RecurrenceRule repeats a task every Interval days, weeks or months. Weekly
+// rules can repeat on several days of the week.
+type RecurrenceRule struct {
+	Frequency string
+	Interval  int
+	// indexes of recurrenceWeekdays, empty repeats on the day of the task
+	Weekdays []int
+}
+
+// ParseRecurrenceRule parses a rule like "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH".
+// Only FREQ (DAILY, WEEKLY or MONTHLY), INTERVAL and BYDAY (only weekly and
+// without numbers) are supported.
+func ParseRecurrenceRule(rule string) (RecurrenceRule, error) {
+	result := RecurrenceRule{Interval: 1}
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+	for _, part := range strings.Split(rule, ";") {
+		key, value, found := strings.Cut(part, "=")
+		if !found || value == "" {
+			return result, errors.New(fmt.Sprintf("Invalid part '%s'", part))
+		}
+		switch key {
+		case "FREQ":
+			switch value {
+			case RECURRENCE_DAILY, RECURRENCE_WEEKLY, RECURRENCE_MONTHLY:
+				result.Frequency = value
+			default:
+				return result, errors.New(fmt.Sprintf("Unsupported frequency '%s'", value))
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return result, errors.New(fmt.Sprintf("Invalid interval '%s'", value))
+			}
+			result.Interval = interval
+		case "BYDAY":
+			result.Weekdays = make([]int, 0)
+			for _, day := range strings.Split(value, ",") {
+				index := -1
+				for i, weekday := range recurrenceWeekdays {
+					if weekday == day {
+						index = i
+					}
+				}
+				if index < 0 {
+					return result, errors.New(fmt.Sprintf("Invalid day '%s'", day))
+				}
+				if !result.onWeekday(index) {
+					result.Weekdays = append(result.Weekdays, index)
+				}
+			}
+			sort.Ints(result.Weekdays)
+		default:
+			return result, errors.New(fmt.Sprintf("Unsupported part '%s'", key))
+		}
+	}
+	if result.Frequency == "" {
+		return result, errors.New("FREQ is missing")
+	}
+	if result.Weekdays != nil && result.Frequency != RECURRENCE_WEEKLY {
+		return result, errors.New("BYDAY is only supported by weekly rules")
+	}
+	return result, nil
+}
+
+// String returns the rule in the format of RRULE
+func (r *RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Frequency}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.Weekdays) > 0 {
+		days := make([]string, 0, len(r.Weekdays))
+		for _, weekday := range r.Weekdays {
+			days = append(days, recurrenceWeekdays[weekday])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+func ValidateRecurrence(rule string) bool {
+	if rule == "" {
+		return true
+	}
+	_, err := ParseRecurrenceRule(rule)
+	return err == nil
+}
+
+func (r *RecurrenceRule) onWeekday(index int) bool {
+	for _, weekday := range r.Weekdays {
+		if weekday == index {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first date of the rule after the date
+func (r *RecurrenceRule) Next(date time.Time) time.Time {
+	switch r.Frequency {
+	case RECURRENCE_DAILY:
+		return date.AddDate(0, 0, r.Interval)
+	case RECURRENCE_WEEKLY:
+		if len(r.Weekdays) == 0 {
+			return date.AddDate(0, 0, 7*r.Interval)
+		}
+		index := (int(date.Weekday()) + 6) % 7
+		for i := index + 1; i < len(recurrenceWeekdays); i++ {
+			if r.onWeekday(i) {
+				return date.AddDate(0, 0, i-index)
+			}
+		}
+		weekStart := date.AddDate(0, 0, 7*r.Interval-index)
+		for i := range recurrenceWeekdays {
+			if r.onWeekday(i) {
+				return weekStart.AddDate(0, 0, i)
+			}
+		}
+	case RECURRENCE_MONTHLY:
+		// like RFC 5545 months without the day are skipped, so the 31st is
+		// only repeated in months with 31 days
+		for n := 1; ; n++ {
+			next := date.AddDate(0, n*r.Interval, 0)
+			if next.Day() == date.Day() {
+				return next
+			}
+		}
+	}
+	return date
+}
+
+// shiftDate moves a date (yyyy-mm-dd) by a number of days
+func shiftDate(date string, days int) string {
+	if date == "" {
+		return ""
+	}
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		logger.Error.Println(err)
+		return date
+	}
+	return d.AddDate(0, 0, days).Format("2006-01-02")
+}
+
+// NextOccurrence returns the task, which is created when the recurring task
+// is done. Its date is the first date of the rule after the day of
+// completion, the due date is moved by the same number of days. A task
+// without date and due date gets the first date of the rule after the day of
+// completion. False is returned, if the task doesn't recur.
+func NextOccurrence(task *Task, completedAt time.Time) (CreateTask, bool) {
+	if task.Recurrence == "" {
+		return CreateTask{}, false
+	}
+	rule, err := ParseRecurrenceRule(task.Recurrence)
+	if err != nil {
+		logger.Error.Println(err)
+		return CreateTask{}, false
+	}
+	next := CreateTask{
+		Title:              task.Title,
+		Description:        task.Description,
+		Location:           task.Location,
+		Date:               task.Date,
+		Time:               task.Time,
+		Status:             STATUS_OPEN,
+		EstimatedDuration:  task.EstimatedDuration,
+		Tags:               task.Tags,
+		DueDate:            task.DueDate,
+		DueTime:            task.DueTime,
+		Priority:           task.Priority,
+		Recurrence:         task.Recurrence,
+		RecurrenceCopyNext: task.RecurrenceCopyNext,
+	}
+	if task.RecurrenceCopyNext {
+		next.NextTaskIds = task.NextTaskIds
+	}
+	completedDay, _ := time.Parse("2006-01-02", completedAt.Format("2006-01-02"))
+	base := task.Date
+	if base == "" {
+		base = task.DueDate
+	}
+	if base == "" {
+		next.Date = rule.Next(completedDay).Format("2006-01-02")
+		return next, true
+	}
+	baseDate, err := time.Parse("2006-01-02", base)
+	if err != nil {
+		logger.Error.Println(err)
+		return CreateTask{}, false
+	}
+	nextDate := rule.Next(baseDate)
+	for !nextDate.After(completedDay) {
+		nextDate = rule.Next(nextDate)
+	}
+	days := int(nextDate.Sub(baseDate).Hours() / 24)
+	next.Date = shiftDate(task.Date, days)
+	next.DueDate = shiftDate(task.DueDate, days)
+	return next, true
+}
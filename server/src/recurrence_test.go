@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrenceRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		result RecurrenceRule
+		valid  bool
+	}{
+		{"FREQ=DAILY", RecurrenceRule{RECURRENCE_DAILY, 1, nil}, true},
+		{"freq=weekly;interval=2", RecurrenceRule{RECURRENCE_WEEKLY, 2, nil}, true},
+		{"RRULE:FREQ=MONTHLY", RecurrenceRule{RECURRENCE_MONTHLY, 1, nil}, true},
+		{"FREQ=WEEKLY;BYDAY=TH,MO,TH", RecurrenceRule{RECURRENCE_WEEKLY, 1, []int{0, 3}}, true},
+		{"", RecurrenceRule{}, false},
+		{"INTERVAL=2", RecurrenceRule{}, false},
+		{"FREQ=YEARLY", RecurrenceRule{}, false},
+		{"FREQ=DAILY;INTERVAL=0", RecurrenceRule{}, false},
+		{"FREQ=DAILY;INTERVAL=x", RecurrenceRule{}, false},
+		{"FREQ=WEEKLY;BYDAY=1MO", RecurrenceRule{}, false},
+		{"FREQ=DAILY;BYDAY=MO", RecurrenceRule{}, false},
+		{"FREQ=DAILY;COUNT=3", RecurrenceRule{}, false},
+		{"FREQ", RecurrenceRule{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			result, err := ParseRecurrenceRule(test.rule)
+			if test.valid != (err == nil) {
+				t.Fatalf("ParseRecurrenceRule() returned %v, want valid %v", err, test.valid)
+			}
+			if test.valid && !reflect.DeepEqual(result, test.result) {
+				t.Errorf("ParseRecurrenceRule() = %+v, want %+v", result, test.result)
+			}
+		})
+	}
+}
+
+func TestRecurrenceRuleString(t *testing.T) {
+	rule, err := ParseRecurrenceRule("byday=fr,mo;freq=weekly;interval=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.String() != "FREQ=WEEKLY;INTERVAL=3;BYDAY=MO,FR" {
+		t.Errorf("String() = %s", rule.String())
+	}
+}
+
+func TestRecurrenceRuleNext(t *testing.T) {
+	tests := []struct {
+		rule string
+		date string
+		next string
+	}{
+		{"FREQ=DAILY", "2023-01-31", "2023-02-01"},
+		{"FREQ=DAILY;INTERVAL=3", "2023-12-30", "2024-01-02"},
+		{"FREQ=WEEKLY", "2023-05-03", "2023-05-10"},
+		{"FREQ=WEEKLY;INTERVAL=2", "2023-05-03", "2023-05-17"},
+		// 2023-05-01 is a monday
+		{"FREQ=WEEKLY;BYDAY=MO,TH", "2023-05-01", "2023-05-04"},
+		{"FREQ=WEEKLY;BYDAY=MO,TH", "2023-05-04", "2023-05-08"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2023-05-04", "2023-05-15"},
+		{"FREQ=WEEKLY;BYDAY=MO", "2023-05-07", "2023-05-08"},
+		{"FREQ=MONTHLY", "2023-03-15", "2023-04-15"},
+		{"FREQ=MONTHLY;INTERVAL=12", "2023-03-15", "2024-03-15"},
+		// months without the 31st are skipped
+		{"FREQ=MONTHLY", "2023-01-31", "2023-03-31"},
+	}
+	for _, test := range tests {
+		t.Run(test.rule+" "+test.date, func(t *testing.T) {
+			rule, err := ParseRecurrenceRule(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			date, _ := time.Parse("2006-01-02", test.date)
+			next := rule.Next(date).Format("2006-01-02")
+			if next != test.next {
+				t.Errorf("Next(%s) = %s, want %s", test.date, next, test.next)
+			}
+		})
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	completedAt := time.Date(2023, 5, 10, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		task    Task
+		date    string
+		dueDate string
+		next    []uint
+	}{
+		{"date and due date", Task{Date: "2023-05-08", DueDate: "2023-05-09", Recurrence: "FREQ=WEEKLY"}, "2023-05-15", "2023-05-16", nil},
+		{"missed occurrences are skipped", Task{Date: "2023-05-01", Recurrence: "FREQ=DAILY;INTERVAL=2"}, "2023-05-11", "", nil},
+		{"due date only", Task{DueDate: "2023-05-10", Recurrence: "FREQ=DAILY"}, "", "2023-05-11", nil},
+		{"without dates", Task{Recurrence: "FREQ=MONTHLY"}, "2023-06-10", "", nil},
+		{"next tasks are copied", Task{NextTaskIds: []uint{2}, Recurrence: "FREQ=DAILY", RecurrenceCopyNext: true}, "2023-05-11", "", []uint{2}},
+		{"next tasks are not copied", Task{NextTaskIds: []uint{2}, Recurrence: "FREQ=DAILY"}, "2023-05-11", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.task.Title = "recurring"
+			test.task.Status = STATUS_DONE
+			next, ok := NextOccurrence(&test.task, completedAt)
+			if !ok {
+				t.Fatalf("NextOccurrence() returned no task")
+			}
+			if next.Date != test.date || next.DueDate != test.dueDate || !reflect.DeepEqual(next.NextTaskIds, test.next) {
+				t.Errorf("NextOccurrence() = %+v", next)
+			}
+			if next.Status != STATUS_OPEN || next.Recurrence != test.task.Recurrence || next.Title != "recurring" {
+				t.Errorf("NextOccurrence() = %+v", next)
+			}
+		})
+	}
+	if _, ok := NextOccurrence(&Task{Date: "2023-05-08"}, completedAt); ok {
+		t.Errorf("NextOccurrence() of a task without rule returned a task")
+	}
+}
+
+// completing a recurring task creates its next occurrence once
+func TestCompleteRecurringTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		id := c.createTask(map[string]interface{}{"title": "recurring", "date": "2023-05-01", "recurrence": "FREQ=DAILY"})
+		path := fmt.Sprintf("/tasks/%d", id)
+		for i := 0; i < 2; i++ {
+			if status := c.request("PATCH", path, map[string]interface{}{"status": STATUS_DONE}, nil); status != http.StatusOK {
+				t.Fatalf("patch responded with %d", status)
+			}
+		}
+		tasks := c.getTasks()
+		if len(tasks) != 2 {
+			t.Fatalf("tasks after the completion are %+v", tasks)
+		}
+		done, next := tasks[0], tasks[1]
+		if done.Recurrence != "" || done.Status != STATUS_DONE {
+			t.Errorf("completed task is %+v", done)
+		}
+		today := time.Now().Format("2006-01-02")
+		if next.Recurrence != "FREQ=DAILY" || next.Status != STATUS_OPEN || next.Date <= today {
+			t.Errorf("next occurrence is %+v", next)
+		}
+	})
+}
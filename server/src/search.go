@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// full-text search over the title, description and location of the tasks
+
+const SEARCH_HIGHLIGHT_START = "<mark>"
+const SEARCH_HIGHLIGHT_STOP = "</mark>"
+
+const SEARCH_DEFAULT_LIMIT = 20
+const SEARCH_MAX_LIMIT = 100
+
+// maximum number of words of the snippet of a description
+const SEARCH_SNIPPET_WORDS = 35
+
+// options of ts_headline, which match the in-process highlighting
+const SEARCH_HEADLINE_OPTIONS = "StartSel=" + SEARCH_HIGHLIGHT_START +
+	", StopSel=" + SEARCH_HIGHLIGHT_STOP + ", HighlightAll=true"
+const SEARCH_SNIPPET_OPTIONS = "StartSel=" + SEARCH_HIGHLIGHT_START +
+	", StopSel=" + SEARCH_HIGHLIGHT_STOP + ", MaxWords=35, MinWords=15"
+
+// weights of the fields for the ranking, like the default weights of A, B
+// and C of ts_rank
+var searchWeights = map[string]float64{
+	"title":       1.0,
+	"description": 0.4,
+	"location":    0.2,
+}
+
+type SearchResult struct {
+	Task Task `json:"task"`
+	// only comparable between the results of one search
+	Rank float64 `json:"rank"`
+	// matching fields with the matches enclosed in SEARCH_HIGHLIGHT_START and
+	// SEARCH_HIGHLIGHT_STOP, the text isn't HTML escaped. The description is
+	// shortened to a snippet.
+	Highlights map[string]string `json:"highlights"`
+}
+
+// searchWords splits a text into lower case words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchQuery is the subset of the web search syntax, which is supported by
+// the in-process search: all words must match, except words with a leading
+// '-', which must not match
+type searchQuery struct {
+	include []string
+	exclude []string
+}
+
+func parseSearchQuery(query string) searchQuery {
+	var q searchQuery
+	for _, token := range strings.Fields(query) {
+		if strings.HasPrefix(token, "-") {
+			q.exclude = append(q.exclude, searchWords(token)...)
+		} else {
+			q.include = append(q.include, searchWords(token)...)
+		}
+	}
+	return q
+}
+
+// highlightText encloses the whitespace separated parts of the text, which
+// contain one of the words, in highlight marks. If snippet is set, the text
+// is shortened around the first match.
+func highlightText(text string, words map[string]bool, snippet bool) string {
+	parts := strings.Fields(text)
+	first := -1
+	for i, part := range parts {
+		for _, word := range searchWords(part) {
+			if words[word] {
+				parts[i] = SEARCH_HIGHLIGHT_START + part + SEARCH_HIGHLIGHT_STOP
+				if first < 0 {
+					first = i
+				}
+				break
+			}
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	if !snippet || len(parts) <= SEARCH_SNIPPET_WORDS {
+		return strings.Join(parts, " ")
+	}
+	start := first - SEARCH_SNIPPET_WORDS/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + SEARCH_SNIPPET_WORDS
+	if end > len(parts) {
+		end = len(parts)
+		start = end - SEARCH_SNIPPET_WORDS
+	}
+	result := strings.Join(parts[start:end], " ")
+	if start > 0 {
+		result = "... " + result
+	}
+	if end < len(parts) {
+		result += " ..."
+	}
+	return result
+}
+
+// SearchTasks is the in-process search, which is used by the storage
+// backends without full-text search
+func SearchTasks(tasks []Task, query string, limit uint) []SearchResult {
+	q := parseSearchQuery(query)
+	if len(q.include) == 0 {
+		return []SearchResult{}
+	}
+	included := make(map[string]bool)
+	for _, word := range q.include {
+		included[word] = true
+	}
+	results := make([]SearchResult, 0)
+	for _, task := range tasks {
+		fields := map[string]string{
+			"title":       task.Title,
+			"description": task.Description,
+			"location":    task.Location,
+		}
+		counts := make(map[string]int)
+		rank := 0.0
+		for field, text := range fields {
+			for _, word := range searchWords(text) {
+				counts[word]++
+				if included[word] {
+					rank += searchWeights[field]
+				}
+			}
+		}
+		matches := true
+		for _, word := range q.include {
+			matches = matches && counts[word] > 0
+		}
+		for _, word := range q.exclude {
+			matches = matches && counts[word] == 0
+		}
+		if !matches {
+			continue
+		}
+		highlights := make(map[string]string)
+		for field, text := range fields {
+			if highlight := highlightText(text, included, field == "description"); highlight != "" {
+				highlights[field] = highlight
+			}
+		}
+		results = append(results, SearchResult{task, rank, highlights})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank > results[j].Rank
+	})
+	if uint(len(results)) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func handleTasksSearchGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, "query parameter q is missing", http.StatusBadRequest)
+		return
+	}
+	var limit uint = SEARCH_DEFAULT_LIMIT
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.ParseUint(limitStr, 10, 32)
+		if err != nil || l == 0 || l > SEARCH_MAX_LIMIT {
+			writeError(w, "limit must be between 1 and "+strconv.Itoa(SEARCH_MAX_LIMIT), http.StatusBadRequest)
+			return
+		}
+		limit = uint(l)
+	}
+	results, err := store.SearchTasks(user, query, limit)
+	if err == nil {
+		flagged := make([]*Task, 0, len(results))
+		for i := range results {
+			flagged = append(flagged, &results[i].Task)
+		}
+		err = flagTasksOfUser(user, flagged)
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(results)
+}
@@ -5,22 +5,25 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/argon2"
+
+	"smart-todo-server/graph"
 )
 
 const JSON_CONTENT_TYPE = "application/json"
 
 var config Conf
-var db Db
+var store Store
 var logger Logger
-var tokenUserMap map[string]TokenUser
 
 func handleSpecialTaskGet(w http.ResponseWriter, r *http.Request) {
 	user := r.Header.Get("username")
@@ -38,13 +41,17 @@ func handleSpecialTaskGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var task Task
-	task, err = db.SelectOneSpecialTasks(id, user)
+	task, err = store.SelectOneSpecialTasks(id, user)
+	if err == nil {
+		err = flagTasksOfUser(user, []*Task{&task})
+	}
 	if err != nil {
 		error := make(map[string]string)
 		error["error"] = fmt.Sprint(err)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(error)
 	} else {
+		w.Header().Set("ETag", taskETag(task.Version))
 		json.NewEncoder(w).Encode(task)
 	}
 }
@@ -52,11 +59,36 @@ func handleSpecialTaskGet(w http.ResponseWriter, r *http.Request) {
 func handleTasksGet(w http.ResponseWriter, r *http.Request) {
 	user := r.Header.Get("username")
 	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
-	tasks, err := db.SelectAllTasks(user)
+	filter, err := ParseTaskFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := filter.Limit
+	if limit > 0 {
+		// one more task tells, if there is a next page
+		filter.Limit++
+	}
+	tasks, err := store.SelectAllTasks(user, filter)
+	next := ""
+	if err == nil {
+		if limit > 0 && uint(len(tasks)) > limit {
+			tasks = tasks[:limit]
+			next = EncodeTaskCursor(&tasks[limit-1], &filter)
+		}
+		flagged := make([]*Task, 0, len(tasks))
+		for i := range tasks {
+			flagged = append(flagged, &tasks[i])
+		}
+		err = flagTasksOfUser(user, flagged)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		logger.Error.Println(err)
+	} else if limit > 0 {
+		// a page is returned with the cursor of the next page
+		json.NewEncoder(w).Encode(map[string]any{"tasks": tasks, "next": next})
 	} else {
 		json.NewEncoder(w).Encode(tasks)
 	}
@@ -74,8 +106,12 @@ func handleTasksPost(w http.ResponseWriter, r *http.Request) {
 		if err == nil {
 			if ValidateCreateTask(&createTask) {
 				// create Task
-				id, err := db.InsertTask(createTask, user)
-				if err != nil {
+				id, err := store.InsertTask(createTask, user)
+				var cycleErr *graph.CycleError
+				if errors.As(err, &cycleErr) {
+					writeCycleError(w, cycleErr)
+					return
+				} else if err != nil {
 					logger.Error.Println(err)
 					error = "next task id doesn't exists"
 				} else {
@@ -97,13 +133,214 @@ func handleTasksPost(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// parseIdArray converts a json array of numbers to task ids
+func parseIdArray(value interface{}) ([]uint, bool) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	ids := make([]uint, 0, len(items))
+	for _, item := range items {
+		id, ok := item.(float64)
+		if !ok || id < 0 || id != float64(uint(id)) {
+			return nil, false
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, true
+}
+
+// parseTagArray converts a json array of strings to tag names, null is no tag
+func parseTagArray(tags interface{}) ([]string, bool) {
+	if tags == nil {
+		return []string{}, true
+	}
+	array, ok := tags.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	result := make([]string, 0, len(array))
+	for _, tag := range array {
+		name, ok := tag.(string)
+		if !ok || !ValidateTagName(name) {
+			return nil, false
+		}
+		result = append(result, name)
+	}
+	return result, true
+}
+
+// parsePatchTask validates the json object of a PATCH request. It returns the
+// patched values and the keys of the values, which should be updated. If the
+// object isn't valid, an error message is returned.
+func parsePatchTask(patchObj map[string]interface{}) (CreateTask, []string, string) {
+	patchTask := CreateTask{}
+	patchKeys := make([]string, 0)
+	var error string
+	if title, ok := patchObj["title"]; ok {
+		if v, ok := title.(string); ok && v != "" {
+			patchTask.Title = v
+			patchKeys = append(patchKeys, "title")
+		} else {
+			error = "title must no be empty"
+		}
+	}
+	if description, ok := patchObj["description"]; ok {
+		if description == nil {
+			description = ""
+		}
+		if v, ok := description.(string); ok {
+			patchTask.Description = v
+			patchKeys = append(patchKeys, "description")
+		} else {
+			error = "description must be a string"
+		}
+	}
+	if location, ok := patchObj["location"]; ok {
+		if location == nil {
+			location = ""
+		}
+		if v, ok := location.(string); ok {
+			patchTask.Location = v
+			patchKeys = append(patchKeys, "location")
+		} else {
+			error = "location must be a string"
+		}
+	}
+	if date, ok := patchObj["date"]; ok {
+		if date == nil {
+			date = ""
+		}
+		if v, ok := date.(string); ok && ValidateDate(v) {
+			patchTask.Date = v
+			patchKeys = append(patchKeys, "date")
+		} else {
+			error = "Date not a valid ISO 8601 string"
+		}
+	}
+	if time, ok := patchObj["time"]; ok {
+		if time == nil {
+			time = ""
+		}
+		if v, ok := time.(string); ok && ValidateTime(v) {
+			patchTask.Time = v
+			patchKeys = append(patchKeys, "time")
+		} else {
+			error = "Time not a valid ISO 8601 string"
+		}
+	}
+	if dueDate, ok := patchObj["dueDate"]; ok {
+		if dueDate == nil {
+			dueDate = ""
+		}
+		if v, ok := dueDate.(string); ok && ValidateDate(v) {
+			patchTask.DueDate = v
+			patchKeys = append(patchKeys, "dueDate")
+		} else {
+			error = "dueDate not a valid ISO 8601 string"
+		}
+	}
+	if dueTime, ok := patchObj["dueTime"]; ok {
+		if dueTime == nil {
+			dueTime = ""
+		}
+		if v, ok := dueTime.(string); ok && ValidateTime(v) {
+			patchTask.DueTime = v
+			patchKeys = append(patchKeys, "dueTime")
+		} else {
+			error = "dueTime not a valid ISO 8601 string"
+		}
+	}
+	if priority, ok := patchObj["priority"]; ok {
+		if priority == nil {
+			priority = ""
+		}
+		if v, ok := priority.(string); ok && ValidatePriority(v) {
+			patchTask.Priority = v
+			patchKeys = append(patchKeys, "priority")
+		} else {
+			error = "priority must be one of 'low', 'medium' or 'high'"
+		}
+	}
+	if recurrence, ok := patchObj["recurrence"]; ok {
+		if recurrence == nil {
+			recurrence = ""
+		}
+		if v, ok := recurrence.(string); ok && ValidateRecurrence(v) {
+			patchTask.Recurrence = v
+			patchKeys = append(patchKeys, "recurrence")
+		} else {
+			error = "recurrence must be a rule with FREQ=DAILY, WEEKLY or MONTHLY, " +
+				"INTERVAL and BYDAY"
+		}
+	}
+	if recurrenceCopyNext, ok := patchObj["recurrenceCopyNext"]; ok {
+		if v, ok := recurrenceCopyNext.(bool); ok {
+			patchTask.RecurrenceCopyNext = v
+			patchKeys = append(patchKeys, "recurrenceCopyNext")
+		} else {
+			error = "recurrenceCopyNext must be a boolean"
+		}
+	}
+	if status, ok := patchObj["status"]; ok {
+		if v, ok := status.(string); ok && ValidateStatus(v) {
+			patchTask.Status = v
+			patchKeys = append(patchKeys, "status")
+		} else {
+			error = "status must be one of 'open', 'in_progress', 'done' or 'cancelled'"
+		}
+	}
+	if estimatedDuration, ok := patchObj["estimatedDuration"]; ok {
+		if estimatedDuration == nil {
+			estimatedDuration = float64(0)
+		}
+		if v, ok := estimatedDuration.(float64); ok && v >= 0 && v == float64(uint(v)) {
+			patchTask.EstimatedDuration = uint(v)
+			patchKeys = append(patchKeys, "estimatedDuration")
+		} else {
+			error = "estimatedDuration must be a non-negative integer"
+		}
+	}
+	if nextTaskIds, ok := patchObj["nextTaskIds"]; ok {
+		if v, ok := parseIdArray(nextTaskIds); ok {
+			patchTask.NextTaskIds = uniqueIds(v)
+			patchKeys = append(patchKeys, "nextTaskIds")
+		} else {
+			error = "NextTaskIds must be an integer array"
+		}
+	}
+	if previousTaskIds, ok := patchObj["previousTaskIds"]; ok {
+		if v, ok := parseIdArray(previousTaskIds); ok {
+			patchTask.PreviousTaskIds = uniqueIds(v)
+			patchKeys = append(patchKeys, "previousTaskIds")
+		} else {
+			error = "PreviousTaskIds must be an integer array"
+		}
+	}
+	if tags, ok := patchObj["tags"]; ok {
+		if v, ok := parseTagArray(tags); ok {
+			patchTask.Tags = v
+			patchKeys = append(patchKeys, "tags")
+		} else {
+			error = "tags must be an array of tag names"
+		}
+	}
+	return patchTask, patchKeys, error
+}
+
 func handleSpecialTasksPatch(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
 	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
 	result := make(map[string]string)
 	vars := mux.Vars(r)
 	idStr := vars["taskId"]
 	idInt, err := strconv.Atoi(idStr)
 	id := uint(idInt)
+	version, ok := parseIfMatch(r)
+	if !ok {
+		writeError(w, "If-Match doesn't match the task", http.StatusPreconditionFailed)
+		return
+	}
 	if err == nil {
 		contentType := r.Header.Get("Content-Type")
 		switch contentType {
@@ -111,139 +348,22 @@ func handleSpecialTasksPatch(w http.ResponseWriter, r *http.Request) {
 			patchObj := make(map[string]interface{})
 			err := json.NewDecoder(r.Body).Decode(&patchObj)
 			if err == nil {
-				title, titleExists := patchObj["title"]
-				if titleExists {
-					v, ok := title.(string)
-					if !ok || v == "" {
-						w.WriteHeader(http.StatusBadRequest)
-						result["error"] = "title must no be empty"
-						titleExists = false
-					}
-				}
-				description, descriptionExists := patchObj["description"]
-				if descriptionExists {
-					if description == nil {
-						description = ""
-					}
-					if _, ok := description.(string); !ok {
-						w.WriteHeader(http.StatusBadRequest)
-						result["error"] = "description must be a string"
-					}
-				}
-				location, locationExists := patchObj["location"]
-				if locationExists {
-					if location == nil {
-						location = ""
-					}
-					if _, ok := location.(string); !ok {
-						w.WriteHeader(http.StatusBadRequest)
-						result["error"] = "location must be a string"
-					}
-				}
-				date, dateExists := patchObj["date"]
-				if dateExists {
-					if date == nil {
-						date = ""
-					}
-					if d, ok := date.(string); ok && !ValidateDate(d) {
-						w.WriteHeader(http.StatusBadRequest)
-						result["error"] = "Date not a valid ISO 8601 string"
-						dateExists = false
-					}
-				}
-
-				time, timeExists := patchObj["time"]
-				if timeExists {
-					if time == nil {
-						time = ""
-					}
-					if t, ok := time.(string); ok {
-						if !ValidateTime(t) {
-							w.WriteHeader(http.StatusBadRequest)
-							result["error"] = "Time not a valid ISO 8601 string"
-							timeExists = false
-						}
-					} else {
-						w.WriteHeader(http.StatusBadRequest)
-						result["error"] = "Time not a valid ISO 8601 string"
-						timeExists = false
-					}
-				}
-				nextTaskIds, nextTaskIdsExists := patchObj["nextTaskIds"]
-				nextTaskIdsArr := make([]uint, 0)
-				if nextTaskIdsExists {
-					_, ok := nextTaskIds.([]interface{})
-					if ok {
-						completeOk := true
-						for _, item := range nextTaskIds.([]interface{}) {
-							_, curOk := item.(float64)
-							nextTaskIdsArr = append(nextTaskIdsArr, uint(item.(float64)))
-							if !curOk {
-								completeOk = false
-							}
-						}
-						if !completeOk {
-							w.WriteHeader(http.StatusBadRequest)
-							result["error"] = "NextTaskIds must be an integer array"
-							nextTaskIdsExists = false
-						}
-					}
-				}
-				previousTaskIds, previousTaskIdsExists := patchObj["previousTaskIds"]
-				previousTaskIdsArr := make([]uint, 0)
-				if previousTaskIdsExists {
-					_, ok := previousTaskIds.([]interface{})
-					if ok {
-						completeOk := true
-						for _, item := range previousTaskIds.([]interface{}) {
-							_, curOk := item.(float64)
-							previousTaskIdsArr = append(previousTaskIdsArr, uint(item.(float64)))
-							if !curOk {
-								completeOk = false
-							}
-						}
-						if !completeOk {
-							w.WriteHeader(http.StatusBadRequest)
-							result["error"] = "PreviousTaskIds must be an integer array"
-							previousTaskIdsExists = false
-						}
-					}
-				}
-				_, containErrors := result["error"]
-				if !containErrors {
+				patchTask, patchKeys, error := parsePatchTask(patchObj)
+				if error != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					result["error"] = error
+				} else {
 					// PATCH task
-					patchTask := CreateTask{}
-					patchKeys := make([]string, 0)
-					if titleExists {
-						patchTask.Title = title.(string)
-						patchKeys = append(patchKeys, "title")
-					}
-					if descriptionExists {
-						patchTask.Description = description.(string)
-						patchKeys = append(patchKeys, "description")
-					}
-					if locationExists {
-						patchTask.Location = location.(string)
-						patchKeys = append(patchKeys, "location")
-					}
-					if dateExists {
-						patchTask.Date = date.(string)
-						patchKeys = append(patchKeys, "date")
-					}
-					if timeExists {
-						patchTask.Time = time.(string)
-						patchKeys = append(patchKeys, "time")
-					}
-					if nextTaskIdsExists {
-						patchTask.NextTaskIds = nextTaskIdsArr
-						patchKeys = append(patchKeys, "nextTaskIds")
-					}
-					if previousTaskIdsExists {
-						patchTask.PreviousTaskIds = previousTaskIdsArr
-						patchKeys = append(patchKeys, "previousTaskIds")
-					}
-					err := db.UpdateTask(id, patchTask, patchKeys)
-					if err != nil {
+					err := store.UpdateTask(id, patchTask, patchKeys, version, user)
+					var cycleErr *graph.CycleError
+					var versionErr *VersionError
+					if errors.As(err, &cycleErr) {
+						writeCycleError(w, cycleErr)
+						return
+					} else if errors.As(err, &versionErr) {
+						writeVersionError(w, versionErr)
+						return
+					} else if err != nil {
 						logger.Error.Println(err)
 						if strings.Contains(err.Error(), "not found to update") {
 							w.WriteHeader(http.StatusNotFound)
@@ -253,7 +373,6 @@ func handleSpecialTasksPatch(w http.ResponseWriter, r *http.Request) {
 						result["error"] = err.Error()
 					}
 				}
-
 			} else {
 				logger.Error.Println(err)
 				w.WriteHeader(http.StatusBadRequest)
@@ -283,10 +402,19 @@ func handleSpecialTasksDelete(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).
 			Encode(map[string]string{"error": "Fail to get taskId from requested path"})
+		return
+	}
+	version, ok := parseIfMatch(r)
+	if !ok {
+		writeError(w, "If-Match doesn't match the task", http.StatusPreconditionFailed)
+		return
 	}
 
-	err = db.DeleteTask(id, user)
-	if err != nil {
+	err = store.DeleteTask(id, version, user)
+	var versionErr *VersionError
+	if errors.As(err, &versionErr) {
+		writeVersionError(w, versionErr)
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 	}
@@ -297,6 +425,46 @@ func writeError(w http.ResponseWriter, error string, errorCode int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": error})
 }
 
+// writeCycleError responds with 409 and the path of the cycle, which the
+// request would have created
+func writeCycleError(w http.ResponseWriter, cycleErr *graph.CycleError) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": cycleErr.Error(),
+		"cycle": cycleErr.Path,
+	})
+}
+
+// taskETag returns the ETag of a version of a task
+func taskETag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// parseIfMatch returns the version of the If-Match header, 0 if the header is
+// missing or "*". Only a single ETag of a task is supported, for other values
+// false is returned.
+func parseIfMatch(r *http.Request) (uint64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(header[1:len(header)-1], 10, 64)
+	if err != nil || version == 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// writeVersionError responds with 412 and the ETag of the current version of
+// the task
+func writeVersionError(w http.ResponseWriter, versionErr *VersionError) {
+	w.Header().Set("ETag", taskETag(versionErr.Version))
+	writeError(w, versionErr.Error(), http.StatusPreconditionFailed)
+}
+
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
 	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
@@ -353,14 +521,13 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 	hashedPasswd := getHashedPasswd([]byte(password), salt)
 	user := User{username, fullname, email, hashedPasswd, salt}
-	err = db.insertUser(user)
+	err = store.InsertUser(user)
 	if err != nil {
 		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	logger.Info.Printf("Register user %v\n", username)
-	handleLoginTokenAction(w, username)
-
+	handleLoginTokenAction(w, r, username)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -393,7 +560,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "password must not be emtpy", http.StatusBadRequest)
 		return
 	}
-	user, err := db.getUser(username)
+	user, err := store.GetUser(username)
 	if err != nil {
 		logger.Error.Println(err)
 		logger.Info.Println("Log in failed. ")
@@ -403,7 +570,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	hashedPasswd := getHashedPasswd([]byte(password), user.Salt)
 	if bytes.Equal(user.Password, hashedPasswd) {
 		logger.Info.Printf("Logged in as %v", username)
-		handleLoginTokenAction(w, username)
+		handleLoginTokenAction(w, r, username)
 	} else {
 		logger.Info.Println("Log in failed. ")
 		writeError(w, "Log in failed. Wrong credentials", http.StatusUnauthorized)
@@ -411,14 +578,20 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleLoginTokenAction(w http.ResponseWriter, username string) {
+func handleLoginTokenAction(w http.ResponseWriter, r *http.Request, username string) {
 	token, err := getSalt(32)
 	if err != nil {
 		writeError(w, fmt.Sprintf("fail to get token: %v", err.Error()), http.StatusInternalServerError)
+		return
 	}
 	tokenStr := hex.EncodeToString(token)
-	tokenUserMap[tokenStr] = NewTokenUser(username)
-	user, err := db.getUser(username)
+	_, err = store.InsertSession(hashToken(tokenStr), username, r.UserAgent(), clientIp(r))
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, "Failed to store session", http.StatusInternalServerError)
+		return
+	}
+	user, err := store.GetUser(username)
 	if err != nil {
 		logger.Error.Println(err)
 		writeError(w, "Failed to load user from database", http.StatusInternalServerError)
@@ -434,7 +607,7 @@ func handleLoginTokenAction(w http.ResponseWriter, username string) {
 
 func handleUserInfo(w http.ResponseWriter, r *http.Request) {
 	username := r.Header.Get("username")
-	user, err := db.getUser(username)
+	user, err := store.GetUser(username)
 	if err != nil {
 		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -447,8 +620,23 @@ func handleUserInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("token")
-	delete(tokenUserMap, token)
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	session := sessionFromRequest(r)
+	if session == 0 {
+		writeError(w, "access tokens can't log out, revoke the token instead", http.StatusBadRequest)
+		return
+	}
+	err := store.DeleteSession(session, user)
+	if err != nil {
+		// the session was revoked in the meantime
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
 }
 
 func getHashedPasswd(password, salt []byte) []byte {
@@ -472,19 +660,37 @@ func authMiddleware(next http.Handler) http.Handler {
 			token := strings.Split(autorization, " ")
 			if len(token) == 2 && token[0] == "Bearer" {
 				token := token[1]
-				user, ok := tokenUserMap[token]
-				if ok {
-					if user.expired(config.Server.TokenTTL) {
-						writeError(w, "token expired", http.StatusUnauthorized)
+				if strings.HasPrefix(token, ACCESS_TOKEN_PREFIX) {
+					user, error, status := authorizeAccessToken(r, token)
+					if error != "" {
+						writeError(w, error, status)
 						return
 					}
-					logger.Info.Printf("user: %v\n", user)
 					r.Header.Del("username")
-					r.Header.Add("username", user.User)
-					if r.RequestURI == fmt.Sprintf("%v/logout", config.Server.ApiPath) {
-						r.Header.Del("token")
-						r.Header.Add("token", token)
+					r.Header.Add("username", user)
+					r.Header.Del("sessionId")
+					next.ServeHTTP(w, r)
+					return
+				}
+				session, err := store.SelectSessionByToken(hashToken(token))
+				if err == nil {
+					if session.expired(config.Server.TokenTTL) {
+						if err := store.DeleteSession(session.Id, session.User); err != nil {
+							logger.Error.Println(err)
+						}
+						writeError(w, "token expired", http.StatusUnauthorized)
+						return
+					}
+					if time.Since(session.LastSeenAt) > SESSION_TOUCH_INTERVAL {
+						if err := store.TouchSession(session.Id, time.Now()); err != nil {
+							logger.Error.Println(err)
+						}
 					}
+					logger.Info.Printf("user: %v\n", session.User)
+					r.Header.Del("username")
+					r.Header.Add("username", session.User)
+					r.Header.Del("sessionId")
+					r.Header.Add("sessionId", fmt.Sprint(session.Id))
 					next.ServeHTTP(w, r)
 				} else {
 					w.WriteHeader(http.StatusUnauthorized)
@@ -503,7 +709,8 @@ func corsMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		w.Header().Add("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Add("Access-Control-Expose-Headers", "ETag")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -512,24 +719,9 @@ func corsMiddleware(handler http.Handler) http.Handler {
 	})
 }
 
-func main() {
-	logger.Init()
-	err := config.readConfig()
-	if err != nil {
-		logger.Error.Fatalln(err)
-	}
-	err = db.Connect(config)
-	if err != nil {
-		logger.Error.Fatalln(err)
-	}
-	defer db.Disconnect()
-	tokenUserMap = make(map[string]TokenUser)
-	if config.Debug.TokenMap != nil {
-		for token, user := range config.Debug.TokenMap {
-			tokenUserMap[token] = NewTokenUser(user)
-		}
-	}
-
+// newRouter registers the handlers with their middlewares under the api path
+// of the config
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	// router for endpoints which manges the users
@@ -542,6 +734,30 @@ func main() {
 	// login
 	userManagementRouter.HandleFunc("/login", handleLogin).Methods("POST", "OPTIONS")
 
+	// router for feeds, which are subscribed by other applications and are
+	// authorized by an access token in the query
+	feedRouter := router.PathPrefix(config.Server.ApiPath).Subrouter()
+	feedRouter.Use(corsMiddleware)
+	feedRouter.Use(feedAuthMiddleware)
+
+	// iCalendar feed of the tasks
+	route := feedRouter.HandleFunc("/calendar.ics", handleCalendarGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_CALENDAR_READ)
+
+	// router for the event stream and the graph socket, whose token can be
+	// passed in the query
+	eventsRouter := router.PathPrefix(config.Server.ApiPath).Subrouter()
+	eventsRouter.Use(corsMiddleware)
+	eventsRouter.Use(queryTokenMiddleware)
+	eventsRouter.Use(authMiddleware)
+
+	// stream of events about changed tasks
+	route = eventsRouter.HandleFunc("/events", handleEventsGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// WebSocket for collaborative editing of the dependency graph
+	route = eventsRouter.HandleFunc("/tasks/graph/socket", handleTasksGraphSocket).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+
 	// Use API base Path for all routes
 	apiRouter := router.PathPrefix(config.Server.ApiPath).Subrouter()
 	// CORS middleware
@@ -551,23 +767,135 @@ func main() {
 	apiRouter.Use(authMiddleware)
 
 	// update user information
-	apiRouter.HandleFunc("/user", handleUserInfo).Methods("GET", "OPTIONS")
+	route = apiRouter.HandleFunc("/user", handleUserInfo).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_USER_READ)
 	// logout
 	apiRouter.HandleFunc("/logout", handleLogout).Methods("GET", "OPTIONS")
+	// get all sessions of the user
+	apiRouter.HandleFunc("/sessions", handleSessionsGet).Methods("GET", "OPTIONS")
+	// revoke a session
+	apiRouter.HandleFunc("/sessions/{sessionId}", handleSpecialSessionDelete).Methods("DELETE", "OPTIONS")
+	// get all access tokens of the user
+	apiRouter.HandleFunc("/tokens", handleTokensGet).Methods("GET", "OPTIONS")
+	// create an access token
+	apiRouter.HandleFunc("/tokens", handleTokensPost).Methods("POST", "OPTIONS")
+	// revoke an access token
+	apiRouter.HandleFunc("/tokens/{tokenId}", handleSpecialTokenDelete).Methods("DELETE", "OPTIONS")
+	// get all webhooks of the user
+	apiRouter.HandleFunc("/webhooks", handleWebhooksGet).Methods("GET", "OPTIONS")
+	// register a webhook
+	apiRouter.HandleFunc("/webhooks", handleWebhooksPost).Methods("POST", "OPTIONS")
+	// delete a webhook
+	apiRouter.HandleFunc("/webhooks/{webhookId}", handleSpecialWebhookDelete).Methods("DELETE", "OPTIONS")
+	// get the last deliveries of a webhook
+	apiRouter.HandleFunc("/webhooks/{webhookId}/deliveries", handleWebhookDeliveriesGet).Methods("GET", "OPTIONS")
+	// export the account as JSON archive
+	apiRouter.HandleFunc("/export", handleExportGet).Methods("GET", "OPTIONS")
+	// import tasks from a file
+	route = apiRouter.HandleFunc("/import", handleImportPost).Methods("POST", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
 	// get all tasks
-	apiRouter.HandleFunc("/tasks", handleTasksGet).Methods("GET", "OPTIONS")
+	route = apiRouter.HandleFunc("/tasks", handleTasksGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
 	// Create a new Task
-	apiRouter.HandleFunc("/tasks", handleTasksPost).Methods("POST", "OPTIONS")
+	route = apiRouter.HandleFunc("/tasks", handleTasksPost).Methods("POST", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// Create, update and delete tasks at once
+	route = apiRouter.HandleFunc("/tasks/batch", handleTasksBatchPost).Methods("POST", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// changes since a cursor for offline clients
+	route = apiRouter.HandleFunc("/sync", handleSyncGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// mutations of offline clients
+	route = apiRouter.HandleFunc("/sync", handleSyncPost).Methods("POST", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// get all tags
+	route = apiRouter.HandleFunc("/tags", handleTagsGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// create a tag
+	route = apiRouter.HandleFunc("/tags", handleTagsPost).Methods("POST", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// rename a tag or change its color
+	route = apiRouter.HandleFunc("/tags/{tagId}", handleSpecialTagPatch).Methods("PATCH", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// delete a tag
+	route = apiRouter.HandleFunc("/tags/{tagId}", handleSpecialTagDelete).Methods("DELETE", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	// full-text search over the tasks
+	route = apiRouter.HandleFunc("/tasks/search", handleTasksSearchGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// get all tasks, which can be done right now
+	route = apiRouter.HandleFunc("/tasks/ready", handleTasksReadyGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// get the dependency graph of all tasks
+	route = apiRouter.HandleFunc("/tasks/graph", handleTasksGraphGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
+	// get the critical path through the dependency graph
+	route = apiRouter.HandleFunc("/tasks/critical-path", handleTasksCriticalPathGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
 	// get a speical task by an id
-	apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTaskGet).Methods("GET", "OPTIONS")
+	route = apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTaskGet).Methods("GET", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_READ)
 	// Update a path
-	apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTasksPatch).Methods("PATCH", "OPTIONS")
+	route = apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTasksPatch).Methods("PATCH", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
 	// Delete a task
-	apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTasksDelete).Methods("DELETE", "OPTIONS")
+	route = apiRouter.HandleFunc("/tasks/{taskId}", handleSpecialTasksDelete).Methods("DELETE", "OPTIONS")
+	requireScope(route, SCOPE_TASKS_WRITE)
+	return router
+}
+
+func main() {
+	logger.Init()
+	err := config.readConfig()
+	if err != nil {
+		logger.Error.Fatalln(err)
+	}
+	store, err = NewStore(config)
+	if err != nil {
+		logger.Error.Fatalln(err)
+	}
+	defer store.Close()
+	migrator, hasSchema := store.(Migrator)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if !hasSchema {
+			logger.Error.Fatalf("database driver %s has no migrations", config.Database.Driver)
+		}
+		err = runMigrateCommand(migrator, os.Args[2:])
+		if err != nil {
+			logger.Error.Fatalln(err)
+		}
+		return
+	}
+	if hasSchema {
+		migrations, err := migrator.MigrateUp()
+		for _, migration := range migrations {
+			logger.Info.Printf("applied migration %04d_%s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			logger.Error.Fatalln(err)
+		}
+	}
+	ttl := time.Duration(config.Server.TokenTTL) * 24 * time.Hour
+	err = store.DeleteExpiredSessions(time.Now().Add(-ttl))
+	if err != nil {
+		logger.Error.Println(err)
+	}
+	if config.Debug.TokenMap != nil {
+		for token, user := range config.Debug.TokenMap {
+			err = store.UpsertSession(hashToken(token), user)
+			if err != nil {
+				logger.Error.Fatalln(err)
+			}
+		}
+	}
+	// deliveries, which were queued before a restart, are sent as well
+	go runWebhookWorker()
+	go runChangeLogCleanup()
 
 	addr := fmt.Sprintf("%s:%d", config.Server.Domain, config.Server.Port)
 	srv := &http.Server{
-		Handler:      router,
+		Handler:      newRouter(),
 		Addr:         addr,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
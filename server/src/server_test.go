@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	config.Server.ApiPath = "/api"
+	config.Server.TokenTTL = 7
+	config.Server.ChangeLogTTL = 30
+	os.Exit(m.Run())
+}
+
+// testClient sends requests to the api with the token of a registered user
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	token  string
+}
+
+// forEachStore runs the test against a new MemoryStore and a new sqlite
+// database, each with a registered user
+func forEachStore(t *testing.T, test func(t *testing.T, c *testClient)) {
+	for _, driver := range []string{DRIVER_MEMORY, DRIVER_SQLITE} {
+		t.Run(driver, func(t *testing.T) {
+			config.Database.Driver = driver
+			config.Database.Path = filepath.Join(t.TempDir(), "smart-todo.db")
+			var err error
+			store, err = NewStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if migrator, ok := store.(Migrator); ok {
+				if _, err := migrator.MigrateUp(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := &testClient{t: t, server: httptest.NewServer(newRouter())}
+			defer c.server.Close()
+			var registered struct {
+				Token string `json:"token"`
+			}
+			user := map[string]string{"username": "test", "fullname": "Test", "email": "test@example.com", "password": "secret"}
+			if status := c.request("POST", "/register", user, &registered); status != http.StatusOK {
+				t.Fatalf("register responded with %d", status)
+			}
+			c.token = registered.Token
+			test(t, c)
+		})
+	}
+}
+
+// request sends the body as JSON and decodes the response into result, if it
+// isn't nil. The status code is returned. Pairs of headers follow the result.
+func (c *testClient) request(method, path string, body interface{}, result interface{}, headers ...string) int {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	r, err := http.NewRequest(method, c.server.URL+config.Server.ApiPath+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", JSON_CONTENT_TYPE)
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			c.t.Fatalf("%s %s: can't decode the response: %v", method, path, err)
+		}
+	}
+	return response.StatusCode
+}
+
+// upload sends the data of a file with its content type and decodes the
+// response into result. The status code is returned.
+func (c *testClient) upload(path string, contentType string, data string, result interface{}) int {
+	c.t.Helper()
+	r, err := http.NewRequest("POST", c.server.URL+config.Server.ApiPath+path, strings.NewReader(data))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		c.t.Fatalf("POST %s: can't decode the response: %v", path, err)
+	}
+	return response.StatusCode
+}
+
+// importResponse is the response of an import with a result per item
+type importResponse struct {
+	Items []ImportResult `json:"items"`
+	Error string         `json:"error"`
+}
+
+// createTask creates a task and returns its id
+func (c *testClient) createTask(task map[string]interface{}) uint {
+	c.t.Helper()
+	var created struct {
+		Created uint `json:"created"`
+	}
+	if status := c.request("POST", "/tasks", task, &created); status != http.StatusOK {
+		c.t.Fatalf("create responded with %d", status)
+	}
+	return created.Created
+}
+
+func (c *testClient) getTask(id uint) Task {
+	c.t.Helper()
+	var task Task
+	if status := c.request("GET", fmt.Sprintf("/tasks/%d", id), nil, &task); status != http.StatusOK {
+		c.t.Fatalf("get task %d responded with %d", id, status)
+	}
+	return task
+}
+
+func (c *testClient) getTasks() []Task {
+	c.t.Helper()
+	var tasks []Task
+	if status := c.request("GET", "/tasks", nil, &tasks); status != http.StatusOK {
+		c.t.Fatalf("get tasks responded with %d", status)
+	}
+	return tasks
+}
+
+type errorResponse struct {
+	Error     string `json:"error"`
+	Cycle     []uint `json:"cycle"`
+	Operation *int   `json:"operation"`
+}
+
+func TestCreateTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		first := c.createTask(map[string]interface{}{"title": "first", "estimatedDuration": 30})
+		second := c.createTask(map[string]interface{}{
+			"title": "second", "previousTaskIds": []uint{first}, "tags": []string{"work"},
+		})
+		task := c.getTask(first)
+		if task.Title != "first" || task.EstimatedDuration != 30 || task.Status != STATUS_OPEN {
+			t.Errorf("created task is %+v", task)
+		}
+		if !reflect.DeepEqual(task.NextTaskIds, []uint{second}) {
+			t.Errorf("nextTaskIds of the previous task are %v", task.NextTaskIds)
+		}
+		if tags := c.getTask(second).Tags; !reflect.DeepEqual(tags, []string{"work"}) {
+			t.Errorf("tags are %v", tags)
+		}
+
+		tests := []struct {
+			task   map[string]interface{}
+			status int
+		}{
+			{map[string]interface{}{}, http.StatusBadRequest},
+			{map[string]interface{}{"title": "x", "estimatedDuration": -1}, http.StatusBadRequest},
+			{map[string]interface{}{"title": "x", "status": "unknown"}, http.StatusBadRequest},
+			{map[string]interface{}{"title": "x", "previousTaskIds": []uint{99}}, http.StatusBadRequest},
+		}
+		for _, test := range tests {
+			if status := c.request("POST", "/tasks", test.task, nil); status != test.status {
+				t.Errorf("create %v responded with %d, want %d", test.task, status, test.status)
+			}
+		}
+		if tasks := c.getTasks(); len(tasks) != 2 {
+			t.Errorf("%d tasks exist after invalid creates", len(tasks))
+		}
+	})
+}
+
+// the timestamps of a task follow its status
+func TestTaskStatus(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		id := c.createTask(map[string]interface{}{"title": "task"})
+		path := fmt.Sprintf("/tasks/%d", id)
+		if task := c.getTask(id); task.Status != STATUS_OPEN || task.StartedAt != "" || task.CompletedAt != "" {
+			t.Errorf("created task is %+v", task)
+		}
+		c.request("PATCH", path, map[string]interface{}{"status": STATUS_IN_PROGRESS}, nil)
+		started := c.getTask(id)
+		if started.StartedAt == "" || started.CompletedAt != "" {
+			t.Errorf("task in progress is %+v", started)
+		}
+		c.request("PATCH", path, map[string]interface{}{"status": STATUS_DONE}, nil)
+		if task := c.getTask(id); task.StartedAt != started.StartedAt || task.CompletedAt == "" {
+			t.Errorf("done task is %+v", task)
+		}
+		c.request("PATCH", path, map[string]interface{}{"status": STATUS_OPEN}, nil)
+		if task := c.getTask(id); task.StartedAt != "" || task.CompletedAt != "" {
+			t.Errorf("reopened task is %+v", task)
+		}
+		if status := c.request("PATCH", path, map[string]interface{}{"status": "finished"}, nil); status != http.StatusBadRequest {
+			t.Errorf("patch of an unknown status responded with %d", status)
+		}
+		done := c.createTask(map[string]interface{}{"title": "done", "status": STATUS_DONE})
+		if task := c.getTask(done); task.CompletedAt == "" {
+			t.Errorf("task created as done is %+v", task)
+		}
+	})
+}
+
+func TestPatchTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		id := c.createTask(map[string]interface{}{"title": "task", "estimatedDuration": 30})
+		path := fmt.Sprintf("/tasks/%d", id)
+		patch := map[string]interface{}{"title": "changed", "estimatedDuration": 0}
+		if status := c.request("PATCH", path, patch, nil); status != http.StatusOK {
+			t.Fatalf("patch responded with %d", status)
+		}
+		task := c.getTask(id)
+		if task.Title != "changed" || task.EstimatedDuration != 0 || task.Version != 2 {
+			t.Errorf("patched task is %+v", task)
+		}
+
+		var response errorResponse
+		status := c.request("PATCH", path, map[string]interface{}{"estimatedDuration": 1.5}, &response)
+		if status != http.StatusBadRequest || response.Error != "estimatedDuration must be a non-negative integer" {
+			t.Errorf("invalid patch responded with %d %s", status, response.Error)
+		}
+		if status := c.request("PATCH", "/tasks/99", map[string]interface{}{"title": "x"}, nil); status != http.StatusNotFound {
+			t.Errorf("patch of a missing task responded with %d", status)
+		}
+		if task := c.getTask(id); task.Title != "changed" || task.Version != 2 {
+			t.Errorf("rejected patches changed the task to %+v", task)
+		}
+	})
+}
+
+// a patch or delete with If-Match only succeeds for the current version
+func TestTaskIfMatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		id := c.createTask(map[string]interface{}{"title": "task"})
+		path := fmt.Sprintf("/tasks/%d", id)
+		etag := func() string {
+			r, _ := http.NewRequest("GET", c.server.URL+config.Server.ApiPath+path, nil)
+			r.Header.Set("Authorization", "Bearer "+c.token)
+			response, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			return response.Header.Get("ETag")
+		}
+		if tag := etag(); tag != `"1"` {
+			t.Errorf("ETag of a new task is %s", tag)
+		}
+		if status := c.request("PATCH", path, map[string]interface{}{"title": "changed"}, nil, "If-Match", `"1"`); status != http.StatusOK {
+			t.Fatalf("patch of the current version responded with %d", status)
+		}
+		if tag := etag(); tag != `"2"` {
+			t.Errorf("ETag of the patched task is %s", tag)
+		}
+
+		tests := []struct {
+			method  string
+			ifMatch string
+			status  int
+		}{
+			{"PATCH", `"1"`, http.StatusPreconditionFailed},
+			{"PATCH", `"1", "2"`, http.StatusPreconditionFailed},
+			{"PATCH", "2", http.StatusPreconditionFailed},
+			{"DELETE", `"1"`, http.StatusPreconditionFailed},
+			{"PATCH", "*", http.StatusOK},
+			{"DELETE", `"3"`, http.StatusOK},
+		}
+		for _, test := range tests {
+			status := c.request(test.method, path, map[string]interface{}{"title": "stale"}, nil, "If-Match", test.ifMatch)
+			if status != test.status {
+				t.Errorf("%s with If-Match %s responded with %d, want %d", test.method, test.ifMatch, status, test.status)
+			}
+		}
+		if tasks := c.getTasks(); len(tasks) != 0 {
+			t.Errorf("tasks after the delete are %+v", tasks)
+		}
+	})
+}
+
+// a dependency, which would create a cycle, is rejected with the cycle
+func TestTaskCycle(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		first := c.createTask(map[string]interface{}{"title": "first"})
+		second := c.createTask(map[string]interface{}{"title": "second", "previousTaskIds": []uint{first}})
+		third := c.createTask(map[string]interface{}{"title": "third", "previousTaskIds": []uint{second}})
+		before := c.getTasks()
+
+		tests := []struct {
+			id    uint
+			patch map[string]interface{}
+			cycle []uint
+		}{
+			{first, map[string]interface{}{"nextTaskIds": []uint{first}}, []uint{first, first}},
+			{first, map[string]interface{}{"previousTaskIds": []uint{third}}, []uint{first, second, third, first}},
+			{third, map[string]interface{}{"nextTaskIds": []uint{second}}, []uint{second, third, second}},
+		}
+		for _, test := range tests {
+			var response errorResponse
+			status := c.request("PATCH", fmt.Sprintf("/tasks/%d", test.id), test.patch, &response)
+			if status != http.StatusConflict || !reflect.DeepEqual(response.Cycle, test.cycle) {
+				t.Errorf("patch %v responded with %d and cycle %v, want %v", test.patch, status, response.Cycle, test.cycle)
+			}
+		}
+		var response errorResponse
+		create := map[string]interface{}{"title": "fourth", "previousTaskIds": []uint{third}, "nextTaskIds": []uint{first}}
+		status := c.request("POST", "/tasks", create, &response)
+		// the task, which is not yet inserted, has the id NEW_TASK_ID
+		cycle := []uint{NEW_TASK_ID, first, second, third, NEW_TASK_ID}
+		if status != http.StatusConflict || !reflect.DeepEqual(response.Cycle, cycle) {
+			t.Errorf("create %v responded with %d and cycle %v, want %v", create, status, response.Cycle, cycle)
+		}
+		if after := c.getTasks(); !reflect.DeepEqual(before, after) {
+			t.Errorf("rejected requests changed the tasks from %+v to %+v", before, after)
+		}
+	})
+}
+
+// both stores insert an edge only once, if the ids of a request repeat it
+func TestDuplicateDependencies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		first := c.createTask(map[string]interface{}{"title": "first"})
+		second := c.createTask(map[string]interface{}{"title": "second", "previousTaskIds": []uint{first, first}})
+		third := c.createTask(map[string]interface{}{"title": "third"})
+		patch := map[string]interface{}{"nextTaskIds": []uint{second, second}}
+		if status := c.request("PATCH", fmt.Sprintf("/tasks/%d", first), patch, nil); status != http.StatusOK {
+			t.Errorf("patch of the existing edge responded with %d", status)
+		}
+		patch = map[string]interface{}{"nextTaskIds": []uint{third, third}}
+		if status := c.request("PATCH", fmt.Sprintf("/tasks/%d", second), patch, nil); status != http.StatusOK {
+			t.Errorf("patch responded with %d", status)
+		}
+		var response batchResponse
+		status := c.request("POST", "/tasks/batch", map[string]interface{}{"operations": []interface{}{
+			map[string]interface{}{"action": "create", "tempId": "a", "task": map[string]interface{}{"title": "a"}},
+			map[string]interface{}{"action": "create", "task": map[string]interface{}{
+				"title": "b", "previousTaskIds": []interface{}{"a", "a", third, third},
+			}},
+			map[string]interface{}{"action": "update", "id": third, "task": map[string]interface{}{
+				"previousTaskIds": []interface{}{"a", second, "a", second},
+			}},
+		}}, &response)
+		if status != http.StatusOK {
+			t.Fatalf("batch responded with %d %+v", status, response.errorResponse)
+		}
+		a, b := response.Results[0].Id, response.Results[1].Id
+		expected := map[uint][]uint{first: {second}, second: {third}, third: {b}, a: {third, b}}
+		for id, next := range expected {
+			if got := c.getTask(id).NextTaskIds; !reflect.DeepEqual(got, next) {
+				t.Errorf("nextTaskIds of task %d are %v, want %v", id, got, next)
+			}
+		}
+	})
+}
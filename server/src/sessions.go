@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the last seen timestamp of a session is only updated after this interval,
+// so not every request results in a write
+const SESSION_TOUCH_INTERVAL = time.Minute
+
+// only the hash of a token is stored, so a leaked database doesn't contain
+// usable tokens
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// trustedProxy returns true, if the ip is in the trusted proxies of the config
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range config.Server.TrustedProxies {
+		// validated by the config
+		_, ipNet, err := net.ParseCIDR(network)
+		if err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns the ip of the client. Behind a trusted proxy it's the
+// last entry of the X-Forwarded-For header, which wasn't added by a trusted
+// proxy. The other entries can be set by the client.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+// sessionFromRequest returns the id of the session, which was set by the
+// authMiddleware
+func sessionFromRequest(r *http.Request) uint {
+	id, err := strconv.Atoi(r.Header.Get("sessionId"))
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+func handleSessionsGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	sessions, err := store.SelectSessions(user)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	current := sessionFromRequest(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == current
+	}
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func handleSpecialSessionDelete(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	idInt, err := strconv.Atoi(mux.Vars(r)["sessionId"])
+	if err != nil {
+		writeError(w, "Fail to get sessionId from requested path", http.StatusNotFound)
+		return
+	}
+	err = store.DeleteSession(uint(idInt), user)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
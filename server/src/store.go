@@ -0,0 +1,118 @@
+package main
+
+import "time"
+
+const (
+	DRIVER_POSTGRES = "postgres"
+	DRIVER_SQLITE   = "sqlite"
+	DRIVER_MEMORY   = "memory"
+)
+
+type TaskStore interface {
+	SelectAllTasks(user string, filter TaskFilter) ([]Task, error)
+	SelectOneSpecialTasks(id uint, user string) (Task, error)
+	// SelectPreviousTasks returns the previous tasks of the tasks, also the
+	// indirect ones, with their next tasks but without tags
+	SelectPreviousTasks(ids []uint, user string) ([]Task, error)
+	// SearchTasks returns the best matching tasks of a full-text search
+	SearchTasks(user string, query string, limit uint) ([]SearchResult, error)
+	InsertTask(task CreateTask, user string) (uint, error)
+	// UpdateTask and DeleteTask return a VersionError, if the version isn't 0
+	// and the task has another version
+	UpdateTask(id uint, patchTask CreateTask, patchKeys []string, version uint64, user string) error
+	DeleteTask(id uint, version uint64, user string) error
+	// LinkTasks adds the edge from the task to the next task, if it doesn't
+	// exist yet. Like UpdateTask, both tasks must exist and the edge must not
+	// create a cycle.
+	LinkTasks(id uint, nextTaskId uint, user string) error
+	// UnlinkTasks removes the edge from the task to the next task, if it
+	// exists
+	UnlinkTasks(id uint, nextTaskId uint, user string) error
+	// ApplyBatch applies all operations or none of them
+	ApplyBatch(operations []BatchOperation, user string) ([]BatchResult, error)
+	// ImportTasks inserts all tasks with the edges between them or none of
+	// them, the ids are returned in the order of the tasks. In the same
+	// transaction the tags are restored: missing tags are created and
+	// existing tags without color get the color. If profile isn't nil, the
+	// full name and email of the user are set.
+	ImportTasks(tasks []ImportTask, tags []Tag, profile *User, user string) ([]uint, error)
+
+	// SelectChanges returns the events of the tasks after the cursor since in
+	// the order of the change log, the ids of the events are their cursors.
+	// An ExpiredCursorError is returned, if changes after the cursor were
+	// deleted.
+	SelectChanges(user string, since uint64) ([]Event, error)
+	// LastChange returns the cursor of the last event of the user, which
+	// isn't older than the deleted changes
+	LastChange(user string) (uint64, error)
+	// DeleteChanges deletes the changes of all users, which were created
+	// before the time
+	DeleteChanges(createdBefore time.Time) error
+
+	SelectTags(user string) ([]Tag, error)
+	InsertTag(tag Tag, user string) (uint, error)
+	UpdateTag(id uint, patchTag Tag, patchKeys []string, user string) error
+	// DeleteTag removes the tag from all tasks
+	DeleteTag(id uint, user string) error
+}
+
+type UserStore interface {
+	InsertUser(user User) error
+	GetUser(username string) (User, error)
+	UpdateUserProfile(username string, fullname string, email string) error
+
+	InsertSession(tokenHash []byte, user string, userAgent string, ip string) (uint, error)
+	UpsertSession(tokenHash []byte, user string) error
+	SelectSessionByToken(tokenHash []byte) (Session, error)
+	SelectSessions(user string) ([]Session, error)
+	TouchSession(id uint, lastSeen time.Time) error
+	DeleteSession(id uint, user string) error
+	DeleteExpiredSessions(createdBefore time.Time) error
+
+	InsertAccessToken(tokenHash []byte, token AccessToken) (uint, error)
+	SelectAccessTokenByToken(tokenHash []byte) (AccessToken, error)
+	SelectAccessTokens(user string) ([]AccessToken, error)
+	TouchAccessToken(id uint, lastUsed time.Time) error
+	DeleteAccessToken(id uint, user string) error
+}
+
+type WebhookStore interface {
+	SelectWebhooks(user string) ([]Webhook, error)
+	InsertWebhook(webhook Webhook) (uint, error)
+	// DeleteWebhook deletes the webhook with its deliveries
+	DeleteWebhook(id uint, user string) error
+	// SelectDeliveries returns the last deliveries of the webhook, the newest
+	// first
+	SelectDeliveries(webhookId uint, user string, limit uint) ([]WebhookDelivery, error)
+	// SelectDueDeliveries returns the pending deliveries of all users, whose
+	// next attempt isn't after now, except of the deliveries of the skipped
+	// webhooks. They are ordered by their next attempt.
+	SelectDueDeliveries(now time.Time, skipWebhookIds []uint, limit uint) ([]DueDelivery, error)
+	// UpdateDelivery stores the result of an attempt
+	UpdateDelivery(delivery WebhookDelivery) error
+	// DeleteDeliveries deletes the delivered and failed deliveries, which were
+	// created before the time
+	DeleteDeliveries(createdBefore time.Time) error
+}
+
+// Store is the storage backend of the server, which is selected by the
+// driver in the config. The deliveries of the webhooks are queued with the
+// events of the tasks.
+type Store interface {
+	TaskStore
+	UserStore
+	WebhookStore
+	Close() error
+}
+
+func NewStore(conf Conf) (Store, error) {
+	if conf.Database.Driver == DRIVER_MEMORY {
+		return NewMemoryStore(), nil
+	}
+	db := &Db{}
+	err := db.Connect(conf)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
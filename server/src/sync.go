@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"smart-todo-server/graph"
+)
+
+// delta sync for offline clients. GET /sync returns the tasks, which were
+// created, updated or deleted since a cursor of the change log, POST /sync
+// applies the mutations, which a client queued while it was offline.
+
+const (
+	SYNC_STATUS_APPLIED = "applied"
+	// the task was changed or deleted in between, or the dependencies would
+	// contain a cycle
+	SYNC_STATUS_CONFLICT = "conflict"
+	// the mutation isn't valid
+	SYNC_STATUS_ERROR = "error"
+)
+
+// SyncChanges are the changes since a cursor, which is passed to the next
+// sync. The edges are the nextTaskIds of the tasks, so a task is updated, if
+// its next tasks changed.
+type SyncChanges struct {
+	Cursor  string `json:"cursor"`
+	Created []Task `json:"created"`
+	Updated []Task `json:"updated"`
+	Deleted []uint `json:"deleted"`
+}
+
+// a mutation of a client is an operation of a batch with a reference
+type syncMutation struct {
+	// chosen by the client, the result contains it
+	Ref string `json:"ref"`
+	batchRequestOperation
+}
+
+type syncRequest struct {
+	Mutations []syncMutation `json:"mutations"`
+}
+
+type SyncResult struct {
+	Ref    string `json:"ref"`
+	Status string `json:"status"` // one of the SYNC_STATUS_* constants
+	// the created, updated or deleted task
+	Id    uint   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	Cycle []uint `json:"cycle,omitempty"`
+	// the current task, if it was changed in between
+	Task *Task `json:"task,omitempty"`
+}
+
+// DeltaSync sorts the tasks of the changes into created, updated and deleted
+// tasks. Tasks, which were deleted after the changes were read, are skipped,
+// the next sync returns them as deleted.
+func DeltaSync(tasks []Task, changes []Event) SyncChanges {
+	created := make(map[uint]bool)
+	changed := make(map[uint]bool)
+	deleted := make(map[uint]bool)
+	result := SyncChanges{
+		Created: make([]Task, 0),
+		Updated: make([]Task, 0),
+		Deleted: make([]uint, 0),
+	}
+	for _, change := range changes {
+		switch change.Type {
+		case EVENT_TASK_CREATED:
+			created[change.TaskId] = true
+		case EVENT_TASK_DELETED:
+			if !deleted[change.TaskId] {
+				result.Deleted = append(result.Deleted, change.TaskId)
+			}
+			deleted[change.TaskId] = true
+		}
+		changed[change.TaskId] = true
+	}
+	for _, task := range tasks {
+		if !changed[task.Id] || deleted[task.Id] {
+			continue
+		}
+		if created[task.Id] {
+			result.Created = append(result.Created, task)
+		} else {
+			result.Updated = append(result.Updated, task)
+		}
+	}
+	return result
+}
+
+// selectChangedTasks returns the tasks of the changes with their flags. Only
+// the changed tasks and their previous tasks are loaded, for more changed
+// tasks than a page all tasks are loaded at once.
+func selectChangedTasks(user string, changes []Event) ([]Task, error) {
+	ids := make([]uint, 0)
+	seen := make(map[uint]bool)
+	for _, change := range changes {
+		if !seen[change.TaskId] {
+			seen[change.TaskId] = true
+			ids = append(ids, change.TaskId)
+		}
+	}
+	if len(ids) > TASKS_MAX_LIMIT {
+		tasks, err := store.SelectAllTasks(user, TaskFilter{})
+		if err != nil {
+			return nil, err
+		}
+		FlagTasks(tasks, time.Now())
+		return tasks, nil
+	}
+	tasks, err := store.SelectAllTasks(user, TaskFilter{Ids: ids})
+	if err != nil {
+		return nil, err
+	}
+	changed := make([]*Task, 0, len(tasks))
+	for i := range tasks {
+		changed = append(changed, &tasks[i])
+	}
+	return tasks, flagTasksOfUser(user, changed)
+}
+
+func handleSyncGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	var since uint64
+	full := true
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		full = false
+	}
+	// the changes are read before the tasks, so no change is missed
+	var changes []Event
+	var err error
+	cursor := since
+	if full {
+		cursor, err = store.LastChange(user)
+	} else {
+		changes, err = store.SelectChanges(user, since)
+		if len(changes) > 0 {
+			cursor = changes[len(changes)-1].Id
+		}
+	}
+	var cursorErr *ExpiredCursorError
+	if errors.As(err, &cursorErr) {
+		writeError(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tasks []Task
+	if full {
+		tasks, err = store.SelectAllTasks(user, TaskFilter{})
+		if err == nil {
+			FlagTasks(tasks, time.Now())
+		}
+	} else {
+		tasks, err = selectChangedTasks(user, changes)
+	}
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := SyncChanges{Created: tasks, Updated: make([]Task, 0), Deleted: make([]uint, 0)}
+	if !full {
+		result = DeltaSync(tasks, changes)
+	}
+	result.Cursor = strconv.FormatUint(cursor, 10)
+	json.NewEncoder(w).Encode(result)
+}
+
+// runChangeLogCleanup deletes the changes, which are older than the time to
+// live of the config, every hour until the server stops
+func runChangeLogCleanup() {
+	ttl := time.Duration(config.Server.ChangeLogTTL) * 24 * time.Hour
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+	for {
+		err := store.DeleteChanges(time.Now().UTC().Add(-ttl))
+		if err != nil {
+			logger.Error.Println(err)
+		}
+		<-cleanup.C
+	}
+}
+
+// applySyncMutation applies a mutation on its own, so a conflict doesn't
+// affect the other mutations. Like in a batch, a mutation can reference the
+// tasks of earlier creates by their temporary ids. tempIds are the temporary
+// ids of the earlier mutations, created maps the ones of the applied creates
+// to their ids.
+func applySyncMutation(
+	mutation syncMutation,
+	tempIds map[string]bool,
+	created map[string]uint,
+	user string,
+) SyncResult {
+	result := SyncResult{Ref: mutation.Ref, Status: SYNC_STATUS_APPLIED}
+	operation, error := parseBatchOperation(mutation.batchRequestOperation, tempIds)
+	result.Id = operation.Id
+	if error != "" {
+		result.Status = SYNC_STATUS_ERROR
+		result.Error = error
+		return result
+	}
+	// fails, if the create of a temporary id wasn't applied
+	if err := operation.resolve(created); err != nil {
+		result.Status = SYNC_STATUS_ERROR
+		result.Error = err.Error()
+		return result
+	}
+	result.Id = operation.Id
+	results, err := store.ApplyBatch([]BatchOperation{operation}, user)
+	if err == nil {
+		result.Id = results[0].Id
+		if operation.TempId != "" {
+			created[operation.TempId] = result.Id
+		}
+		return result
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		result.Error = batchErr.Err.Error()
+	} else {
+		result.Error = err.Error()
+	}
+	var cycleErr *graph.CycleError
+	var versionErr *VersionError
+	var notFoundErr *TaskNotFoundError
+	result.Status = SYNC_STATUS_CONFLICT
+	if errors.As(err, &versionErr) {
+		task, err := store.SelectOneSpecialTasks(operation.Id, user)
+		if err == nil {
+			err = flagTasksOfUser(user, []*Task{&task})
+		}
+		if err != nil {
+			logger.Error.Println(err)
+		} else {
+			result.Task = &task
+		}
+	} else if errors.As(err, &cycleErr) {
+		result.Cycle = cycleErr.Path
+	} else if !errors.As(err, &notFoundErr) {
+		logger.Error.Println(err)
+		result.Status = SYNC_STATUS_ERROR
+	}
+	return result
+}
+
+func handleSyncPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	var request syncRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, "Can't parse json body", http.StatusBadRequest)
+		return
+	}
+	results := make([]SyncResult, 0, len(request.Mutations))
+	tempIds := make(map[string]bool)
+	created := make(map[string]uint)
+	for _, mutation := range request.Mutations {
+		results = append(results, applySyncMutation(mutation, tempIds, created, user))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type syncResponse struct {
+	Cursor  string `json:"cursor"`
+	Created []Task `json:"created"`
+	Updated []Task `json:"updated"`
+	Deleted []uint `json:"deleted"`
+}
+
+func TestSync(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		first := c.createTask(map[string]interface{}{"title": "first"})
+		var full syncResponse
+		if status := c.request("GET", "/sync", nil, &full); status != http.StatusOK {
+			t.Fatalf("sync responded with %d", status)
+		}
+		if len(full.Created) != 1 || full.Cursor == "" {
+			t.Fatalf("full sync returned %+v", full)
+		}
+
+		second := c.createTask(map[string]interface{}{"title": "second"})
+		c.request("PATCH", fmt.Sprintf("/tasks/%d", first), map[string]interface{}{"title": "changed"}, nil)
+		var changes syncResponse
+		if status := c.request("GET", "/sync?since="+full.Cursor, nil, &changes); status != http.StatusOK {
+			t.Fatalf("sync since a cursor responded with %d", status)
+		}
+		if len(changes.Created) != 1 || changes.Created[0].Id != second ||
+			len(changes.Updated) != 1 || changes.Updated[0].Title != "changed" || len(changes.Deleted) != 0 {
+			t.Errorf("changes since the cursor are %+v", changes)
+		}
+		if status := c.request("GET", "/sync?since=x", nil, nil); status != http.StatusBadRequest {
+			t.Errorf("sync with an invalid cursor responded with %d", status)
+		}
+
+		var results struct {
+			Results []struct {
+				Ref    string `json:"ref"`
+				Status string `json:"status"`
+				Id     uint   `json:"id"`
+				Cycle  []uint `json:"cycle"`
+				Task   *Task  `json:"task"`
+			} `json:"results"`
+		}
+		status := c.request("POST", "/sync", map[string]interface{}{"mutations": []interface{}{
+			map[string]interface{}{"ref": "m1", "action": "create", "tempId": "t", "task": map[string]interface{}{"title": "offline"}},
+			map[string]interface{}{"ref": "m2", "action": "link", "id": "t", "nextTaskId": first},
+			map[string]interface{}{"ref": "m3", "action": "update", "id": first, "version": 1, "task": map[string]interface{}{"title": "old"}},
+			map[string]interface{}{"ref": "m4", "action": "link", "id": first, "nextTaskId": "t"},
+			map[string]interface{}{"ref": "m5", "action": "link", "id": "u", "nextTaskId": first},
+		}}, &results)
+		if status != http.StatusOK || len(results.Results) != 5 {
+			t.Fatalf("sync mutations responded with %d %+v", status, results)
+		}
+		created := results.Results[0].Id
+		expected := []struct {
+			status string
+			id     uint
+		}{
+			{SYNC_STATUS_APPLIED, created},
+			{SYNC_STATUS_APPLIED, created},
+			{SYNC_STATUS_CONFLICT, first},
+			{SYNC_STATUS_CONFLICT, first},
+			{SYNC_STATUS_ERROR, 0},
+		}
+		for i, result := range results.Results {
+			if result.Status != expected[i].status || result.Id != expected[i].id {
+				t.Errorf("result %s is %s of %d, want %s of %d", result.Ref, result.Status, result.Id, expected[i].status, expected[i].id)
+			}
+		}
+		if task := results.Results[2].Task; task == nil || task.Title != "changed" {
+			t.Errorf("conflict of an old version returned the task %+v", task)
+		}
+		if cycle := results.Results[3].Cycle; !reflect.DeepEqual(cycle, []uint{first, created, first}) {
+			t.Errorf("conflict of a cycle returned %v", cycle)
+		}
+		if next := c.getTask(created).NextTaskIds; !reflect.DeepEqual(next, []uint{first}) {
+			t.Errorf("nextTaskIds of the created task are %v", next)
+		}
+	})
+}
+
+// a delta sync only loads the changed tasks, but their flags depend on the
+// unchanged previous tasks
+func TestSyncFlagsOfChangedTasks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		late := c.createTask(map[string]interface{}{"title": "late", "date": "2099-06-01"})
+		between := c.createTask(map[string]interface{}{"title": "between", "previousTaskIds": []uint{late}})
+		var full syncResponse
+		c.request("GET", "/sync", nil, &full)
+
+		due := c.createTask(map[string]interface{}{
+			"title": "due", "dueDate": "2099-05-01", "previousTaskIds": []uint{between},
+		})
+		var changes syncResponse
+		if status := c.request("GET", "/sync?since="+full.Cursor, nil, &changes); status != http.StatusOK {
+			t.Fatalf("sync responded with %d", status)
+		}
+		if len(changes.Created) != 1 || changes.Created[0].Id != due {
+			t.Fatalf("created tasks are %+v", changes.Created)
+		}
+		if conflicts := changes.Created[0].DueConflicts; !reflect.DeepEqual(conflicts, []uint{late}) {
+			t.Errorf("due conflicts of the created task are %v", conflicts)
+		}
+		// the next tasks of the previous task changed
+		if len(changes.Updated) != 1 || changes.Updated[0].Id != between {
+			t.Errorf("updated tasks are %+v", changes.Updated)
+		}
+	})
+}
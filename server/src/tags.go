@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// tags of the tasks and expressions over them
+
+const (
+	TAG_EXPRESSION_TAG = "tag"
+	TAG_EXPRESSION_AND = "AND"
+	TAG_EXPRESSION_OR  = "OR"
+	TAG_EXPRESSION_NOT = "NOT"
+)
+
+// TagExpression is a tree of tag names combined by AND, OR and NOT
+type TagExpression struct {
+	Op       string
+	Tag      string
+	Operands []*TagExpression
+}
+
+// Matches evaluates the expression for the tags of a task
+func (e *TagExpression) Matches(tags []string) bool {
+	switch e.Op {
+	case TAG_EXPRESSION_TAG:
+		for _, tag := range tags {
+			if tag == e.Tag {
+				return true
+			}
+		}
+		return false
+	case TAG_EXPRESSION_NOT:
+		return !e.Operands[0].Matches(tags)
+	case TAG_EXPRESSION_AND:
+		for _, operand := range e.Operands {
+			if !operand.Matches(tags) {
+				return false
+			}
+		}
+		return true
+	case TAG_EXPRESSION_OR:
+		for _, operand := range e.Operands {
+			if operand.Matches(tags) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func tokenizeTagExpression(expression string) []string {
+	tokens := make([]string, 0)
+	current := ""
+	for _, r := range expression {
+		if unicode.IsSpace(r) || r == '(' || r == ')' {
+			if current != "" {
+				tokens = append(tokens, current)
+				current = ""
+			}
+			if r == '(' || r == ')' {
+				tokens = append(tokens, string(r))
+			}
+			continue
+		}
+		current += string(r)
+	}
+	if current != "" {
+		tokens = append(tokens, current)
+	}
+	return tokens
+}
+
+// tagExpressionParser is a recursive descent parser of the grammar
+//
+//	or  = and { "OR" and }
+//	and = not { ["AND"] not }
+//	not = "NOT" not | "(" or ")" | tag
+//
+// the operators are case insensitive
+type tagExpressionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagExpressionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagExpressionParser) isOperator(op string) bool {
+	return strings.ToUpper(p.peek()) == op
+}
+
+func (p *tagExpressionParser) parseOr() (*TagExpression, error) {
+	operand, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	operands := []*TagExpression{operand}
+	for p.isOperator(TAG_EXPRESSION_OR) {
+		p.pos++
+		operand, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &TagExpression{Op: TAG_EXPRESSION_OR, Operands: operands}, nil
+}
+
+func (p *tagExpressionParser) parseAnd() (*TagExpression, error) {
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	operands := []*TagExpression{operand}
+	for p.peek() != "" && p.peek() != ")" && !p.isOperator(TAG_EXPRESSION_OR) {
+		if p.isOperator(TAG_EXPRESSION_AND) {
+			p.pos++
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &TagExpression{Op: TAG_EXPRESSION_AND, Operands: operands}, nil
+}
+
+func (p *tagExpressionParser) parseNot() (*TagExpression, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, errors.New("Unexpected end of tag expression")
+	case p.isOperator(TAG_EXPRESSION_NOT):
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &TagExpression{Op: TAG_EXPRESSION_NOT, Operands: []*TagExpression{operand}}, nil
+	case token == "(":
+		p.pos++
+		expression, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("Missing ')' in tag expression")
+		}
+		p.pos++
+		return expression, nil
+	case !ValidateTagName(token):
+		return nil, errors.New(fmt.Sprintf("Unexpected '%s' in tag expression", token))
+	}
+	p.pos++
+	return &TagExpression{Op: TAG_EXPRESSION_TAG, Tag: token}, nil
+}
+
+// ParseTagExpression parses expressions like "work AND NOT (blocked OR
+// waiting)". Tags next to each other are combined by AND.
+func ParseTagExpression(expression string) (*TagExpression, error) {
+	parser := tagExpressionParser{tokens: tokenizeTagExpression(expression)}
+	result, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek() != "" {
+		return nil, errors.New(fmt.Sprintf("Unexpected '%s' in tag expression", parser.peek()))
+	}
+	return result, nil
+}
+
+// normalizeTags removes duplicate tag names and sorts them
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func handleTagsGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	tags, err := store.SelectTags(user)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+// parsePatchTag reads the name and color of a tag, like parsePatchTask
+func parsePatchTag(patchObj map[string]interface{}) (Tag, []string, string) {
+	patchTag := Tag{}
+	patchKeys := make([]string, 0)
+	var error string
+	if name, ok := patchObj["name"]; ok {
+		if v, ok := name.(string); ok && ValidateTagName(v) {
+			patchTag.Name = v
+			patchKeys = append(patchKeys, "name")
+		} else {
+			error = "name must not be empty, contain whitespace or parentheses or be AND, OR or NOT"
+		}
+	}
+	if color, ok := patchObj["color"]; ok {
+		if color == nil {
+			color = ""
+		}
+		if v, ok := color.(string); ok && ValidateColor(v) {
+			patchTag.Color = v
+			patchKeys = append(patchKeys, "color")
+		} else {
+			error = "color must be like #rrggbb"
+		}
+	}
+	return patchTag, patchKeys, error
+}
+
+func handleTagsPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	patchObj := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&patchObj); err != nil {
+		writeError(w, "Can't parse json body", http.StatusBadRequest)
+		return
+	}
+	tag, _, error := parsePatchTag(patchObj)
+	if error == "" && tag.Name == "" {
+		error = "name is missing"
+	}
+	if error != "" {
+		writeError(w, error, http.StatusBadRequest)
+		return
+	}
+	id, err := store.InsertTag(tag, user)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]uint{"created": id})
+}
+
+func parseTagId(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	idInt, err := strconv.Atoi(mux.Vars(r)["tagId"])
+	if err != nil {
+		writeError(w, "Fail to get tagId from requested path", http.StatusNotFound)
+		return 0, false
+	}
+	return uint(idInt), true
+}
+
+func handleSpecialTagPatch(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	id, ok := parseTagId(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	patchObj := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&patchObj); err != nil {
+		writeError(w, "Can't parse json body", http.StatusBadRequest)
+		return
+	}
+	tag, keys, error := parsePatchTag(patchObj)
+	if error != "" {
+		writeError(w, error, http.StatusBadRequest)
+		return
+	}
+	err := store.UpdateTag(id, tag, keys, user)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else if strings.Contains(err.Error(), "already exists") {
+			writeError(w, err.Error(), http.StatusConflict)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleSpecialTagDelete(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	id, ok := parseTagId(w, r)
+	if !ok {
+		return
+	}
+	err := store.DeleteTag(id, user)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// formatTagExpression prints the tree of an expression in prefix notation
+func formatTagExpression(e *TagExpression) string {
+	if e.Op == TAG_EXPRESSION_TAG {
+		return e.Tag
+	}
+	operands := make([]string, 0, len(e.Operands))
+	for _, operand := range e.Operands {
+		operands = append(operands, formatTagExpression(operand))
+	}
+	return "(" + e.Op + " " + strings.Join(operands, " ") + ")"
+}
+
+func TestParseTagExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		tree       string
+		valid      bool
+	}{
+		{"work", "work", true},
+		{"work home", "(AND work home)", true},
+		{"work and home", "(AND work home)", true},
+		{"work OR home", "(OR work home)", true},
+		{"a OR b c", "(OR a (AND b c))", true},
+		{"a b OR c", "(OR (AND a b) c)", true},
+		{"NOT work", "(NOT work)", true},
+		{"not not work", "(NOT (NOT work))", true},
+		{"work AND NOT (blocked OR waiting)", "(AND work (NOT (OR blocked waiting)))", true},
+		{"(a)(b)", "(AND a b)", true},
+		{"", "", false},
+		{"AND", "", false},
+		{"work AND", "", false},
+		{"work OR", "", false},
+		{"NOT", "", false},
+		{"(work", "", false},
+		{"work)", "", false},
+		{"()", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			expression, err := ParseTagExpression(test.expression)
+			if test.valid != (err == nil) {
+				t.Fatalf("ParseTagExpression() returned %v, want valid %v", err, test.valid)
+			}
+			if test.valid && formatTagExpression(expression) != test.tree {
+				t.Errorf("ParseTagExpression() = %s, want %s", formatTagExpression(expression), test.tree)
+			}
+		})
+	}
+}
+
+func TestTagExpressionMatches(t *testing.T) {
+	tests := []struct {
+		expression string
+		tags       []string
+		matches    bool
+	}{
+		{"work", []string{"work"}, true},
+		{"work", []string{}, false},
+		{"work home", []string{"work"}, false},
+		{"work home", []string{"home", "work"}, true},
+		{"work OR home", []string{"home"}, true},
+		{"NOT work", []string{"home"}, true},
+		{"work AND NOT (blocked OR waiting)", []string{"work", "waiting"}, false},
+		{"work AND NOT (blocked OR waiting)", []string{"work", "later"}, true},
+	}
+	for _, test := range tests {
+		expression, err := ParseTagExpression(test.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expression.Matches(test.tags) != test.matches {
+			t.Errorf("%s matches %v = %v, want %v", test.expression, test.tags, !test.matches, test.matches)
+		}
+	}
+}
+
+func TestTaskTags(t *testing.T) {
+	forEachStore(t, func(t *testing.T, c *testClient) {
+		both := c.createTask(map[string]interface{}{"title": "both", "tags": []string{"work", "urgent"}})
+		work := c.createTask(map[string]interface{}{"title": "work", "tags": []string{"work"}})
+		none := c.createTask(map[string]interface{}{"title": "none"})
+		tests := []struct {
+			query string
+			ids   []uint
+		}{
+			{"work", []uint{both, work}},
+			{"work AND NOT urgent", []uint{work}},
+			{"urgent OR NOT work", []uint{both, none}},
+			{"unknown", []uint{}},
+		}
+		for _, test := range tests {
+			var tasks []Task
+			if status := c.request("GET", "/tasks?tags="+url.QueryEscape(test.query), nil, &tasks); status != http.StatusOK {
+				t.Errorf("%s responded with %d", test.query, status)
+				continue
+			}
+			ids := make([]uint, 0, len(tasks))
+			for _, task := range tasks {
+				ids = append(ids, task.Id)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("%s returned %v, want %v", test.query, ids, test.ids)
+			}
+		}
+		if status := c.request("GET", "/tasks?tags="+url.QueryEscape("work AND"), nil, nil); status != http.StatusBadRequest {
+			t.Errorf("invalid expression responded with %d", status)
+		}
+
+		// the tags of the tasks follow a rename and a delete
+		var tags []Tag
+		c.request("GET", "/tags", nil, &tags)
+		ids := make(map[string]uint)
+		for _, tag := range tags {
+			ids[tag.Name] = tag.Id
+		}
+		if len(tags) != 2 || ids["work"] == 0 || ids["urgent"] == 0 {
+			t.Fatalf("tags are %+v", tags)
+		}
+		status := c.request("PATCH", fmt.Sprintf("/tags/%d", ids["work"]), map[string]interface{}{"name": "urgent"}, nil)
+		if status != http.StatusConflict {
+			t.Errorf("rename to an existing name responded with %d", status)
+		}
+		status = c.request("PATCH", fmt.Sprintf("/tags/%d", ids["work"]), map[string]interface{}{"name": "job"}, nil)
+		if status != http.StatusOK {
+			t.Errorf("rename responded with %d", status)
+		}
+		if status := c.request("DELETE", fmt.Sprintf("/tags/%d", ids["urgent"]), nil, nil); status != http.StatusOK {
+			t.Errorf("delete responded with %d", status)
+		}
+		if tags := c.getTask(both).Tags; !reflect.DeepEqual(tags, []string{"job"}) {
+			t.Errorf("tags of the task are %v", tags)
+		}
+	})
+}
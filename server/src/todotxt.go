@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// todo.txt (https://github.com/todotxt/todo.txt) export and import of the
+// tasks. Besides the format, the following key:value pairs are used:
+//
+//	t:yyyy-mm-dd     date of the task (threshold date)
+//	time:hh:mm       time of the task
+//	due:yyyy-mm-dd   due date
+//	duetime:hh:mm    due time
+//	pri:A            priority of done tasks
+//	rrule:rule       recurrence rule like FREQ=WEEKLY;BYDAY=MO
+//	dur:minutes      estimated duration
+//	status:value     in_progress or cancelled, done is marked by a leading x
+//	id:n next:n,m    dependencies
+//
+// The priorities high, medium and low are (A), (B) and (C), lower priorities
+// are imported as low. The location is written as context with spaces
+// replaced by underscores, the tags as projects. The description and if the
+// next occurrence gets the next tasks aren't exported.
+
+const TODO_TXT_CONTENT_TYPE = "text/plain"
+
+var todoTxtPriorityRegex = regexp.MustCompile(`^\([A-Z]\)$`)
+
+var todoTxtPriorities = map[string]string{
+	PRIORITY_HIGH:   "A",
+	PRIORITY_MEDIUM: "B",
+	PRIORITY_LOW:    "C",
+}
+
+func priorityOfTodoTxt(letter string) string {
+	for priority, l := range todoTxtPriorities {
+		if l == letter {
+			return priority
+		}
+	}
+	return PRIORITY_LOW
+}
+
+func isTodoTxtDate(token string) bool {
+	_, err := time.Parse("2006-01-02", token)
+	return err == nil
+}
+
+// RenderTodoTxt renders one line per task
+func RenderTodoTxt(tasks []Task) string {
+	// tasks with dependencies, only they need an id
+	linked := make(map[uint]bool)
+	for _, task := range tasks {
+		for _, nt := range task.NextTaskIds {
+			linked[task.Id] = true
+			linked[nt] = true
+		}
+	}
+	var builder strings.Builder
+	for _, task := range tasks {
+		parts := make([]string, 0)
+		if isResolved(&task) {
+			parts = append(parts, "x")
+			if task.CompletedAt != "" {
+				completedAt, err := time.Parse(time.RFC3339, task.CompletedAt)
+				if err == nil {
+					parts = append(parts, completedAt.Local().Format("2006-01-02"))
+				}
+			}
+		} else if task.Priority != "" {
+			parts = append(parts, "("+todoTxtPriorities[task.Priority]+")")
+		}
+		parts = append(parts, strings.Join(strings.Fields(task.Title), " "))
+		for _, tag := range task.Tags {
+			parts = append(parts, "+"+tag)
+		}
+		if task.Location != "" {
+			parts = append(parts, "@"+strings.Join(strings.Fields(task.Location), "_"))
+		}
+		if task.Date != "" {
+			parts = append(parts, "t:"+task.Date)
+		}
+		if task.Time != "" {
+			parts = append(parts, "time:"+task.Time)
+		}
+		if task.DueDate != "" {
+			parts = append(parts, "due:"+task.DueDate)
+		}
+		if task.DueTime != "" {
+			parts = append(parts, "duetime:"+task.DueTime)
+		}
+		if task.EstimatedDuration > 0 {
+			parts = append(parts, fmt.Sprintf("dur:%d", task.EstimatedDuration))
+		}
+		if task.Recurrence != "" {
+			parts = append(parts, "rrule:"+task.Recurrence)
+		}
+		if isResolved(&task) && task.Priority != "" {
+			parts = append(parts, "pri:"+todoTxtPriorities[task.Priority])
+		}
+		if task.Status == STATUS_IN_PROGRESS || task.Status == STATUS_CANCELLED {
+			parts = append(parts, "status:"+task.Status)
+		}
+		if linked[task.Id] {
+			parts = append(parts, fmt.Sprintf("id:%d", task.Id))
+		}
+		if len(task.NextTaskIds) > 0 {
+			ids := make([]string, 0, len(task.NextTaskIds))
+			for _, nt := range task.NextTaskIds {
+				ids = append(ids, fmt.Sprint(nt))
+			}
+			parts = append(parts, "next:"+strings.Join(ids, ","))
+		}
+		builder.WriteString(strings.Join(parts, " "))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// parseTodoTxtLine converts a line into a task, the id and the references of
+// the next tasks are returned as well
+func parseTodoTxtLine(line string) (ImportTask, string, []string, error) {
+	task := ImportTask{}
+	tokens := strings.Fields(line)
+	if len(tokens) > 0 && tokens[0] == "x" {
+		task.Task.Status = STATUS_DONE
+		tokens = tokens[1:]
+		if len(tokens) > 0 && isTodoTxtDate(tokens[0]) {
+			completedAt, _ := time.ParseInLocation("2006-01-02", tokens[0], time.Local)
+			task.CompletedAt = sql.NullTime{Time: completedAt, Valid: true}
+			tokens = tokens[1:]
+		}
+	} else if len(tokens) > 0 && todoTxtPriorityRegex.MatchString(tokens[0]) {
+		task.Task.Priority = priorityOfTodoTxt(tokens[0][1:2])
+		tokens = tokens[1:]
+	}
+	// creation date
+	if len(tokens) > 0 && isTodoTxtDate(tokens[0]) {
+		tokens = tokens[1:]
+	}
+
+	var id string
+	var nextRefs []string
+	title := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		key, value, found := strings.Cut(token, ":")
+		if strings.HasPrefix(token, "@") && len(token) > 1 && task.Task.Location == "" {
+			task.Task.Location = strings.ReplaceAll(token[1:], "_", " ")
+			continue
+		}
+		if strings.HasPrefix(token, "+") && ValidateTagName(token[1:]) {
+			task.Task.Tags = append(task.Task.Tags, token[1:])
+			continue
+		}
+		if !found || value == "" {
+			title = append(title, token)
+			continue
+		}
+		switch key {
+		case "t":
+			task.Task.Date = value
+		case "time":
+			task.Task.Time = value
+		case "due":
+			task.Task.DueDate = value
+		case "duetime":
+			task.Task.DueTime = value
+		case "rrule":
+			task.Task.Recurrence = value
+		case "pri":
+			if len(value) != 1 || value[0] < 'A' || value[0] > 'Z' {
+				return task, "", nil, errors.New(fmt.Sprintf("Invalid priority '%s'", value))
+			}
+			task.Task.Priority = priorityOfTodoTxt(value)
+		case "dur":
+			duration, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return task, "", nil, errors.New(fmt.Sprintf("Invalid duration '%s'", value))
+			}
+			task.Task.EstimatedDuration = uint(duration)
+		case "status":
+			if value != STATUS_IN_PROGRESS && value != STATUS_CANCELLED {
+				return task, "", nil, errors.New(fmt.Sprintf("Invalid status '%s'", value))
+			}
+			if value == STATUS_CANCELLED || task.Task.Status != STATUS_DONE {
+				task.Task.Status = value
+			}
+		case "id":
+			id = value
+		case "next":
+			nextRefs = strings.Split(value, ",")
+		default:
+			title = append(title, token)
+		}
+	}
+	task.Task.Title = strings.Join(title, " ")
+	if !ValidateCreateTask(&task.Task) {
+		return task, id, nextRefs, errors.New("Task is not valid")
+	}
+	return task, id, nextRefs, nil
+}
+
+// ImportTodoTxt converts the lines of a todo.txt file into tasks, empty
+// lines are skipped. Lines without id are referenced by their line number.
+func ImportTodoTxt(data string) ([]ImportTask, []ImportResult, bool) {
+	tasks := make([]ImportTask, 0)
+	results := make([]ImportResult, 0)
+	ids := make([]string, 0)
+	nextRefs := make([][]string, 0)
+	valid := true
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		task, id, next, err := parseTodoTxtLine(line)
+		result := ImportResult{Index: len(results), Ref: id}
+		if id == "" {
+			result.Ref = fmt.Sprintf("line %d", i+1)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			valid = false
+		}
+		tasks = append(tasks, task)
+		results = append(results, result)
+		ids = append(ids, id)
+		nextRefs = append(nextRefs, next)
+	}
+	if !linkImportTasks(tasks, results, ids, nextRefs) {
+		valid = false
+	}
+	if valid {
+		valid = checkImportCycle(tasks, results)
+	}
+	return tasks, results, valid
+}
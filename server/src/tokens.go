@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// access tokens start with this prefix, so they can be distinguished from the
+// tokens of a session
+const ACCESS_TOKEN_PREFIX = "pat_"
+
+const (
+	SCOPE_TASKS_READ  = "tasks:read"
+	SCOPE_TASKS_WRITE = "tasks:write"
+	SCOPE_USER_READ   = "user:read"
+	// subscribe to the calendar feed
+	SCOPE_CALENDAR_READ = "calendar:read"
+)
+
+var validScopes = []string{
+	SCOPE_TASKS_READ,
+	SCOPE_TASKS_WRITE,
+	SCOPE_USER_READ,
+	SCOPE_CALENDAR_READ,
+}
+
+// scope an access token needs for a route, routes without a scope can only be
+// used with the token of a session
+var routeScopes = make(map[*mux.Route]string)
+
+// requireScope allows access tokens with the scope to use the route
+func requireScope(route *mux.Route, scope string) {
+	routeScopes[route] = scope
+}
+
+func ValidateScope(scope string) bool {
+	for _, s := range validScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeAccessToken checks the access token for the request. It returns
+// the user of the token or an error message and the http status.
+func authorizeAccessToken(r *http.Request, token string) (string, string, int) {
+	accessToken, err := store.SelectAccessTokenByToken(hashToken(token))
+	if err != nil {
+		return "", "invalid token", http.StatusUnauthorized
+	}
+	if accessToken.expired() {
+		return "", "token expired", http.StatusUnauthorized
+	}
+	scope, ok := routeScopes[mux.CurrentRoute(r)]
+	if !ok {
+		return "", "endpoint can't be used with an access token", http.StatusForbidden
+	}
+	if !accessToken.hasScope(scope) {
+		return "", fmt.Sprintf("access token needs the scope %s", scope), http.StatusForbidden
+	}
+	now := time.Now()
+	if accessToken.LastUsedAt == nil || now.Sub(*accessToken.LastUsedAt) > SESSION_TOUCH_INTERVAL {
+		if err := store.TouchAccessToken(accessToken.Id, now); err != nil {
+			logger.Error.Println(err)
+		}
+	}
+	return accessToken.User, "", 0
+}
+
+func handleTokensGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	tokens, err := store.SelectAccessTokens(user)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func handleTokensPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	var createObj struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays uint     `json:"expiresInDays"` // 0 means never
+	}
+	err := json.NewDecoder(r.Body).Decode(&createObj)
+	if err != nil {
+		writeError(w, "fail to parse json body", http.StatusBadRequest)
+		return
+	}
+	if createObj.Name == "" {
+		writeError(w, "name must not be emtpy", http.StatusBadRequest)
+		return
+	}
+	if len(createObj.Scopes) == 0 {
+		writeError(w, "token needs at least one scope", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range createObj.Scopes {
+		if !ValidateScope(scope) {
+			writeError(
+				w,
+				fmt.Sprintf("unknown scope '%s', must be one of %s", scope, strings.Join(validScopes, ", ")),
+				http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	tokenBytes, err := getSalt(32)
+	if err != nil {
+		writeError(w, fmt.Sprintf("fail to get token: %v", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	tokenStr := ACCESS_TOKEN_PREFIX + hex.EncodeToString(tokenBytes)
+	token := AccessToken{
+		User:      user,
+		Name:      createObj.Name,
+		Scopes:    createObj.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if createObj.ExpiresInDays > 0 {
+		expiresAt := token.CreatedAt.Add(time.Duration(createObj.ExpiresInDays) * 24 * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+	token.Id, err = store.InsertAccessToken(hashToken(tokenStr), token)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, "Failed to store access token", http.StatusInternalServerError)
+		return
+	}
+	// the token is only shown once
+	json.NewEncoder(w).Encode(struct {
+		AccessToken
+		Token string `json:"token"`
+	}{token, tokenStr})
+}
+
+func handleSpecialTokenDelete(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	idInt, err := strconv.Atoi(mux.Vars(r)["tokenId"])
+	if err != nil {
+		writeError(w, "Fail to get tokenId from requested path", http.StatusNotFound)
+		return
+	}
+	err = store.DeleteAccessToken(uint(idInt), user)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
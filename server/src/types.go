@@ -1,10 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -16,6 +19,28 @@ type Task struct {
 	Date        string `json:"date"` // yyyy-mm-dd (https://en.wikipedia.org/wiki/ISO_8601)
 	Time        string `json:"time"` // hh:mm
 	NextTaskIds []uint `json:"nextTaskIds"`
+	Status      string `json:"status"`      // one of the STATUS_* constants
+	StartedAt   string `json:"startedAt"`   // RFC 3339, empty if not started
+	CompletedAt string `json:"completedAt"` // RFC 3339, empty if not done or cancelled
+	// estimated duration in minutes
+	EstimatedDuration uint `json:"estimatedDuration"`
+	// names of the tags, sorted
+	Tags []string `json:"tags"`
+	// deadline of the task, the whole day if there is no time
+	DueDate  string `json:"dueDate"`  // yyyy-mm-dd
+	DueTime  string `json:"dueTime"`  // hh:mm
+	Priority string `json:"priority"` // one of the PRIORITY_* constants
+	// recurrence rule like "FREQ=WEEKLY;BYDAY=MO", see RecurrenceRule
+	Recurrence string `json:"recurrence"`
+	// if the next occurrence gets the next tasks of the task
+	RecurrenceCopyNext bool `json:"recurrenceCopyNext"`
+	// incremented on every change, the ETag of the task is the quoted version
+	Version uint64 `json:"version"`
+	// set by the server, if the deadline has passed and the task isn't done
+	Overdue bool `json:"overdue"`
+	// set by the server, previous tasks (also indirect ones), which start
+	// after the deadline
+	DueConflicts []uint `json:"dueConflicts"`
 }
 
 // all of Task, but no id
@@ -27,6 +52,17 @@ type CreateTask struct {
 	Time            string `json:"time"`
 	NextTaskIds     []uint `json:"nextTaskIds"`
 	PreviousTaskIds []uint `json:"previousTaskIds"`
+	Status          string `json:"status"`
+	// estimated duration in minutes
+	EstimatedDuration uint `json:"estimatedDuration"`
+	// names of the tags, missing tags are created
+	Tags     []string `json:"tags"`
+	DueDate  string   `json:"dueDate"`
+	DueTime  string   `json:"dueTime"`
+	Priority string   `json:"priority"`
+	// recurrence rule, the next occurrence is created when the task is done
+	Recurrence         string `json:"recurrence"`
+	RecurrenceCopyNext bool   `json:"recurrenceCopyNext"`
 }
 
 func (task *CreateTask) GetByKey(key string) (interface{}, bool) {
@@ -44,61 +80,251 @@ func (task *CreateTask) GetByKey(key string) (interface{}, bool) {
 		return task.NextTaskIds, true
 	} else if key == "previousTaskIds" {
 		return task.PreviousTaskIds, true
+	} else if key == "status" {
+		return task.Status, true
+	} else if key == "estimatedDuration" {
+		return task.EstimatedDuration, true
+	} else if key == "tags" {
+		return task.Tags, true
+	} else if key == "dueDate" {
+		return task.DueDate, true
+	} else if key == "dueTime" {
+		return task.DueTime, true
+	} else if key == "priority" {
+		return task.Priority, true
+	} else if key == "recurrence" {
+		return task.Recurrence, true
+	} else if key == "recurrenceCopyNext" {
+		return task.RecurrenceCopyNext, true
 	} else {
 		return nil, false
 	}
 }
 
-type ArrayAggInt struct {
-	Value []uint
-	Valid bool
+const (
+	STATUS_OPEN        = "open"
+	STATUS_IN_PROGRESS = "in_progress"
+	STATUS_DONE        = "done"
+	STATUS_CANCELLED   = "cancelled"
+)
+
+// empty priority means no priority
+const (
+	PRIORITY_LOW    = "low"
+	PRIORITY_MEDIUM = "medium"
+	PRIORITY_HIGH   = "high"
+)
+
+const (
+	BATCH_ACTION_CREATE = "create"
+	BATCH_ACTION_UPDATE = "update"
+	BATCH_ACTION_DELETE = "delete"
+	BATCH_ACTION_LINK   = "link"
+	BATCH_ACTION_UNLINK = "unlink"
+)
+
+// one write of a batch, Task, PatchKeys and Version are used like by
+// InsertTask, UpdateTask and DeleteTask. Link and unlink use Id and
+// NextTaskId like LinkTasks and UnlinkTasks.
+type BatchOperation struct {
+	Action     string
+	Id         uint
+	NextTaskId uint
+	Version    uint64
+	Task       CreateTask
+	PatchKeys  []string
+	// temporary id of a created task, which is referenced by later operations
+	TempId string
+	// temporary ids, which are resolved to the ids of the created tasks before
+	// the operation is applied
+	IdRef            string
+	NextTaskRef      string
+	NextTaskRefs     []string
+	PreviousTaskRefs []string
 }
 
-func (h *ArrayAggInt) Scan(src any) error {
-	arr, ok := src.([]uint8)
-	if !ok {
-		errorStr := fmt.Sprintf("unsupported Scan, storing driver.Value type %T into type []uint8", src)
-		return errors.New(errorStr)
-	}
-	if string(arr) == "{NULL}" {
-		h.Valid = false
+// resolve replaces the temporary ids of the operation by the ids of the
+// created tasks and clears them, so the operation is resolved only once
+func (op *BatchOperation) resolve(created map[string]uint) error {
+	lookup := func(ref string, id *uint) error {
+		if ref == "" {
+			return nil
+		}
+		var ok bool
+		*id, ok = created[ref]
+		if !ok {
+			return errors.New(fmt.Sprintf("Unknown temporary id '%s'", ref))
+		}
 		return nil
 	}
-	arrLen := len(arr)
-	value := make([]uint, 0)
-	if arr[0] != 123 || arr[arrLen-1] != 125 {
-		return errors.New("unsupported Scan, No grouped Value with {}")
-	}
-	curValueArr := make([]uint, 0)
-	for index, item := range arr {
-		if item == 44 || index == arrLen-1 {
-			var curValue uint = 0
-			curValueArrIdx := 0
-			for i := len(curValueArr) - 1; i >= 0; i-- {
-				v := curValueArr[i]
-				var digitFactor uint = uint(curValueArrIdx * 10)
-				if digitFactor == 0 {
-					digitFactor = 1
-				}
-				curValue += v * digitFactor
-				curValueArrIdx++
-			}
-			value = append(value, curValue)
-			curValueArr = make([]uint, 0)
-		}
-		if index != 0 && index != arrLen-1 && item >= 48 && item <= 57 {
-			curValueArr = append(curValueArr, uint(item-48))
+	if err := lookup(op.IdRef, &op.Id); err != nil {
+		return err
+	}
+	if err := lookup(op.NextTaskRef, &op.NextTaskId); err != nil {
+		return err
+	}
+	op.Task.NextTaskIds = append([]uint{}, op.Task.NextTaskIds...)
+	for _, ref := range op.NextTaskRefs {
+		var id uint
+		if err := lookup(ref, &id); err != nil {
+			return err
 		}
+		op.Task.NextTaskIds = append(op.Task.NextTaskIds, id)
 	}
-	if len(value) > 0 {
-		h.Value = value
-		h.Valid = true
-	} else {
-		h.Valid = false
+	op.Task.PreviousTaskIds = append([]uint{}, op.Task.PreviousTaskIds...)
+	for _, ref := range op.PreviousTaskRefs {
+		var id uint
+		if err := lookup(ref, &id); err != nil {
+			return err
+		}
+		op.Task.PreviousTaskIds = append(op.Task.PreviousTaskIds, id)
 	}
+	op.Task.NextTaskIds = uniqueIds(op.Task.NextTaskIds)
+	op.Task.PreviousTaskIds = uniqueIds(op.Task.PreviousTaskIds)
+	op.IdRef, op.NextTaskRef = "", ""
+	op.NextTaskRefs, op.PreviousTaskRefs = nil, nil
 	return nil
 }
 
+type BatchResult struct {
+	Action string `json:"action"`
+	Id     uint   `json:"id"`
+	TempId string `json:"tempId,omitempty"`
+}
+
+// BatchError is returned, if an operation of a batch failed. In this case
+// none of the operations are applied.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d failed: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// VersionError is returned, if a task was changed since the version, which
+// the client knows
+type VersionError struct {
+	Id uint
+	// current version of the task
+	Version uint64
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Task %d was changed, its version is %d", e.Id, e.Version)
+}
+
+// TaskNotFoundError is returned, if a task doesn't exist or belongs to
+// another user. The message is formatted with the id.
+type TaskNotFoundError struct {
+	Id      uint
+	Message string
+}
+
+func (e *TaskNotFoundError) Error() string {
+	return fmt.Sprintf(e.Message, e.Id)
+}
+
+// ExpiredCursorError is returned, if changes after the cursor were already
+// deleted from the change log
+type ExpiredCursorError struct {
+	Cursor uint64
+}
+
+func (e *ExpiredCursorError) Error() string {
+	return fmt.Sprintf("Cursor %d is too old, sync all tasks again", e.Cursor)
+}
+
+// a task of an import, its previous tasks are given as indexes of other
+// tasks of the same import. Valid timestamps replace the timestamps, which
+// are set by the status.
+type ImportTask struct {
+	Task            CreateTask
+	PreviousIndexes []int
+	StartedAt       sql.NullTime
+	CompletedAt     sql.NullTime
+}
+
+// addPreviousIndex adds the index of a previous task, if it isn't added yet.
+// Files often state a relation on both tasks, but the edge must be inserted
+// only once.
+func (t *ImportTask) addPreviousIndex(index int) {
+	for _, previous := range t.PreviousIndexes {
+		if previous == index {
+			return
+		}
+	}
+	t.PreviousIndexes = append(t.PreviousIndexes, index)
+}
+
+// filter for the list of tasks, empty fields are ignored
+type TaskFilter struct {
+	// only the tasks with these ids, if it isn't nil
+	Ids    []uint
+	Status []string
+	// range of the date, both are inclusive (yyyy-mm-dd)
+	DateFrom string
+	DateTo   string
+	// case insensitive text in the title, description or location
+	Query string
+	// if the task has previous tasks
+	HasDependencies *bool
+	// if the task has next tasks
+	HasDependents *bool
+	// one of the TASK_SORT_* constants, TASK_SORT_ID if empty
+	Sort       string
+	Descending bool
+	// only the tasks after the cursor are returned
+	After *TaskCursor
+	// maximum number of tasks, 0 is unlimited
+	Limit uint
+	// expression over the tag names like "work AND NOT blocked"
+	Tags *TagExpression
+}
+
+// position of a task in a sorted list of tasks
+type TaskCursor struct {
+	Id    uint   `json:"id"`
+	Value string `json:"value"`
+}
+
+// StatusTimestamps returns the started and completed timestamps of a task,
+// whose status changes from oldStatus to newStatus
+func StatusTimestamps(
+	oldStatus string,
+	startedAt sql.NullTime,
+	completedAt sql.NullTime,
+	newStatus string,
+	now time.Time,
+) (sql.NullTime, sql.NullTime) {
+	if oldStatus == newStatus {
+		return startedAt, completedAt
+	}
+	switch newStatus {
+	case STATUS_OPEN:
+		return sql.NullTime{}, sql.NullTime{}
+	case STATUS_IN_PROGRESS:
+		if !startedAt.Valid {
+			startedAt = sql.NullTime{Time: now, Valid: true}
+		}
+		return startedAt, sql.NullTime{}
+	default:
+		return startedAt, sql.NullTime{Time: now, Valid: true}
+	}
+}
+
+// a label of tasks, the names are unique per user
+type Tag struct {
+	Id    uint   `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"` // #rrggbb or empty
+}
+
 type User struct {
 	Username string `json:"username"`
 	Fullname string `json:"fullname"`
@@ -107,25 +333,51 @@ type User struct {
 	Salt     []byte
 }
 
-type TokenUser struct {
-	User       string
-	CreateDate time.Time
+// a login of a user, the token itself is only known by the client
+type Session struct {
+	Id         uint      `json:"id"`
+	User       string    `json:"-"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	UserAgent  string    `json:"userAgent"`
+	Ip         string    `json:"ip"`
+	Current    bool      `json:"current"` // session of the request
 }
 
-func (t *TokenUser) expired(ttl int) bool {
+func (s *Session) expired(ttl int) bool {
 	ttlDuration, err := time.ParseDuration(fmt.Sprintf("%dh", 24*ttl))
 	if err != nil {
 		logger.Error.Println(err)
 		return false
 	}
-	if time.Now().Sub(t.CreateDate) > ttlDuration {
+	if time.Now().Sub(s.CreatedAt) > ttlDuration {
 		return true
 	}
 	return false
 }
 
-func NewTokenUser(username string) TokenUser {
-	return TokenUser{username, time.Now()}
+// a long-lived token for automation, which is restricted to some scopes
+type AccessToken struct {
+	Id         uint       `json:"id"`
+	User       string     `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"` // nil if the token never expires
+}
+
+func (t *AccessToken) expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+func (t *AccessToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 func ValidateDate(dateStr string) bool {
@@ -154,21 +406,96 @@ func ValidateTime(timeStr string) bool {
 	return valid
 }
 
+// empty status is valid and means STATUS_OPEN
+func ValidateStatus(status string) bool {
+	switch status {
+	case "", STATUS_OPEN, STATUS_IN_PROGRESS, STATUS_DONE, STATUS_CANCELLED:
+		return true
+	}
+	return false
+}
+
+func ValidatePriority(priority string) bool {
+	switch priority {
+	case "", PRIORITY_LOW, PRIORITY_MEDIUM, PRIORITY_HIGH:
+		return true
+	}
+	return false
+}
+
+var tagNameRegex = regexp.MustCompile(`^[^\s()]+$`)
+
+// ValidateTagName checks, if a tag can be used in tag expressions, so it must
+// not contain whitespace or parentheses and must not be an operator
+func ValidateTagName(name string) bool {
+	switch strings.ToUpper(name) {
+	case "AND", "OR", "NOT":
+		return false
+	}
+	return tagNameRegex.MatchString(name)
+}
+
+var colorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func ValidateColor(color string) bool {
+	return color == "" || colorRegex.MatchString(color)
+}
+
+// uniqueIds removes duplicate ids and keeps the order of the others
+func uniqueIds(ids []uint) []uint {
+	if ids == nil {
+		return nil
+	}
+	seen := make(map[uint]bool)
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// ValidateCreateTask validates the task and removes duplicate ids of its next
+// and previous tasks, so every store inserts the same edges
 func ValidateCreateTask(createTask *CreateTask) bool {
+	createTask.NextTaskIds = uniqueIds(createTask.NextTaskIds)
+	createTask.PreviousTaskIds = uniqueIds(createTask.PreviousTaskIds)
 	return ValidateTask(&Task{
-		0,
-		createTask.Title,
-		createTask.Description,
-		createTask.Location,
-		createTask.Date,
-		createTask.Time,
-		createTask.NextTaskIds})
+		Title:       createTask.Title,
+		Description: createTask.Description,
+		Location:    createTask.Location,
+		Date:        createTask.Date,
+		Time:        createTask.Time,
+		NextTaskIds: createTask.NextTaskIds,
+		Status:      createTask.Status,
+		Tags:        createTask.Tags,
+		DueDate:     createTask.DueDate,
+		DueTime:     createTask.DueTime,
+		Priority:    createTask.Priority,
+		Recurrence:  createTask.Recurrence,
+	})
 }
 
 func ValidateTask(task *Task) bool {
 	if task.Title != "" {
 		if ValidateDate(task.Date) {
 			if ValidateTime(task.Time) {
+				if !ValidateStatus(task.Status) {
+					return false
+				}
+				if !ValidateDate(task.DueDate) || !ValidateTime(task.DueTime) {
+					return false
+				}
+				if !ValidatePriority(task.Priority) || !ValidateRecurrence(task.Recurrence) {
+					return false
+				}
+				for _, tag := range task.Tags {
+					if !ValidateTagName(tag) {
+						return false
+					}
+				}
 				return true
 			}
 		}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestStatusTimestamps(t *testing.T) {
+	before := sql.NullTime{Time: time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC), Valid: true}
+	now := time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+	at := sql.NullTime{Time: now, Valid: true}
+	none := sql.NullTime{}
+	tests := []struct {
+		oldStatus   string
+		startedAt   sql.NullTime
+		completedAt sql.NullTime
+		newStatus   string
+		started     sql.NullTime
+		completed   sql.NullTime
+	}{
+		{STATUS_OPEN, none, none, STATUS_IN_PROGRESS, at, none},
+		{STATUS_OPEN, none, none, STATUS_DONE, none, at},
+		{STATUS_IN_PROGRESS, before, none, STATUS_DONE, before, at},
+		{STATUS_IN_PROGRESS, before, none, STATUS_CANCELLED, before, at},
+		{STATUS_DONE, before, before, STATUS_IN_PROGRESS, before, none},
+		{STATUS_DONE, before, before, STATUS_OPEN, none, none},
+		{STATUS_DONE, before, before, STATUS_DONE, before, before},
+	}
+	for _, test := range tests {
+		started, completed := StatusTimestamps(test.oldStatus, test.startedAt, test.completedAt, test.newStatus, now)
+		if started != test.started || completed != test.completed {
+			t.Errorf("%s -> %s: StatusTimestamps() = %v, %v, want %v, %v",
+				test.oldStatus, test.newStatus, started, completed, test.started, test.completed)
+		}
+	}
+}
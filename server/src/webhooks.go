@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// outgoing webhooks, which are called on events of the tasks. The deliveries
+// are queued in the transaction of the change and are sent by a worker, which
+// retries failed deliveries with exponential backoff.
+
+const (
+	WEBHOOK_DELIVERY_PENDING   = "pending"
+	WEBHOOK_DELIVERY_DELIVERED = "delivered"
+	// all attempts failed
+	WEBHOOK_DELIVERY_FAILED = "failed"
+)
+
+// events, which can be selected by webhooks
+var webhookEvents = []string{
+	EVENT_TASK_CREATED,
+	EVENT_TASK_UPDATED,
+	EVENT_TASK_DELETED,
+	EVENT_TASK_COMPLETED,
+	EVENT_DEPENDENCIES_CHANGED,
+}
+
+const (
+	WEBHOOK_EVENT_HEADER    = "X-Smart-Todo-Event"
+	WEBHOOK_DELIVERY_HEADER = "X-Smart-Todo-Delivery"
+	// "sha256=" and the hex encoded HMAC-SHA256 of the body with the secret
+	WEBHOOK_SIGNATURE_HEADER = "X-Smart-Todo-Signature"
+)
+
+const (
+	WEBHOOK_TIMEOUT       = 10 * time.Second
+	WEBHOOK_POLL_INTERVAL = 10 * time.Second
+	// delay after the first failed attempt, it's doubled after every attempt
+	WEBHOOK_RETRY_DELAY  = 30 * time.Second
+	WEBHOOK_MAX_ATTEMPTS = 8
+	// finished deliveries are deleted after this time
+	WEBHOOK_HISTORY_TTL = 30 * 24 * time.Hour
+)
+
+// number of deliveries, which are loaded at once
+const WEBHOOK_BATCH_SIZE = 50
+
+// number of webhooks, which are called at once
+const WEBHOOK_CONCURRENCY = 8
+
+// maximum number of deliveries in the history of a webhook
+const WEBHOOK_HISTORY_LIMIT = 100
+
+type Webhook struct {
+	Id   uint   `json:"id"`
+	User string `json:"-"`
+	Url  string `json:"url"`
+	// types of the events, empty for all events
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (w *Webhook) accepts(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a queued or finished delivery of an event, the times
+// are in UTC
+type WebhookDelivery struct {
+	Id             uint64          `json:"id"`
+	WebhookId      uint            `json:"webhookId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"` // one of the WEBHOOK_DELIVERY_* constants
+	Attempts       uint            `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	LastAttemptAt  *time.Time      `json:"lastAttemptAt"`
+	ResponseStatus int             `json:"responseStatus"` // 0 if there was no response
+	Error          string          `json:"error"`
+	CreatedAt      time.Time       `json:"createdAt"`
+}
+
+// DueDelivery is a pending delivery with the webhook, which is needed to send
+// it
+type DueDelivery struct {
+	WebhookDelivery
+	Url    string
+	Secret string
+}
+
+// WebhookPayload is the body, which is sent to the webhooks
+type WebhookPayload struct {
+	Event  string `json:"event"`
+	TaskId uint   `json:"taskId"`
+	// the task after the change, null if it's deleted
+	Task      *Task     `json:"task"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// NewWebhookDeliveries returns the deliveries of the events to the webhooks,
+// which accept them. selectTask returns the current task or nil, if the task
+// is deleted.
+func NewWebhookDeliveries(
+	webhooks []Webhook,
+	userEvents []Event,
+	selectTask func(id uint) (*Task, error),
+	now time.Time,
+) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+	for _, event := range userEvents {
+		var payload []byte
+		for _, webhook := range webhooks {
+			if !webhook.accepts(event.Type) {
+				continue
+			}
+			if payload == nil {
+				task, err := selectTask(event.TaskId)
+				if err != nil {
+					return nil, err
+				}
+				payload, err = json.Marshal(WebhookPayload{event.Type, event.TaskId, task, now})
+				if err != nil {
+					return nil, err
+				}
+			}
+			deliveries = append(deliveries, WebhookDelivery{
+				WebhookId:     webhook.Id,
+				Event:         event.Type,
+				Payload:       payload,
+				Status:        WEBHOOK_DELIVERY_PENDING,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			})
+		}
+	}
+	return deliveries, nil
+}
+
+// wakes up the worker, when deliveries were queued
+var webhooksQueued = make(chan bool, 1)
+
+func notifyWebhookWorker() {
+	select {
+	case webhooksQueued <- true:
+	default:
+	}
+}
+
+// webhookAddressAllowed returns false for loopback, private, link-local and
+// unspecified addresses, which aren't in the allowed networks of the config.
+// Otherwise webhooks could call the internal services of the server.
+func webhookAddressAllowed(ip net.IP) bool {
+	for _, network := range config.Webhooks.AllowedNetworks {
+		// validated by the config
+		_, ipNet, err := net.ParseCIDR(network)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified()
+}
+
+// the address is checked again when connecting, because the DNS could
+// resolve the host to another address than at the registration
+var webhookDialer = &net.Dialer{
+	Timeout: WEBHOOK_TIMEOUT,
+	Control: func(network string, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !webhookAddressAllowed(ip) {
+			return errors.New(fmt.Sprintf("address %s is not allowed", host))
+		}
+		return nil
+	},
+}
+
+var webhookClient = &http.Client{
+	Timeout: WEBHOOK_TIMEOUT,
+	// no proxy, so the dialer checks the address of the webhook
+	Transport: &http.Transport{
+		DialContext:         webhookDialer.DialContext,
+		TLSHandshakeTimeout: WEBHOOK_TIMEOUT,
+	},
+	// a redirect is a failed delivery
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func signWebhookPayload(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook sends the delivery once and sets the result of the attempt
+func deliverWebhook(delivery *DueDelivery, now time.Time) {
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseStatus = 0
+	delivery.Error = ""
+	request, err := http.NewRequest("POST", delivery.Url, strings.NewReader(string(delivery.Payload)))
+	if err == nil {
+		request.Header.Set("Content-Type", JSON_CONTENT_TYPE)
+		request.Header.Set("User-Agent", "smart-todo-webhook")
+		request.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event)
+		request.Header.Set(WEBHOOK_DELIVERY_HEADER, strconv.FormatUint(delivery.Id, 10))
+		request.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhookPayload(delivery.Payload, delivery.Secret))
+		var response *http.Response
+		response, err = webhookClient.Do(request)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+			delivery.ResponseStatus = response.StatusCode
+			if response.StatusCode >= 200 && response.StatusCode < 300 {
+				delivery.Status = WEBHOOK_DELIVERY_DELIVERED
+				return
+			}
+			delivery.Error = response.Status
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		delivery.Status = WEBHOOK_DELIVERY_FAILED
+		return
+	}
+	delivery.NextAttemptAt = now.Add(WEBHOOK_RETRY_DELAY << (delivery.Attempts - 1))
+}
+
+// the webhooks, whose deliveries are sent at the moment
+var webhooksInFlightMutex sync.Mutex
+var webhooksInFlight = make(map[uint]bool)
+
+var webhookSlots = make(chan bool, WEBHOOK_CONCURRENCY)
+
+// deliverWebhookQueue sends the due deliveries of a webhook in order. After a
+// failed attempt the other deliveries wait for the next cycle, so a slow
+// webhook costs at most one timeout per cycle and doesn't delay the other
+// webhooks.
+func deliverWebhookQueue(webhookId uint, deliveries []DueDelivery) {
+	webhookSlots <- true
+	defer func() {
+		<-webhookSlots
+		webhooksInFlightMutex.Lock()
+		delete(webhooksInFlight, webhookId)
+		webhooksInFlightMutex.Unlock()
+	}()
+	for i := range deliveries {
+		deliverWebhook(&deliveries[i], time.Now().UTC())
+		if err := store.UpdateDelivery(deliveries[i].WebhookDelivery); err != nil {
+			logger.Error.Println(err)
+			return
+		}
+		if deliveries[i].Status == WEBHOOK_DELIVERY_PENDING {
+			return
+		}
+	}
+}
+
+// deliverDueWebhooks starts to send the deliveries, which are due, without
+// waiting for them. The webhooks, which are still sending, are skipped.
+func deliverDueWebhooks() {
+	for {
+		webhooksInFlightMutex.Lock()
+		inFlight := make([]uint, 0, len(webhooksInFlight))
+		for id := range webhooksInFlight {
+			inFlight = append(inFlight, id)
+		}
+		webhooksInFlightMutex.Unlock()
+		deliveries, err := store.SelectDueDeliveries(time.Now().UTC(), inFlight, WEBHOOK_BATCH_SIZE)
+		if err != nil {
+			logger.Error.Println(err)
+			return
+		}
+		webhookIds := make([]uint, 0)
+		queues := make(map[uint][]DueDelivery)
+		for _, delivery := range deliveries {
+			if _, ok := queues[delivery.WebhookId]; !ok {
+				webhookIds = append(webhookIds, delivery.WebhookId)
+			}
+			queues[delivery.WebhookId] = append(queues[delivery.WebhookId], delivery)
+		}
+		webhooksInFlightMutex.Lock()
+		for _, id := range webhookIds {
+			webhooksInFlight[id] = true
+		}
+		webhooksInFlightMutex.Unlock()
+		for _, id := range webhookIds {
+			go deliverWebhookQueue(id, queues[id])
+		}
+		// the next batch skips the webhooks of this one
+		if len(deliveries) < WEBHOOK_BATCH_SIZE {
+			return
+		}
+	}
+}
+
+// runWebhookWorker sends the queued deliveries and deletes the old ones, it
+// runs until the server stops
+func runWebhookWorker() {
+	poll := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-poll.C:
+		case <-webhooksQueued:
+		case <-cleanup.C:
+			err := store.DeleteDeliveries(time.Now().UTC().Add(-WEBHOOK_HISTORY_TTL))
+			if err != nil {
+				logger.Error.Println(err)
+			}
+			continue
+		}
+		deliverDueWebhooks()
+	}
+}
+
+// validateWebhookUrl returns an error message, if the URL isn't an http or
+// https URL or one of the addresses of its host isn't allowed
+func validateWebhookUrl(webhookUrl string) string {
+	u, err := url.Parse(webhookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "url must be an http or https URL"
+	}
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(u.Hostname())
+		if err != nil {
+			return fmt.Sprintf("Can't resolve the host %s", u.Hostname())
+		}
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			return "url must not be a loopback, private or link-local address"
+		}
+	}
+	return ""
+}
+
+func handleWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	webhooks, err := store.SelectWebhooks(user)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func handleWebhooksPost(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	if r.Header.Get("Content-Type") != JSON_CONTENT_TYPE {
+		writeError(w, "Content-Type must be 'application/json'", http.StatusBadRequest)
+		return
+	}
+	var createObj struct {
+		Url    string   `json:"url"`
+		Events []string `json:"events"`
+		// generated, if it's empty
+		Secret string `json:"secret"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&createObj)
+	if err != nil {
+		writeError(w, "Can't parse json body", http.StatusBadRequest)
+		return
+	}
+	if error := validateWebhookUrl(createObj.Url); error != "" {
+		writeError(w, error, http.StatusBadRequest)
+		return
+	}
+	events := make([]string, 0, len(createObj.Events))
+	for _, event := range createObj.Events {
+		valid := false
+		for _, e := range webhookEvents {
+			valid = valid || e == event
+		}
+		if !valid {
+			writeError(
+				w,
+				fmt.Sprintf("unknown event '%s', must be one of %s", event, strings.Join(webhookEvents, ", ")),
+				http.StatusBadRequest,
+			)
+			return
+		}
+		events = append(events, event)
+	}
+	webhook := Webhook{
+		User:      user,
+		Url:       createObj.Url,
+		Events:    events,
+		Secret:    createObj.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if webhook.Secret == "" {
+		secret, err := getSalt(32)
+		if err != nil {
+			writeError(w, fmt.Sprintf("fail to get secret: %v", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	webhook.Id, err = store.InsertWebhook(webhook)
+	if err != nil {
+		logger.Error.Println(err)
+		writeError(w, "Failed to store webhook", http.StatusInternalServerError)
+		return
+	}
+	// the secret is only shown once
+	json.NewEncoder(w).Encode(struct {
+		Webhook
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret})
+}
+
+func parseWebhookId(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	idInt, err := strconv.Atoi(mux.Vars(r)["webhookId"])
+	if err != nil {
+		writeError(w, "Fail to get webhookId from requested path", http.StatusNotFound)
+		return 0, false
+	}
+	return uint(idInt), true
+}
+
+func handleSpecialWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	id, ok := parseWebhookId(w, r)
+	if !ok {
+		return
+	}
+	err := store.DeleteWebhook(id, user)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleWebhookDeliveriesGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("username")
+	w.Header().Add("Content-Type", JSON_CONTENT_TYPE)
+	id, ok := parseWebhookId(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := store.SelectDeliveries(id, user, WEBHOOK_HISTORY_LIMIT)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeError(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Error.Println(err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}